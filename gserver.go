@@ -0,0 +1,9 @@
+package main
+
+import (
+    "github.com/jaekwon/gourami/server"
+)
+
+func main() {
+    server.Main()
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+    "os"
+    "io"
+    "errors"
+    "encoding/json"
+    "time"
+    "bytes"
+    "io/ioutil"
+    "crypto/rand"
+    "code.google.com/p/go.crypto/nacl/secretbox"
+    "code.google.com/p/go.crypto/scrypt"
+    "github.com/jaekwon/gourami/types"
+    "github.com/jaekwon/gourami/storage"
+)
+
+const ConfigVersion = "0"
+
+type Peer struct {
+    Name string                 `json:"name"`
+    Address string              `json:"address"`
+    Identity string             `json:"identity"` // public key, see types.KeyToString
+}
+
+type Quotas struct {
+    DefaultCapacity int64       `json:"default_capacity"`    // bytes allocated per account
+    MaxDepositSize int64        `json:"max_deposit_size"`
+}
+
+type Retention struct {
+    SweepInterval int64         `json:"sweep_interval_seconds"`
+    SweepBatchSize int          `json:"sweep_batch_size"`
+}
+
+type RateLimits struct {
+    Sender Rate                 `json:"sender"`
+    Recipient Rate              `json:"recipient"`
+    Conn Rate                   `json:"conn"`
+    MaxKeys int                 `json:"max_keys"`
+}
+
+/* The server's configuration file, stored as plain JSON.
+ * The identity is kept separately in an encrypted IdentityFile.
+ */
+type Config struct {
+    Version string              `json:"version"`
+    Listen []string             `json:"listen"`
+    IdentityFile string         `json:"identity_file"`
+    StorageRoot string          `json:"storage_root"`
+    Quotas Quotas               `json:"quotas"`
+    Retention Retention         `json:"retention"`
+    RateLimits RateLimits       `json:"rate_limits"`
+    MaxConns int                `json:"max_conns"`
+    Peers []Peer                `json:"peers"`
+}
+
+func DefaultConfig() *Config {
+    return &Config{
+        Version: ConfigVersion,
+        Listen: []string{":7373"},
+        IdentityFile: "./gserver.identity",
+        StorageRoot: "./gserver-data",
+        Quotas: Quotas{
+            DefaultCapacity: 1024 * 1024 * 1024,
+            MaxDepositSize: DefaultMaxDepositSize,
+        },
+        Retention: Retention{
+            SweepInterval: int64(storage.DefaultSweepInterval / time.Second),
+            SweepBatchSize: storage.DefaultSweepBatchSize,
+        },
+        RateLimits: RateLimits{
+            Sender: DefaultSenderRate,
+            Recipient: DefaultRecipientRate,
+            Conn: DefaultConnRate,
+            MaxKeys: DefaultMaxLimiterKeys,
+        },
+        MaxConns: DefaultMaxConns,
+        Peers: []Peer{},
+    }
+}
+
+func (this *Config) Validate() error {
+    if this.Version != ConfigVersion {
+        return errors.New("Unsupported config version: " + this.Version) }
+    if len(this.Listen) == 0 {
+        return errors.New("Config must list at least one listen address") }
+    if this.IdentityFile == "" {
+        return errors.New("Config is missing identity_file") }
+    if this.StorageRoot == "" {
+        return errors.New("Config is missing storage_root") }
+    if this.Retention.SweepInterval <= 0 || this.Retention.SweepBatchSize <= 0 {
+        return errors.New("Config retention values must be positive") }
+    for _, peer := range this.Peers {
+        if _, err := types.StringToKey(peer.Identity); err != nil {
+            return errors.New("Invalid identity for peer " + peer.Name + ": " + err.Error()) }
+    }
+    return nil
+}
+
+func (this *Config) Sweeper(target storage.ExpirySweepable) *storage.Sweeper {
+    sweeper := storage.NewSweeper(target)
+    sweeper.Interval = time.Duration(this.Retention.SweepInterval) * time.Second
+    sweeper.BatchSize = this.Retention.SweepBatchSize
+    return sweeper
+}
+
+func (this *Config) Limits() *Limits {
+    rl := this.RateLimits
+    return &Limits{
+        Sender: NewLimiter(rl.Sender, rl.MaxKeys),
+        Recipient: NewLimiter(rl.Recipient, rl.MaxKeys),
+        Conn: NewLimiter(rl.Conn, rl.MaxKeys),
+    }
+}
+
+// Apply the configured rates to limits already in use, e.g. on reload
+func (this *Config) ApplyRates(limits *Limits) {
+    rl := this.RateLimits
+    limits.SetRates(rl.Sender, rl.Recipient, rl.Conn)
+}
+
+// Refuses to overwrite an existing file
+func (this *Config) Save(filepath string) error {
+    file, err := os.OpenFile(filepath, os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0600)
+    if err != nil { return err }
+    defer file.Close()
+    configBytes, err := json.MarshalIndent(this, "", "    ")
+    if err != nil { return err }
+    _, err = file.Write(append(configBytes, '\n'))
+    if err != nil {
+        os.Remove(filepath)
+        return err }
+    return nil
+}
+
+func LoadConfig(filepath string) (*Config, error) {
+    file, err := os.Open(filepath)
+    if err != nil { return nil, err }
+    defer file.Close()
+    config := DefaultConfig()
+    err = json.NewDecoder(file).Decode(config)
+    if err != nil { return nil, errors.New("Invalid config file: " + err.Error()) }
+    err = config.Validate()
+    if err != nil { return nil, err }
+    return config, nil
+}
+
+/* The identity file holds the server's key pair as JSON, encrypted
+ *  via a CipherWriter with a key derived from a password by scrypt.
+ * It starts with a line of JSON giving the salt & cost parameters.
+ */
+
+type identityKdf struct {
+    Kdf string
+    Salt []byte
+    N int
+    R int
+    P int
+}
+
+const identityKdfScrypt = "scrypt"
+
+// the prefix of the identity file's first line
+var identityKdfPrefix = []byte(`{"Kdf":`)
+
+// the maximum size of the encrypted key pair
+const identityMaxSize = 10240
+
+func newIdentityKdf() (*identityKdf, error) {
+    salt := make([]byte, 16)
+    _, err := rand.Read(salt)
+    if err != nil { return nil, err }
+    return &identityKdf{identityKdfScrypt, salt, 1 << 15, 8, 1}, nil
+}
+
+func (this *identityKdf) key(password string) (*[32]byte, error) {
+    if this.Kdf != identityKdfScrypt {
+        return nil, errors.New("Unknown key derivation in identity file: " + this.Kdf) }
+    derived, err := scrypt.Key([]byte(password), this.Salt, this.N, this.R, this.P, 32)
+    if err != nil { return nil, err }
+    key := new([32]byte)
+    copy(key[:], derived)
+    return key, nil
+}
+
+// Refuses to overwrite an existing file
+func SaveIdentity(filepath string, identity *types.Identity, password string) error {
+    if identity.PrivateKey == nil {
+        return errors.New("Identity lacks PrivateKey") }
+    kdf, err := newIdentityKdf()
+    if err != nil { return err }
+    key, err := kdf.key(password)
+    if err != nil { return err }
+    header, err := json.Marshal(kdf)
+    if err != nil { return err }
+    file, err := os.OpenFile(filepath, os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0600)
+    if err != nil { return err }
+    defer file.Close()
+    _, err = file.Write(append(header, '\n'))
+    cipherWriter := types.NewCipherWriter(file, key, int64(identityMaxSize))
+    if err == nil {
+        err = json.NewEncoder(cipherWriter).Encode(identity) }
+    if err == nil {
+        err = cipherWriter.Close() }
+    if err == nil {
+        err = file.Sync() }
+    if err != nil {
+        os.Remove(filepath)
+        return err }
+    return nil
+}
+
+func LoadIdentity(filepath string, password string) (*types.Identity, error) {
+    file, err := os.Open(filepath)
+    if err != nil { return nil, err }
+    defer file.Close()
+    data, err := ioutil.ReadAll(io.LimitReader(file, identityMaxSize + 1024))
+    if err != nil { return nil, err }
+    end := bytes.IndexByte(data, '\n')
+    if !bytes.HasPrefix(data, identityKdfPrefix) || end < 0 {
+        return nil, errors.New("Invalid identity file: no key derivation header") }
+    kdf := &identityKdf{}
+    err = json.Unmarshal(data[:end], kdf)
+    if err != nil { return nil, errors.New("Invalid identity file: " + err.Error()) }
+    key, err := kdf.key(password)
+    if err != nil { return nil, err }
+    data = data[end+1:]
+    // a single chunk: 24 byte nonce, then the sealed JSON
+    size := int64(len(data)) - 24 - secretbox.Overhead
+    if size <= 0 || len(data) > identityMaxSize {
+        return nil, errors.New("Invalid identity file") }
+    reader := types.NewCipherReaderAt(bytes.NewReader(data), key, int64(identityMaxSize))
+    identityBytes := make([]byte, size)
+    _, err = reader.ReadAt(identityBytes, 0)
+    if err != nil && err != io.EOF {
+        return nil, errors.New("Could not decrypt identity file (wrong password?): " + err.Error()) }
+    var identity types.Identity
+    err = json.Unmarshal(identityBytes, &identity)
+    if err != nil { return nil, errors.New("Invalid identity file: " + err.Error()) }
+    if identity.PublicKey == nil || identity.PrivateKey == nil {
+        return nil, errors.New("Identity file lacks keys") }
+    return &identity, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+    "os"
+    "bytes"
+    "io/ioutil"
+    "testing"
+    "reflect"
+    "github.com/jaekwon/gourami/types"
+)
+
+func TestConfig(t *testing.T) {
+    configPath := "../.testServerConfig"
+    identityPath := "../.testServerIdentity"
+    defer os.Remove(configPath)
+    defer os.Remove(identityPath)
+
+    config := DefaultConfig()
+    config.IdentityFile = identityPath
+    config.Peers = append(config.Peers, Peer{"peer", "localhost:7374", types.KeyToString(types.GenerateIdentity().PublicKey)})
+    err := config.Save(configPath)
+    if err != nil { t.Fatal(err) }
+    if config.Save(configPath) == nil {
+        t.Fatal("Expected Save to refuse to overwrite")
+    }
+    config2, err := LoadConfig(configPath)
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(config, config2) {
+        t.Fatal("Loaded config differs from saved config")
+    }
+
+    identity := types.GenerateIdentity()
+    err = SaveIdentity(identityPath, identity, "secret")
+    if err != nil { t.Fatal(err) }
+    identity2, err := LoadIdentity(identityPath, "secret")
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(identity, identity2) {
+        t.Fatal("Loaded identity differs from saved identity")
+    }
+    _, err = LoadIdentity(identityPath, "wrong")
+    if err == nil {
+        t.Fatal("Expected wrong password to fail")
+    }
+    data, _ := ioutil.ReadFile(identityPath)
+    if !bytes.HasPrefix(data, []byte(`{"Kdf":"scrypt","Salt":`)) {
+        t.Fatal("Expected the identity file to start with its scrypt parameters")
+    }
+
+    // files without the scrypt header are refused
+    headerless := identityPath + ".headerless"
+    defer os.Remove(headerless)
+    ioutil.WriteFile(headerless, data[bytes.IndexByte(data, '\n')+1:], 0600)
+    _, err = LoadIdentity(headerless, "secret")
+    if err == nil {
+        t.Fatal("Expected a file without a key derivation header to fail")
+    }
+}
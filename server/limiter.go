@@ -0,0 +1,192 @@
+package server
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+/* A Rate for a token bucket.
+ * Buckets refill at PerSecond tokens per second, up to Burst tokens.
+ */
+type Rate struct {
+    PerSecond float64       `json:"per_second"`
+    Burst float64           `json:"burst"`
+}
+
+type bucket struct {
+    key string
+    tokens float64
+    last time.Time
+}
+
+/* A Limiter keeps a token bucket per key (e.g. an identity or a connection).
+ * Only the MaxKeys most recently used buckets are kept, so memory is bounded.
+ * An evicted key starts over with a full bucket.
+ */
+type Limiter struct {
+    MaxKeys int
+
+    mtx sync.Mutex
+    rate Rate
+    buckets map[string]*list.Element
+    lru *list.List // front is most recently used
+    now func() time.Time
+}
+
+func NewLimiter(rate Rate, maxKeys int) *Limiter {
+    return &Limiter{
+        MaxKeys: maxKeys,
+        rate: rate,
+        buckets: make(map[string]*list.Element),
+        lru: list.New(),
+        now: time.Now,
+    }
+}
+
+func (this *Limiter) Rate() Rate {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.rate
+}
+
+// Change the rate at runtime. Existing buckets keep their tokens.
+func (this *Limiter) SetRate(rate Rate) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    this.rate = rate
+}
+
+// Number of keys currently tracked
+func (this *Limiter) Len() int {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.lru.Len()
+}
+
+/* Take a token for key.
+ * If none is available, returns false and how long until one will be.
+ */
+func (this *Limiter) Allow(key string) (bool, time.Duration) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    b, wait := this.refill(key)
+    if wait != 0 { return false, wait }
+    b.tokens -= 1
+    return true, 0
+}
+
+/* refill key's bucket, returning it & how long until it holds a token:
+ *  0 if it does, negative if it never will.
+ * caller must hold this.mtx
+ */
+func (this *Limiter) refill(key string) (*bucket, time.Duration) {
+    now := this.now()
+    b := this.get(key, now)
+    b.tokens += now.Sub(b.last).Seconds() * this.rate.PerSecond
+    if b.tokens > this.rate.Burst { b.tokens = this.rate.Burst }
+    b.last = now
+    if b.tokens >= 1 { return b, 0 }
+    if this.rate.PerSecond <= 0 { return b, time.Duration(-1) }
+    wait := (1 - b.tokens) / this.rate.PerSecond
+    return b, time.Duration(wait * float64(time.Second))
+}
+
+// Forget key, e.g. when a connection closes.
+func (this *Limiter) Remove(key string) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if elem, ok := this.buckets[key]; ok {
+        this.lru.Remove(elem)
+        delete(this.buckets, key)
+    }
+}
+
+// get or create the bucket for key & mark it as recently used.
+// caller must hold this.mtx
+func (this *Limiter) get(key string, now time.Time) *bucket {
+    if elem, ok := this.buckets[key]; ok {
+        this.lru.MoveToFront(elem)
+        return elem.Value.(*bucket)
+    }
+    for this.MaxKeys > 0 && this.lru.Len() >= this.MaxKeys {
+        oldest := this.lru.Back()
+        this.lru.Remove(oldest)
+        delete(this.buckets, oldest.Value.(*bucket).key)
+    }
+    b := &bucket{key, this.rate.Burst, now}
+    this.buckets[key] = this.lru.PushFront(b)
+    return b
+}
+
+/* Limits groups the limiters a Server applies to deposits.
+ * Any of them may be nil to disable that limit.
+ */
+type Limits struct {
+    Sender *Limiter         // per From identity
+    Recipient *Limiter      // per To identity
+    Conn *Limiter           // per connection
+}
+
+const DefaultMaxLimiterKeys = 10000
+
+var (
+    DefaultSenderRate = Rate{PerSecond: 1, Burst: 20}
+    DefaultRecipientRate = Rate{PerSecond: 5, Burst: 100}
+    DefaultConnRate = Rate{PerSecond: 10, Burst: 50}
+)
+
+func NewDefaultLimits() *Limits {
+    return &Limits{
+        Sender: NewLimiter(DefaultSenderRate, DefaultMaxLimiterKeys),
+        Recipient: NewLimiter(DefaultRecipientRate, DefaultMaxLimiterKeys),
+        Conn: NewLimiter(DefaultConnRate, DefaultMaxLimiterKeys),
+    }
+}
+
+// Change every limiter's rate, e.g. when the config is reloaded
+func (this *Limits) SetRates(sender, recipient, conn Rate) {
+    if this.Sender != nil { this.Sender.SetRate(sender) }
+    if this.Recipient != nil { this.Recipient.SetRate(recipient) }
+    if this.Conn != nil { this.Conn.SetRate(conn) }
+}
+
+/* Check every limiter, & take a token from each only if all of them allow.
+ * Otherwise returns the longest wait of the ones that refused, so a throttled
+ *  sender doesn't also spend its recipient & connection allowance.
+ * The limiters are locked together, always in the same order.
+ */
+func (this *Limits) Allow(from, to, conn string) (bool, time.Duration) {
+    type check struct {
+        limiter *Limiter
+        key string
+    }
+    checks := []check{}
+    for _, c := range []check{{this.Sender, "from:" + from}, {this.Recipient, "to:" + to}, {this.Conn, conn}} {
+        if c.limiter == nil { continue }
+        locked := false
+        for _, other := range checks {
+            if other.limiter == c.limiter { locked = true }
+        }
+        if !locked {
+            c.limiter.mtx.Lock()
+            defer c.limiter.mtx.Unlock()
+        }
+        checks = append(checks, c)
+    }
+    ok := true
+    var wait time.Duration
+    buckets := []*bucket{}
+    for _, c := range checks {
+        b, w := c.limiter.refill(c.key)
+        buckets = append(buckets, b)
+        if w == 0 { continue }
+        ok = false
+        if w < 0 || (wait >= 0 && w > wait) { wait = w }
+    }
+    if !ok { return false, wait }
+    for _, b := range buckets {
+        b.tokens -= 1
+    }
+    return true, 0
+}
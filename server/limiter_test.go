@@ -0,0 +1,116 @@
+package server
+
+import (
+    "os"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestLimiter(t *testing.T) {
+    now := time.Unix(0, 0)
+    limiter := NewLimiter(Rate{PerSecond: 1, Burst: 3}, 2)
+    limiter.now = func() time.Time { return now }
+
+    for i:=0; i<3; i++ {
+        if ok, _ := limiter.Allow("a"); !ok {
+            t.Fatal(fmt.Sprintf("Expected token %v to be allowed", i))
+        }
+    }
+    ok, wait := limiter.Allow("a")
+    if ok {
+        t.Fatal("Expected burst to be exhausted")
+    }
+    if wait != time.Second {
+        t.Fatal(fmt.Sprintf("Wrong wait. Expected 1s, got %v", wait))
+    }
+
+    // refill
+    now = now.Add(time.Second)
+    if ok, _ := limiter.Allow("a"); !ok {
+        t.Fatal("Expected bucket to refill")
+    }
+
+    // adjust at runtime
+    limiter.SetRate(Rate{PerSecond: 10, Burst: 3})
+    now = now.Add(100 * time.Millisecond)
+    if ok, _ := limiter.Allow("a"); !ok {
+        t.Fatal("Expected new rate to apply")
+    }
+
+    // bounded memory
+    limiter.Allow("b")
+    limiter.Allow("c")
+    if limiter.Len() != 2 {
+        t.Fatal(fmt.Sprintf("Expected 2 tracked keys, got %v", limiter.Len()))
+    }
+}
+
+func TestLimits(t *testing.T) {
+    limits := &Limits{
+        Sender: NewLimiter(Rate{PerSecond: 0, Burst: 1}, 10),
+        Recipient: NewLimiter(Rate{PerSecond: 1, Burst: 10}, 10),
+    }
+    if ok, _ := limits.Allow("spammer", "victim", "conn:1"); !ok {
+        t.Fatal("Expected first deposit to be allowed")
+    }
+    ok, wait := limits.Allow("spammer", "victim", "conn:1")
+    if ok {
+        t.Fatal("Expected sender to be throttled")
+    }
+    if wait >= 0 {
+        t.Fatal("Expected an indefinite wait for a zero rate")
+    }
+    if ok, _ := limits.Allow("friend", "victim", "conn:2"); !ok {
+        t.Fatal("Expected other senders to be allowed")
+    }
+}
+
+func TestLimitsAllowAll(t *testing.T) {
+    limits := &Limits{
+        Sender: NewLimiter(Rate{PerSecond: 0, Burst: 2}, 10),
+        Recipient: NewLimiter(Rate{PerSecond: 0, Burst: 1}, 10),
+    }
+    if ok, _ := limits.Allow("sender", "full", "conn:1"); !ok {
+        t.Fatal("Expected first deposit to be allowed")
+    }
+    // refused by the recipient's limit, so the sender keeps its token
+    if ok, _ := limits.Allow("sender", "full", "conn:1"); ok {
+        t.Fatal("Expected recipient to be throttled")
+    }
+    if ok, _ := limits.Allow("sender", "other", "conn:1"); !ok {
+        t.Fatal("Expected the sender's token to be left for another recipient")
+    }
+    if ok, _ := limits.Allow("sender", "another", "conn:1"); ok {
+        t.Fatal("Expected sender to be throttled")
+    }
+
+    // one limiter for both keys
+    shared := NewLimiter(Rate{PerSecond: 0, Burst: 1}, 10)
+    limits = &Limits{Sender: shared, Recipient: shared}
+    if ok, _ := limits.Allow("a", "b", "conn:1"); !ok {
+        t.Fatal("Expected a shared limiter to allow")
+    }
+}
+
+func TestReloadLimits(t *testing.T) {
+    configPath := "../.testReloadConfig"
+    defer os.Remove(configPath)
+    limits := DefaultConfig().Limits()
+    config := DefaultConfig()
+    config.RateLimits.Sender = Rate{PerSecond: 2, Burst: 3}
+    config.RateLimits.Conn = Rate{PerSecond: 4, Burst: 5}
+    err := config.Save(configPath)
+    if err != nil { t.Fatal(err) }
+    err = reloadLimits(configPath, limits)
+    if err != nil { t.Fatal(err) }
+    if limits.Sender.Rate() != config.RateLimits.Sender || limits.Conn.Rate() != config.RateLimits.Conn {
+        t.Fatal("Expected the reloaded rates to apply")
+    }
+    if reloadLimits(configPath + ".missing", limits) == nil {
+        t.Fatal("Expected a missing config to fail to reload")
+    }
+    if limits.Sender.Rate() != config.RateLimits.Sender {
+        t.Fatal("Expected a failed reload to leave the rates")
+    }
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+    "net"
+    "sync"
+    "time"
+)
+
+/* A multiListener accepts connections from several listeners,
+ *  so one Server can listen on many addresses.
+ */
+type multiListener struct {
+    listeners []net.Listener
+    conns chan net.Conn
+    errs chan error
+    closed chan struct{}
+    closeOnce sync.Once
+}
+
+func MultiListener(listeners []net.Listener) net.Listener {
+    if len(listeners) == 1 { return listeners[0] }
+    this := &multiListener{
+        listeners: listeners,
+        conns: make(chan net.Conn),
+        errs: make(chan error, len(listeners)),
+        closed: make(chan struct{}),
+    }
+    for _, listener := range listeners {
+        go this.accept(listener)
+    }
+    return this
+}
+
+func (this *multiListener) accept(listener net.Listener) {
+    var delay time.Duration
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            var retry bool
+            delay, retry = acceptRetry(err, delay)
+            if !retry {
+                this.errs <- err
+                return
+            }
+            select {
+            case <-time.After(delay):
+                continue
+            case <-this.closed:
+                return
+            }
+        }
+        delay = 0
+        select {
+        case this.conns <- conn:
+        case <-this.closed:
+            conn.Close()
+            return
+        }
+    }
+}
+
+func (this *multiListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-this.conns:
+        return conn, nil
+    case err := <-this.errs:
+        return nil, err
+    case <-this.closed:
+        return nil, net.ErrClosed
+    }
+}
+
+func (this *multiListener) Close() error {
+    var err error
+    this.closeOnce.Do(func() {
+        close(this.closed)
+        for _, listener := range this.listeners {
+            if cerr := listener.Close(); cerr != nil && err == nil { err = cerr }
+        }
+    })
+    return err
+}
+
+func (this *multiListener) Addr() net.Addr {
+    return this.listeners[0].Addr()
+}
+
+// Listen on every address, or on none if any fails
+func ListenAll(network string, addresses []string) (net.Listener, error) {
+    listeners := []net.Listener{}
+    for _, address := range addresses {
+        listener, err := net.Listen(network, address)
+        if err != nil {
+            for _, l := range listeners { l.Close() }
+            return nil, err
+        }
+        listeners = append(listeners, listener)
+    }
+    return MultiListener(listeners), nil
+}
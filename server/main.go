@@ -0,0 +1,321 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "flag"
+    "errors"
+    "strconv"
+    "context"
+    "syscall"
+    "os/signal"
+    "github.com/jaekwon/go-prelude/colors"
+    "github.com/jaekwon/gourami/types"
+    "github.com/jaekwon/gourami/storage"
+)
+
+var HeaderLine string = "Gourami "+colors.Cyan("<°", colors.Red("\\"), "\\", colors.Red("\\"), "<")+" server (version 0.0)\n"
+
+const DefaultConfigPath = "./gserver.json"
+
+// the identity file password is taken from the environment, so supervisors can provide it
+const PasswordEnv = "GSERVER_PASSWORD"
+
+func PrintHelp() {
+    fmt.Print("usage: gserver [-config file] <command> [args]\n\n" +
+        "commands:\n" +
+        "  init                         write a default config & generate a server identity\n" +
+        "  identity                     print the server's public identity\n" +
+        "  run                          run the server until interrupted; SIGHUP reloads rate limits\n" +
+        "  allocate <owner> [capacity]  allocate a store for an owner's public key\n" +
+        "  deallocate <owner>           delete an owner's store\n" +
+        "  accounts                     list allocated stores\n" +
+        "  fsck <owner|all> [mode]      check stores; mode is report (default),\n" +
+        "                               rebuild (index stray files) or prune (delete them)\n" +
+        "  export <owner> <file> [n]    write a store to a tar archive, from item counter n\n" +
+        "  import <file>                allocate a store from an archive, or add to it if incremental\n\n" +
+        "The default config file is " + DefaultConfigPath + ".\n" +
+        "The identity file password is read from $" + PasswordEnv + ".\n" +
+        "Builds without cgo keep indexes in logs, which one process at a time may open:\n" +
+        "stop the server before allocate, deallocate, fsck or import.\n\n")
+}
+
+func password() (string, error) {
+    password := os.Getenv(PasswordEnv)
+    if password == "" {
+        return "", errors.New("$" + PasswordEnv + " must be set") }
+    return password, nil
+}
+
+func Main() {
+    fmt.Println(HeaderLine)
+    flags := flag.NewFlagSet("gserver", flag.ExitOnError)
+    flags.Usage = PrintHelp
+    configPath := flags.String("config", DefaultConfigPath, "config file")
+    flags.Parse(os.Args[1:])
+    args := flags.Args()
+    if len(args) == 0 {
+        PrintHelp()
+        return
+    }
+
+    var err error
+    switch {
+    case args[0] == "init":
+        err = InitNode(*configPath)
+    case args[0] == "identity":
+        err = PrintIdentity(*configPath)
+    case args[0] == "run":
+        err = RunNode(*configPath)
+    case args[0] == "allocate" && (len(args) == 2 || len(args) == 3):
+        capacity := int64(-1)
+        if len(args) == 3 {
+            capacity, err = strconv.ParseInt(args[2], 10, 64)
+        }
+        if err == nil {
+            err = Allocate(*configPath, args[1], capacity) }
+    case args[0] == "deallocate" && len(args) == 2:
+        err = Deallocate(*configPath, args[1])
+    case args[0] == "accounts":
+        err = PrintAccounts(*configPath)
+    case args[0] == "fsck" && (len(args) == 2 || len(args) == 3):
+        mode := "report"
+        if len(args) == 3 { mode = args[2] }
+        err = Fsck(*configPath, args[1], mode)
+    case args[0] == "export" && (len(args) == 3 || len(args) == 4):
+        since := int64(0)
+        if len(args) == 4 {
+            since, err = strconv.ParseInt(args[3], 10, 64)
+        }
+        if err == nil {
+            err = Export(*configPath, args[1], args[2], since) }
+    case args[0] == "import" && len(args) == 2:
+        err = Import(*configPath, args[1])
+    default:
+        PrintHelp()
+        return
+    }
+    if err != nil {
+        fmt.Println(colors.Red("Error: " + err.Error()))
+        os.Exit(1)
+    }
+}
+
+/* Write a default config & generate a new identity for this node
+ */
+func InitNode(configPath string) error {
+    password, err := password()
+    if err != nil { return err }
+    config := DefaultConfig()
+    err = config.Save(configPath)
+    if err != nil { return err }
+    identity := types.GenerateIdentity()
+    err = SaveIdentity(config.IdentityFile, identity, password)
+    if err != nil { return err }
+    fmt.Println("Wrote " + configPath + " and " + config.IdentityFile)
+    fmt.Println("Identity: " + types.KeyToString(identity.PublicKey))
+    return nil
+}
+
+func PrintIdentity(configPath string) error {
+    config, err := LoadConfig(configPath)
+    if err != nil { return err }
+    password, err := password()
+    if err != nil { return err }
+    identity, err := LoadIdentity(config.IdentityFile, password)
+    if err != nil { return err }
+    fmt.Println(types.KeyToString(identity.PublicKey))
+    return nil
+}
+
+/* Load the config & identity, then serve until SIGINT or SIGTERM.
+ * SIGHUP re-reads the config & applies its rate limits.
+ */
+func RunNode(configPath string) error {
+    config, err := LoadConfig(configPath)
+    if err != nil { return err }
+    password, err := password()
+    if err != nil { return err }
+    identity, err := LoadIdentity(config.IdentityFile, password)
+    if err != nil { return err }
+    storehouser, err := storage.NewOSStorehouser(config.StorageRoot)
+    if err != nil { return err }
+    listener, err := ListenAll("tcp", config.Listen)
+    if err != nil { return err }
+
+    server := NewServer(listener, identity, storehouser)
+    server.Limits = config.Limits()
+    server.MaxConns = config.MaxConns
+    if config.Quotas.MaxDepositSize > 0 {
+        server.MaxDepositSize = config.Quotas.MaxDepositSize
+    }
+
+    ctx, cancel := SignalContext(context.Background())
+    defer cancel()
+    // stop sweeping before the server shuts down & closes the stores
+    serverCtx, stopServer := context.WithCancel(context.Background())
+    defer stopServer()
+    sweeper := config.Sweeper(storehouser.(*storage.OSStorehouser))
+    go func() {
+        sweeper.Run(ctx)
+        stopServer()
+    }()
+    go reloadOnHangup(ctx, configPath, server.Limits)
+    fmt.Println(colors.Blue(fmt.Sprintf("Serving %v on %v", types.KeyToString(identity.PublicKey), config.Listen)))
+    err = server.Run(serverCtx)
+    if err == ErrServerClosed { err = nil }
+    return err
+}
+
+/* Until ctx is done, re-read the config on SIGHUP & apply its rate limits.
+ * Other settings take effect on restart.
+ */
+func reloadOnHangup(ctx context.Context, configPath string, limits *Limits) {
+    hangups := make(chan os.Signal, 1)
+    signal.Notify(hangups, syscall.SIGHUP)
+    defer signal.Stop(hangups)
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-hangups:
+        }
+        err := reloadLimits(configPath, limits)
+        if err != nil {
+            log.Printf("Not reloading %v: %v", configPath, err)
+            continue
+        }
+        log.Printf("Reloaded rate limits from %v", configPath)
+    }
+}
+
+func reloadLimits(configPath string, limits *Limits) error {
+    config, err := LoadConfig(configPath)
+    if err != nil { return err }
+    config.ApplyRates(limits)
+    return nil
+}
+
+func openStorehouser(configPath string) (*storage.OSStorehouser, error) {
+    config, err := LoadConfig(configPath)
+    if err != nil { return nil, err }
+    storehouser, err := storage.NewOSStorehouser(config.StorageRoot)
+    if err != nil { return nil, err }
+    return storehouser.(*storage.OSStorehouser), nil
+}
+
+/* Allocate a store for owner, with the configured default capacity if capacity < 0
+ */
+func Allocate(configPath string, owner string, capacity int64) error {
+    config, err := LoadConfig(configPath)
+    if err != nil { return err }
+    identity, err := types.StringToIdentity(owner)
+    if err != nil { return errors.New("Invalid owner: " + err.Error()) }
+    if capacity < 0 { capacity = config.Quotas.DefaultCapacity }
+    storehouser, err := openStorehouser(configPath)
+    if err != nil { return err }
+    defer storehouser.Close()
+    _, err = storehouser.AllocateStorer(identity, capacity)
+    if err != nil { return err }
+    fmt.Println(fmt.Sprintf("Allocated %v bytes for %v", capacity, owner))
+    return nil
+}
+
+func Deallocate(configPath string, owner string) error {
+    identity, err := types.StringToIdentity(owner)
+    if err != nil { return errors.New("Invalid owner: " + err.Error()) }
+    storehouser, err := openStorehouser(configPath)
+    if err != nil { return err }
+    defer storehouser.Close()
+    return storehouser.DeallocateStorer(identity)
+}
+
+func PrintAccounts(configPath string) error {
+    storehouser, err := openStorehouser(configPath)
+    if err != nil { return err }
+    defer storehouser.Close()
+    allocations, err := storehouser.Allocations()
+    if err != nil { return err }
+    for owner, capacity := range allocations {
+        fmt.Println(fmt.Sprintf("%v %v", owner, capacity))
+    }
+    return nil
+}
+
+var fsckModes = map[string]storage.FsckOptions{
+    "report": storage.FsckOptions{},
+    "rebuild": storage.FsckRebuild,
+    "prune": storage.FsckPrune,
+}
+
+/* Check the owner's store, or every store if owner is "all",
+ *  repairing according to mode.
+ */
+func Fsck(configPath string, owner string, mode string) error {
+    options, ok := fsckModes[mode]
+    if !ok { return errors.New("Unknown fsck mode: " + mode) }
+    storehouser, err := openStorehouser(configPath)
+    if err != nil { return err }
+    defer storehouser.Close()
+    owners := []string{owner}
+    if owner == "all" {
+        allocations, err := storehouser.Allocations()
+        if err != nil { return err }
+        owners = []string{}
+        for owner := range allocations { owners = append(owners, owner) }
+    }
+    problems := 0
+    for _, owner := range owners {
+        identity, err := types.StringToIdentity(owner)
+        if err != nil { return errors.New("Invalid owner: " + err.Error()) }
+        report, err := storehouser.Fsck(identity, options)
+        if err != nil { return err }
+        fmt.Println(fmt.Sprintf("%v: %v files, %v items, %v bytes", owner, report.Files, report.Items, report.Used))
+        for _, problem := range report.Problems {
+            fmt.Println("  " + problem.String())
+            if !problem.Repaired { problems++ }
+        }
+    }
+    if problems > 0 {
+        return errors.New(fmt.Sprintf("%v problems left unrepaired", problems)) }
+    return nil
+}
+
+/* Export the owner's store to an archive file, from item counter since
+ */
+func Export(configPath string, owner string, file string, since int64) error {
+    identity, err := types.StringToIdentity(owner)
+    if err != nil { return errors.New("Invalid owner: " + err.Error()) }
+    storehouser, err := openStorehouser(configPath)
+    if err != nil { return err }
+    defer storehouser.Close()
+    storer, err := storehouser.GetStorer(identity)
+    if err != nil { return err }
+    if storer == nil { return errors.New("No store for " + owner) }
+    out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil { return err }
+    manifest, err := storage.ExportArchive(storer.(storage.ExportableStorer), out, since)
+    if err == nil {
+        err = out.Sync() }
+    if cerr := out.Close(); err == nil { err = cerr }
+    if err != nil {
+        os.Remove(file)
+        return err
+    }
+    fmt.Println(fmt.Sprintf("Exported %v items; export from %v next time", len(manifest.Items), manifest.Next))
+    return nil
+}
+
+func Import(configPath string, file string) error {
+    storehouser, err := openStorehouser(configPath)
+    if err != nil { return err }
+    defer storehouser.Close()
+    in, err := os.Open(file)
+    if err != nil { return err }
+    defer in.Close()
+    manifest, err := storehouser.Import(in)
+    if err != nil { return err }
+    fmt.Println(fmt.Sprintf("Imported %v items for %v", len(manifest.Items), manifest.Owner))
+    return nil
+}
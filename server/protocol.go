@@ -0,0 +1,121 @@
+package server
+
+/* The wire protocol is a sequence of frames.
+ * A frame is a big-endian uint64 length followed by that many bytes of JSON,
+ *  just like the header of a serialized Message.
+ * Requests that carry a body (e.g. deposit) are followed by exactly Size bytes,
+ *  as are responses to fetch.
+ */
+
+import (
+    "io"
+    "errors"
+    "fmt"
+    "bytes"
+    "crypto/rand"
+    "encoding/json"
+    "encoding/binary"
+    "encoding/base64"
+    "code.google.com/p/go.crypto/nacl/box"
+    "github.com/jaekwon/gourami/types"
+)
+
+const MaxFrameSize = 64 * 1024
+
+const (
+    OpDeposit string = "deposit"
+    OpChallenge string = "challenge"
+    OpSubscribe string = "subscribe"
+    OpFetch string = "fetch"
+    OpDelete string = "delete"
+)
+
+const (
+    StatusOK string = "ok"
+    StatusError string = "error"
+    StatusThrottled string = "throttled"
+    StatusFull string = "full"
+    StatusBusy string = "busy"
+    StatusItem string = "item" // pushed to subscribers
+)
+
+type Request struct {
+    Op string               `json:"op"`
+    To string               `json:"to,omitempty"`
+    From string             `json:"from,omitempty"`
+    Size int64              `json:"size,omitempty"`
+    Expires int64           `json:"expires,omitempty"` // unix time after which a deposit may be removed
+    Owner string            `json:"owner,omitempty"`
+    Proof string            `json:"proof,omitempty"`  // see ProveOwnership
+    Since int64             `json:"since,omitempty"`  // last counter seen by a subscriber
+    Id string               `json:"id,omitempty"`     // item to fetch or delete
+    Offset int64            `json:"offset,omitempty"` // of the range to fetch
+    Length int64            `json:"length,omitempty"` // of the range to fetch, 0 for the rest
+}
+
+type Response struct {
+    Status string           `json:"status"`
+    Error string            `json:"error,omitempty"`
+    Id string               `json:"id,omitempty"`
+    Counter int64           `json:"counter,omitempty"`
+    Challenge string        `json:"challenge,omitempty"`
+    RetryAfter int64        `json:"retry_after_ms,omitempty"` // set when throttled
+    // meta of pushed items, when known
+    Size int64              `json:"size,omitempty"`
+    Received int64          `json:"received,omitempty"` // unix time
+    From string             `json:"from,omitempty"`
+    Expires int64           `json:"expires,omitempty"`
+    Total int64             `json:"total,omitempty"` // size of a fetched item; Size bytes of it follow
+    Existed bool            `json:"existed,omitempty"` // whether a deleted item existed
+}
+
+func ReadFrame(reader io.Reader, v interface{}) error {
+    var size uint64
+    err := binary.Read(reader, binary.BigEndian, &size)
+    if err != nil { return err }
+    if size > MaxFrameSize {
+        return errors.New(fmt.Sprintf("Frame too large (max %v, got %v)", MaxFrameSize, size)) }
+    frameBytes := make([]byte, size)
+    _, err = io.ReadFull(reader, frameBytes)
+    if err != nil { return err }
+    return json.Unmarshal(frameBytes, v)
+}
+
+func WriteFrame(writer io.Writer, v interface{}) error {
+    frameBytes, err := json.Marshal(v)
+    if err != nil { return err }
+    err = binary.Write(writer, binary.BigEndian, uint64(len(frameBytes)))
+    if err != nil { return err }
+    _, err = writer.Write(frameBytes)
+    return err
+}
+
+/* Ownership of a key is proven by sealing the server's challenge in a box
+ *  from the owner to the server. Challenges are used once.
+ */
+
+func NewChallenge() ([]byte, error) {
+    challenge := make([]byte, 32)
+    _, err := rand.Read(challenge)
+    return challenge, err
+}
+
+func ProveOwnership(challenge []byte, owner *types.Identity, server *types.Identity) (string, error) {
+    if owner.PrivateKey == nil {
+        return "", errors.New("Identity lacks PrivateKey") }
+    var nonce [24]byte
+    _, err := rand.Read(nonce[:])
+    if err != nil { return "", err }
+    sealed := box.Seal(nil, challenge, &nonce, server.PublicKey, owner.PrivateKey)
+    return base64.URLEncoding.EncodeToString(append(nonce[:], sealed...)), nil
+}
+
+func VerifyOwnership(challenge []byte, proof string, owner *types.Identity, server *types.Identity) bool {
+    if challenge == nil || server.PrivateKey == nil { return false }
+    proofBytes, err := base64.URLEncoding.DecodeString(proof)
+    if err != nil || len(proofBytes) < 24 { return false }
+    var nonce [24]byte
+    copy(nonce[:], proofBytes[:24])
+    opened, ok := box.Open(nil, proofBytes[24:], &nonce, owner.PublicKey, server.PrivateKey)
+    return ok && bytes.Equal(opened, challenge)
+}
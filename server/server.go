@@ -2,15 +2,513 @@ package server
 
 import (
     "net"
+    "io"
+    "io/ioutil"
+    "log"
     "os"
+    "time"
+    "sync"
+    "errors"
+    "syscall"
+    "context"
+    "os/signal"
+    "encoding/base64"
     . "github.com/jaekwon/gourami/types"
     "github.com/jaekwon/gourami/storage"
 )
 
 const RECV_BUF_LEN = 1024
 
+// Defaults used by NewServer
+const (
+    DefaultMaxDepositSize = 64 * 1024 * 1024
+    DefaultMaxConns = 1024
+    DefaultIdleTimeout = 2 * time.Minute
+    DefaultReadTimeout = 30 * time.Second
+    DefaultBodyTimeout = 10 * time.Minute
+    DefaultWriteTimeout = 30 * time.Second
+    DefaultShutdownTimeout = 30 * time.Second
+)
+
+var ErrServerClosed error = errors.New("Server closed")
+
 type Server struct {
-    Listener Listener
+    Listener net.Listener
     Identity *Identity
     Storehouser storage.Storehouser
+    Limits *Limits
+    MaxDepositSize int64
+
+    MaxConns int                    // further connections are turned away as busy
+    IdleTimeout time.Duration       // max wait for the next request on a connection
+    ReadTimeout time.Duration       // max wait for each read within a request
+    BodyTimeout time.Duration       // max time to receive a whole request body
+    WriteTimeout time.Duration      // max wait for each response
+    ShutdownTimeout time.Duration   // how long Run lets in-flight requests finish
+
+    mtx sync.Mutex
+    conns map[net.Conn]bool // true while a request is in flight
+    wg sync.WaitGroup
+    shutdown bool
+}
+
+func NewServer(listener net.Listener, identity *Identity, storehouser storage.Storehouser) *Server {
+    return &Server{
+        Listener: listener,
+        Identity: identity,
+        Storehouser: storehouser,
+        Limits: NewDefaultLimits(),
+        MaxDepositSize: DefaultMaxDepositSize,
+        MaxConns: DefaultMaxConns,
+        IdleTimeout: DefaultIdleTimeout,
+        ReadTimeout: DefaultReadTimeout,
+        BodyTimeout: DefaultBodyTimeout,
+        WriteTimeout: DefaultWriteTimeout,
+        ShutdownTimeout: DefaultShutdownTimeout,
+    }
+}
+
+// backoff between failed Accepts, as in net/http
+const (
+    minAcceptDelay = 5 * time.Millisecond
+    maxAcceptDelay = time.Second
+)
+
+/* After an Accept error, the delay before trying again, doubling the last one,
+ *  or false if the listener is closed.
+ */
+func acceptRetry(err error, delay time.Duration) (time.Duration, bool) {
+    if errors.Is(err, net.ErrClosed) { return 0, false }
+    if delay == 0 {
+        delay = minAcceptDelay
+    } else {
+        delay *= 2
+    }
+    if delay > maxAcceptDelay { delay = maxAcceptDelay }
+    log.Printf("Error accepting connection: %v; retrying in %v", err, delay)
+    return delay, true
+}
+
+/* Accept connections until the listener is closed.
+ * Other Accept errors, such as running out of file descriptors, are retried
+ *  with backoff. Returns ErrServerClosed after Shutdown.
+ */
+func (this *Server) Serve() error {
+    var delay time.Duration
+    for {
+        conn, err := this.Listener.Accept()
+        if err != nil {
+            if this.isShutdown() { return ErrServerClosed }
+            var retry bool
+            delay, retry = acceptRetry(err, delay)
+            if !retry { return err }
+            time.Sleep(delay)
+            continue
+        }
+        delay = 0
+        if !this.trackConn(conn) { continue }
+        go this.handleConn(conn)
+    }
+}
+
+/* Serve until ctx is cancelled, then shut down gracefully,
+ *  giving in-flight requests up to ShutdownTimeout to finish.
+ */
+func (this *Server) Run(ctx context.Context) error {
+    serveErr := make(chan error, 1)
+    go func() { serveErr <- this.Serve() }()
+    select {
+    case err := <-serveErr:
+        return err
+    case <-ctx.Done():
+    }
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), this.ShutdownTimeout)
+    defer cancel()
+    err := this.Shutdown(shutdownCtx)
+    <-serveErr
+    return err
+}
+
+/* Stop accepting connections & close idle ones, then wait for in-flight
+ *  requests to finish. Once ctx is done, remaining connections are closed.
+ * Finally closes the Storehouser, and with it the store indexes.
+ */
+func (this *Server) Shutdown(ctx context.Context) error {
+    this.mtx.Lock()
+    this.shutdown = true
+    if this.Listener != nil { this.Listener.Close() }
+    for conn, active := range this.conns {
+        if !active { conn.Close() }
+    }
+    this.mtx.Unlock()
+
+    done := make(chan struct{})
+    go func() { this.wg.Wait(); close(done) }()
+    var err error
+    select {
+    case <-done:
+    case <-ctx.Done():
+        this.mtx.Lock()
+        for conn := range this.conns { conn.Close() }
+        this.mtx.Unlock()
+        <-done
+        err = ctx.Err()
+    }
+    if this.Storehouser != nil {
+        closeErr := this.Storehouser.Close()
+        if err == nil { err = closeErr }
+    }
+    return err
+}
+
+// Returns a context that is cancelled on SIGINT or SIGTERM
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+    return signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+}
+
+func (this *Server) isShutdown() bool {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.shutdown
+}
+
+// register a new connection, or turn it away if shut down or too busy
+func (this *Server) trackConn(conn net.Conn) bool {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if this.shutdown {
+        conn.Close()
+        return false
+    }
+    if this.MaxConns > 0 && len(this.conns) >= this.MaxConns {
+        go func() {
+            conn.SetWriteDeadline(time.Now().Add(time.Second))
+            WriteFrame(conn, &Response{Status: StatusBusy, Error: "Too many connections"})
+            conn.Close()
+        }()
+        return false
+    }
+    if this.conns == nil { this.conns = make(map[net.Conn]bool) }
+    this.conns[conn] = false
+    this.wg.Add(1)
+    return true
+}
+
+func (this *Server) untrackConn(conn net.Conn) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    conn.Close()
+    delete(this.conns, conn)
+    this.wg.Done()
+}
+
+// mark whether conn has a request in flight.
+// returns false if the server is shutting down & conn should close.
+func (this *Server) setActive(conn net.Conn, active bool) bool {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if this.shutdown { return false }
+    this.conns[conn] = active
+    return true
+}
+
+/* A timeoutReader reads from a connection in pieces of at most RECV_BUF_LEN,
+ *  each of which must arrive within the timeout, & all of which must arrive
+ *  by the deadline, so a trickle of bytes can't hold a request open forever.
+ */
+type timeoutReader struct {
+    conn net.Conn
+    timeout time.Duration
+    deadline time.Time // zero for none
+}
+
+// start the deadline for a request body, or clear it if timeout is 0
+func (this *timeoutReader) startBody(timeout time.Duration) {
+    this.deadline = time.Time{}
+    if timeout > 0 { this.deadline = time.Now().Add(timeout) }
+}
+
+func (this *timeoutReader) Read(p []byte) (int, error) {
+    if len(p) > RECV_BUF_LEN { p = p[:RECV_BUF_LEN] }
+    deadline := this.deadline
+    if this.timeout > 0 {
+        next := time.Now().Add(this.timeout)
+        if deadline.IsZero() || next.Before(deadline) { deadline = next }
+    }
+    if !deadline.IsZero() { this.conn.SetReadDeadline(deadline) }
+    return this.conn.Read(p)
+}
+
+// per connection state
+type connection struct {
+    net.Conn
+    key string          // for the connection rate limiter
+    reader *timeoutReader // for reading request bodies
+    challenge []byte    // outstanding ownership challenge
+}
+
+func (this *Server) handleConn(conn net.Conn) {
+    defer this.untrackConn(conn)
+    c := &connection{conn, "conn:" + conn.RemoteAddr().String(), &timeoutReader{conn, this.ReadTimeout, time.Time{}}, nil}
+    if this.Limits != nil && this.Limits.Conn != nil {
+        defer this.Limits.Conn.Remove(c.key)
+    }
+    for {
+        if !this.setActive(conn, false) { return }
+        var request Request
+        if this.IdleTimeout > 0 {
+            conn.SetReadDeadline(time.Now().Add(this.IdleTimeout))
+        } else {
+            conn.SetReadDeadline(time.Time{})
+        }
+        err := ReadFrame(conn, &request)
+        if err != nil {
+            if err != io.EOF && !this.isShutdown() {
+                log.Printf("Error reading request from %v: %v", conn.RemoteAddr(), err) }
+            return
+        }
+        if !this.setActive(conn, true) { return }
+        var response *Response
+        switch request.Op {
+        case OpDeposit:
+            response, err = this.handleDeposit(c, &request)
+        case OpChallenge:
+            response = this.handleChallenge(c)
+        case OpSubscribe:
+            response, err = this.handleSubscribe(c, &request)
+        case OpFetch:
+            response, err = this.handleFetch(c, &request)
+        case OpDelete:
+            response = this.handleDelete(c, &request)
+        default:
+            response = &Response{Status: StatusError, Error: "Unknown op: " + request.Op}
+        }
+        if response != nil {
+            if werr := this.respond(c, response); werr != nil { return }
+        }
+        // the connection is out of sync
+        if err != nil {
+            if err != errConnDone {
+                log.Printf("Closing connection %v: %v", conn.RemoteAddr(), err) }
+            return
+        }
+    }
+}
+
+// returned by handlers that are done with the connection
+var errConnDone error = errors.New("Connection done")
+
+func (this *Server) respond(c *connection, response *Response) error {
+    if this.WriteTimeout > 0 {
+        c.SetWriteDeadline(time.Now().Add(this.WriteTimeout))
+    }
+    return WriteFrame(c, response)
+}
+
+/* Stream a deposit body into the recipient's Storer, under its content id.
+ * A non-nil error means the connection can no longer be used.
+ */
+func (this *Server) handleDeposit(c *connection, request *Request) (*Response, error) {
+    if request.Size < 0 || request.Size > this.MaxDepositSize {
+        return &Response{Status: StatusError, Error: "Invalid deposit size"}, io.ErrUnexpectedEOF
+    }
+    // the body must be consumed whatever happens, so the connection stays usable
+    c.reader.startBody(this.BodyTimeout)
+    body := &io.LimitedReader{R: c.reader, N: request.Size}
+    drain := func(response *Response) (*Response, error) {
+        _, err := io.Copy(ioutil.Discard, body)
+        return response, err
+    }
+    // throttle before reading the body
+    if this.Limits != nil {
+        ok, wait := this.Limits.Allow(request.From, request.To, c.key)
+        if !ok {
+            return drain(&Response{Status: StatusThrottled, Error: "Too many deposits", RetryAfter: int64(wait / time.Millisecond)})
+        }
+    }
+    to, err := StringToIdentity(request.To)
+    if err != nil {
+        return drain(&Response{Status: StatusError, Error: "Invalid recipient: " + err.Error()}) }
+    storer, err := this.Storehouser.GetStorer(to)
+    if err != nil {
+        return drain(&Response{Status: StatusError, Error: err.Error()}) }
+    if storer == nil {
+        return drain(&Response{Status: StatusError, Error: "Unknown recipient"}) }
+    var id Id
+    items, ok := storer.(itemStorer)
+    if ok {
+        meta := storage.ItemMeta{Size: request.Size, Sender: request.From}
+        if request.Expires > 0 { meta.Expires = time.Unix(request.Expires, 0) }
+        id, err = items.StoreItem(meta, body)
+    } else {
+        id, err = storer.StoreContent(body, request.Size)
+    }
+    if body.N > 0 && isNetError(err) {
+        return nil, err }
+    if storage.IsCapacityError(err) {
+        return drain(&Response{Status: StatusFull, Error: err.Error()}) }
+    if err != nil {
+        return drain(&Response{Status: StatusError, Error: err.Error()}) }
+    if request.Expires > 0 && !ok {
+        if expiring, ok := storer.(expirer); ok {
+            err = expiring.SetExpiry(id, time.Unix(request.Expires, 0))
+            if err != nil {
+                return &Response{Status: StatusError, Error: err.Error()}, nil }
+        }
+    }
+    return &Response{Status: StatusOK, Id: id.String()}, nil
+}
+
+// Storers that record who sent an item & when it expires, such as *storage.OSStore
+type itemStorer interface {
+    StoreItem(meta storage.ItemMeta, reader io.Reader) (Id, error)
+}
+
+// Storers that can expire items after they are stored
+type expirer interface {
+    SetExpiry(id Id, expires time.Time) error
+}
+
+// did reading from the connection fail?
+func isNetError(err error) bool {
+    _, ok := err.(net.Error)
+    return ok || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func (this *Server) handleChallenge(c *connection) *Response {
+    challenge, err := NewChallenge()
+    if err != nil {
+        return &Response{Status: StatusError, Error: err.Error()} }
+    c.challenge = challenge
+    return &Response{Status: StatusOK, Challenge: base64.URLEncoding.EncodeToString(challenge)}
+}
+
+/* The Storer of request.Owner, who must have answered the challenge
+ *  last sent on c, or else a response saying why not.
+ */
+func (this *Server) ownedStorer(c *connection, request *Request) (storage.Storer, *Response) {
+    owner, err := StringToIdentity(request.Owner)
+    if err != nil {
+        return nil, &Response{Status: StatusError, Error: "Invalid owner: " + err.Error()} }
+    challenge := c.challenge
+    c.challenge = nil
+    if !VerifyOwnership(challenge, request.Proof, owner, this.Identity) {
+        return nil, &Response{Status: StatusError, Error: "Ownership not proven"} }
+    storer, err := this.Storehouser.GetStorer(owner)
+    if err != nil {
+        return nil, &Response{Status: StatusError, Error: err.Error()} }
+    if storer == nil {
+        return nil, &Response{Status: StatusError, Error: "Unknown owner"} }
+    return storer, nil
+}
+
+/* Send a range of an item to its owner, who must first have answered a challenge.
+ * The blob is sent as stored, e.g. still enciphered, so the owner can
+ *  read a CipherMessage in parts through a CipherReaderAt.
+ */
+func (this *Server) handleFetch(c *connection, request *Request) (*Response, error) {
+    storer, response := this.ownedStorer(c, request)
+    if response != nil { return response, nil }
+    id, err := StringToId(request.Id)
+    if err != nil {
+        return &Response{Status: StatusError, Error: "Invalid id: " + err.Error()}, nil }
+    blob, err := storer.Open(id)
+    if err == storage.ErrNotFound {
+        return &Response{Status: StatusError, Error: "Unknown item"}, nil }
+    if err != nil {
+        return &Response{Status: StatusError, Error: err.Error()}, nil }
+    defer blob.Close()
+    total := blob.Size()
+    if request.Offset < 0 || request.Offset > total || request.Length < 0 {
+        return &Response{Status: StatusError, Error: "Invalid range"}, nil }
+    length := total - request.Offset
+    if request.Length > 0 && request.Length < length { length = request.Length }
+    err = this.respond(c, &Response{Status: StatusOK, Id: request.Id, Size: length, Total: total})
+    if err != nil { return nil, err }
+    // once the header is out, a failure can only be signalled by hanging up
+    _, err = io.Copy(c, io.NewSectionReader(blob, request.Offset, length))
+    return nil, err
+}
+
+/* Delete an item for its owner, e.g. once it has been fetched.
+ * Deleting an item that does not exist is not an error.
+ */
+func (this *Server) handleDelete(c *connection, request *Request) *Response {
+    storer, response := this.ownedStorer(c, request)
+    if response != nil { return response }
+    id, err := StringToId(request.Id)
+    if err != nil {
+        return &Response{Status: StatusError, Error: "Invalid id: " + err.Error()} }
+    existed, err := storer.Remove(id)
+    if err != nil {
+        return &Response{Status: StatusError, Error: err.Error()} }
+    return &Response{Status: StatusOK, Id: request.Id, Existed: existed}
+}
+
+// Storers that can list & watch their items, such as *storage.OSStore
+type mailbox interface {
+    QueryItems(query storage.ItemQuery) ([]storage.ItemMeta, error)
+    WatchItems(ch chan struct{})
+    UnwatchItems(ch chan struct{})
+}
+
+// how many items a subscription reads from the index at once
+const subscribeBatchSize = 100
+
+/* Stream the ids of items added after request.Since to their owner,
+ *  who must first have answered a challenge. Once subscribed, the
+ *  connection only carries pushed items until either side closes it.
+ */
+func (this *Server) handleSubscribe(c *connection, request *Request) (*Response, error) {
+    storer, response := this.ownedStorer(c, request)
+    if response != nil { return response, nil }
+    box, ok := storer.(mailbox)
+    if !ok {
+        return &Response{Status: StatusError, Error: "Store does not support subscriptions"}, nil }
+
+    // watch before the first lookup, so no item is missed
+    wake := make(chan struct{}, 1)
+    box.WatchItems(wake)
+    defer box.UnwatchItems(wake)
+    err := this.respond(c, &Response{Status: StatusOK})
+    if err != nil { return nil, err }
+
+    // the subscriber sends nothing more; a read returns once it hangs up
+    hungUp := make(chan struct{})
+    go func() {
+        c.SetReadDeadline(time.Time{})
+        io.Copy(ioutil.Discard, c)
+        close(hungUp)
+    }()
+
+    next := request.Since + 1
+    for {
+        // push everything after next
+        for {
+            items, err := box.QueryItems(storage.ItemQuery{Since: next, Limit: subscribeBatchSize})
+            if err != nil { return nil, err }
+            for _, item := range items {
+                next = item.Counter + 1
+                err = this.respond(c, itemResponse(item))
+                if err != nil { return nil, err }
+            }
+            if len(items) < subscribeBatchSize { break }
+        }
+        // wait for more, letting Shutdown close the connection meanwhile
+        if !this.setActive(c.Conn, false) { return nil, errConnDone }
+        select {
+        case <-wake:
+        case <-hungUp:
+            return nil, errConnDone
+        }
+        if !this.setActive(c.Conn, true) { return nil, errConnDone }
+    }
+}
+
+func itemResponse(item storage.ItemMeta) *Response {
+    response := &Response{Status: StatusItem, Id: item.Id.String(), Counter: item.Counter, From: item.Sender}
+    if item.Size > 0 { response.Size = item.Size }
+    if !item.Received.IsZero() { response.Received = item.Received.Unix() }
+    if !item.Expires.IsZero() { response.Expires = item.Expires.Unix() }
+    return response
 }
@@ -0,0 +1,403 @@
+package server
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "net"
+    "errors"
+    "time"
+    "context"
+    "testing"
+    "encoding/base64"
+    "github.com/jaekwon/gourami/types"
+    "github.com/jaekwon/gourami/storage"
+)
+
+const testRoot = "../.testServerStore"
+
+// a fresh storehouser with a store allocated for owner
+func newTestStorehouser(t *testing.T, owner *types.Identity) (storage.Storehouser, storage.Storer) {
+    os.RemoveAll(testRoot)
+    storehouser, err := storage.NewOSStorehouser(testRoot)
+    if err != nil { t.Fatal(err) }
+    store, err := storehouser.AllocateStorer(owner, 1000)
+    if err != nil { t.Fatal(err) }
+    return storehouser, store
+}
+
+func deposit(conn net.Conn, from, to *types.Identity, data []byte) (*Response, error) {
+    err := WriteFrame(conn, &Request{
+        Op: OpDeposit,
+        From: types.KeyToString(from.PublicKey),
+        To: types.KeyToString(to.PublicKey),
+        Size: int64(len(data)),
+    })
+    if err != nil { return nil, err }
+    _, err = conn.Write(data)
+    if err != nil { return nil, err }
+    var response Response
+    err = ReadFrame(conn, &response)
+    return &response, err
+}
+
+func TestDeposit(t *testing.T) {
+    to := types.GenerateIdentity()
+    from := types.GenerateIdentity()
+    storehouser, store := newTestStorehouser(t, to)
+    defer os.RemoveAll(testRoot)
+    defer storehouser.Close()
+
+    server := NewServer(nil, types.GenerateIdentity(), storehouser)
+    server.Limits.Sender.SetRate(Rate{PerSecond: 0, Burst: 2})
+    client, conn := net.Pipe()
+    server.trackConn(conn)
+    go server.handleConn(conn)
+    defer client.Close()
+
+    for i:=0; i<2; i++ {
+        response, err := deposit(client, from, to, []byte(fmt.Sprintf("message %v", i)))
+        if err != nil { t.Fatal(err) }
+        if response.Status != StatusOK {
+            t.Fatal(fmt.Sprintf("Expected ok, got %v: %v", response.Status, response.Error))
+        }
+    }
+    response, err := deposit(client, from, to, []byte("one too many"))
+    if err != nil { t.Fatal(err) }
+    if response.Status != StatusThrottled {
+        t.Fatal(fmt.Sprintf("Expected throttled, got %v", response.Status))
+    }
+    used, _ := store.Size()
+    if used != 18 {
+        t.Fatal(fmt.Sprintf("Wrong used. Expected 18, got %v", used))
+    }
+}
+
+func TestShutdown(t *testing.T) {
+    to := types.GenerateIdentity()
+    storehouser, _ := newTestStorehouser(t, to)
+    defer os.RemoveAll(testRoot)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    server := NewServer(listener, types.GenerateIdentity(), storehouser)
+    server.MaxConns = 2
+    serveErr := make(chan error, 1)
+    go func() { serveErr <- server.Serve() }()
+
+    // a pipe's writes return once the server has read them
+    uploading, conn := net.Pipe()
+    defer uploading.Close()
+    server.trackConn(conn)
+    go server.handleConn(conn)
+    idle, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer idle.Close()
+
+    // a third connection is turned away
+    busy, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil { t.Fatal(err) }
+    var response Response
+    err = ReadFrame(busy, &response)
+    if err != nil || response.Status != StatusBusy {
+        t.Fatal(fmt.Sprintf("Expected busy, got %v %v", response.Status, err))
+    }
+    busy.Close()
+
+    // start an upload, then shut down in the middle of it
+    err = WriteFrame(uploading, &Request{
+        Op: OpDeposit,
+        From: types.KeyToString(to.PublicKey),
+        To: types.KeyToString(to.PublicKey),
+        Size: 10,
+    })
+    if err != nil { t.Fatal(err) }
+    _, err = uploading.Write([]byte("hello"))
+    if err != nil { t.Fatal(err) }
+    shutdownErr := make(chan error, 1)
+    go func() { shutdownErr <- server.Shutdown(context.Background()) }()
+    // the idle connection is closed once the shutdown has begun
+    idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := idle.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+        t.Fatal("Expected idle connection to be closed:", err)
+    }
+    _, err = uploading.Write([]byte("world"))
+    if err != nil { t.Fatal(err) }
+    err = ReadFrame(uploading, &response)
+    if err != nil || response.Status != StatusOK {
+        t.Fatal(fmt.Sprintf("Expected in-flight upload to finish, got %v %v", response.Status, err))
+    }
+    if err := <-shutdownErr; err != nil { t.Fatal(err) }
+    if err := <-serveErr; err != ErrServerClosed {
+        t.Fatal(fmt.Sprintf("Expected ErrServerClosed, got %v", err))
+    }
+}
+
+// a listener whose first Accepts fail
+type flakyListener struct {
+    net.Listener
+    failures int
+}
+
+func (this *flakyListener) Accept() (net.Conn, error) {
+    if this.failures > 0 {
+        this.failures--
+        return nil, errors.New("too many open files")
+    }
+    return this.Listener.Accept()
+}
+
+func TestAcceptRetry(t *testing.T) {
+    to := types.GenerateIdentity()
+    storehouser, _ := newTestStorehouser(t, to)
+    defer os.RemoveAll(testRoot)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    server := NewServer(&flakyListener{listener, 3}, types.GenerateIdentity(), storehouser)
+    serveErr := make(chan error, 1)
+    go func() { serveErr <- server.Serve() }()
+
+    // connections are still accepted after the failures
+    conn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+    response, err := deposit(conn, to, to, []byte("hello"))
+    if err != nil || response.Status != StatusOK {
+        t.Fatal(fmt.Sprintf("Expected ok after accept errors, got %v %v", response, err))
+    }
+
+    err = server.Shutdown(context.Background())
+    if err != nil { t.Fatal(err) }
+    if err := <-serveErr; err != ErrServerClosed {
+        t.Fatal(fmt.Sprintf("Expected ErrServerClosed, got %v", err))
+    }
+}
+
+func TestMultiListenerRetry(t *testing.T) {
+    first, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    second, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    listener := MultiListener([]net.Listener{&flakyListener{first, 2}, &flakyListener{second, 2}})
+
+    // each address keeps accepting after its failures
+    for _, address := range []net.Addr{first.Addr(), second.Addr()} {
+        conn, err := net.Dial("tcp", address.String())
+        if err != nil { t.Fatal(err) }
+        defer conn.Close()
+        accepted, err := listener.Accept()
+        if err != nil { t.Fatal(fmt.Sprintf("Expected a connection on %v, got %v", address, err)) }
+        accepted.Close()
+    }
+
+    listener.Close()
+    if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+        t.Fatal(fmt.Sprintf("Expected net.ErrClosed, got %v", err))
+    }
+}
+
+func isTimeout(err error) bool {
+    netErr, ok := err.(net.Error)
+    return ok && netErr.Timeout()
+}
+
+func TestBodyTimeout(t *testing.T) {
+    to := types.GenerateIdentity()
+    storehouser, _ := newTestStorehouser(t, to)
+    defer os.RemoveAll(testRoot)
+    defer storehouser.Close()
+
+    server := NewServer(nil, types.GenerateIdentity(), storehouser)
+    server.ReadTimeout = time.Second
+    server.BodyTimeout = 200 * time.Millisecond
+    client, conn := net.Pipe()
+    server.trackConn(conn)
+    go server.handleConn(conn)
+    defer client.Close()
+
+    err := WriteFrame(client, &Request{
+        Op: OpDeposit,
+        From: types.KeyToString(to.PublicKey),
+        To: types.KeyToString(to.PublicKey),
+        Size: 1000,
+    })
+    if err != nil { t.Fatal(err) }
+    // each byte arrives well within ReadTimeout, but the body never completes
+    start := time.Now()
+    for time.Since(start) < 5 * time.Second {
+        if _, err := client.Write([]byte("x")); err != nil { break }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if time.Since(start) >= 5 * time.Second {
+        t.Fatal("Expected a trickled body to be cut off")
+    }
+}
+
+func subscribe(conn net.Conn, owner *types.Identity, server *types.Identity, since int64) (*Response, error) {
+    err := WriteFrame(conn, &Request{Op: OpChallenge})
+    if err != nil { return nil, err }
+    var response Response
+    err = ReadFrame(conn, &response)
+    if err != nil { return nil, err }
+    challenge, err := base64.URLEncoding.DecodeString(response.Challenge)
+    if err != nil { return nil, err }
+    proof, err := ProveOwnership(challenge, owner, server)
+    if err != nil { return nil, err }
+    err = WriteFrame(conn, &Request{Op: OpSubscribe, Owner: types.KeyToString(owner.PublicKey), Proof: proof, Since: since})
+    if err != nil { return nil, err }
+    err = ReadFrame(conn, &response)
+    return &response, err
+}
+
+func TestSubscribe(t *testing.T) {
+    owner := types.GenerateIdentity()
+    storehouser, _ := newTestStorehouser(t, owner)
+    defer os.RemoveAll(testRoot)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    server := NewServer(listener, types.GenerateIdentity(), storehouser)
+    go server.Serve()
+    defer server.Shutdown(context.Background())
+    dial := func() net.Conn {
+        conn, err := net.Dial("tcp", listener.Addr().String())
+        if err != nil { t.Fatal(err) }
+        return conn
+    }
+    depositor := dial()
+    defer depositor.Close()
+    expectItem := func(conn net.Conn, counter int64) {
+        var response Response
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        err := ReadFrame(conn, &response)
+        if err != nil { t.Fatal(err) }
+        if response.Status != StatusItem || response.Counter != counter {
+            t.Fatal(fmt.Sprintf("Expected item %v, got %v %v", counter, response.Status, response.Counter))
+        }
+        // items carry their meta
+        if response.From != types.KeyToString(owner.PublicKey) || response.Size < 5 || response.Received == 0 {
+            t.Fatal(fmt.Sprintf("Wrong meta for item %v: %v", counter, response))
+        }
+    }
+
+    // someone else cannot subscribe
+    impostor := dial()
+    response, err := subscribe(impostor, types.GenerateIdentity(), server.Identity, 0)
+    if err != nil { t.Fatal(err) }
+    if response.Status != StatusError {
+        t.Fatal("Expected impostor to be refused")
+    }
+    impostor.Close()
+
+    deposit(depositor, owner, owner, []byte("first"))
+    subscriber := dial()
+    response, err = subscribe(subscriber, owner, server.Identity, 0)
+    if err != nil { t.Fatal(err) }
+    if response.Status != StatusOK {
+        t.Fatal(fmt.Sprintf("Expected to subscribe, got %v", response.Error))
+    }
+    expectItem(subscriber, 1)
+    deposit(depositor, owner, owner, []byte("second"))
+    expectItem(subscriber, 2)
+    subscriber.Close()
+
+    // resume after reconnecting
+    deposit(depositor, owner, owner, []byte("third"))
+    subscriber = dial()
+    defer subscriber.Close()
+    response, err = subscribe(subscriber, owner, server.Identity, 2)
+    if err != nil || response.Status != StatusOK { t.Fatal("Expected to resubscribe") }
+    expectItem(subscriber, 3)
+}
+
+// answer a challenge, then send request as owner
+func asOwner(conn net.Conn, owner *types.Identity, server *types.Identity, request *Request) (*Response, error) {
+    err := WriteFrame(conn, &Request{Op: OpChallenge})
+    if err != nil { return nil, err }
+    var response Response
+    err = ReadFrame(conn, &response)
+    if err != nil { return nil, err }
+    challenge, err := base64.URLEncoding.DecodeString(response.Challenge)
+    if err != nil { return nil, err }
+    request.Owner = types.KeyToString(owner.PublicKey)
+    request.Proof, err = ProveOwnership(challenge, owner, server)
+    if err != nil { return nil, err }
+    err = WriteFrame(conn, request)
+    if err != nil { return nil, err }
+    response = Response{}
+    err = ReadFrame(conn, &response)
+    return &response, err
+}
+
+func fetch(conn net.Conn, owner *types.Identity, server *types.Identity, id string, offset, length int64) (*Response, []byte, error) {
+    response, err := asOwner(conn, owner, server, &Request{Op: OpFetch, Id: id, Offset: offset, Length: length})
+    if err != nil || response.Status != StatusOK { return response, nil, err }
+    data := make([]byte, response.Size)
+    _, err = io.ReadFull(conn, data)
+    return response, data, err
+}
+
+func TestFetch(t *testing.T) {
+    owner := types.GenerateIdentity()
+    storehouser, _ := newTestStorehouser(t, owner)
+    defer os.RemoveAll(testRoot)
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    server := NewServer(listener, types.GenerateIdentity(), storehouser)
+    go server.Serve()
+    defer server.Shutdown(context.Background())
+    conn, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    data := []byte("the quick brown fox jumps over the lazy dog")
+    response, err := deposit(conn, owner, owner, data)
+    if err != nil || response.Status != StatusOK { t.Fatal("Could not deposit:", err, response) }
+    id := response.Id
+
+    response, fetched, err := fetch(conn, owner, server.Identity, id, 4, 5)
+    if err != nil { t.Fatal(err) }
+    if response.Status != StatusOK || response.Total != int64(len(data)) || string(fetched) != "quick" {
+        t.Fatal(fmt.Sprintf("Wrong fetch: %v %q", response, fetched))
+    }
+    // the rest, on the same connection
+    response, fetched, err = fetch(conn, owner, server.Identity, id, 35, 0)
+    if err != nil || string(fetched) != "lazy dog" {
+        t.Fatal(fmt.Sprintf("Wrong fetch of the rest: %v %q %v", response, fetched, err))
+    }
+    response, _, err = fetch(conn, owner, server.Identity, id, int64(len(data)) + 1, 0)
+    if err != nil || response.Status != StatusError {
+        t.Fatal("Expected a range past the end to be refused")
+    }
+    response, _, err = fetch(conn, owner, server.Identity, storage.ContentId([]byte("nothing")).String(), 0, 0)
+    if err != nil || response.Status != StatusError {
+        t.Fatal("Expected an unknown item to be refused")
+    }
+    response, _, err = fetch(conn, types.GenerateIdentity(), server.Identity, id, 0, 0)
+    if err != nil || response.Status != StatusError {
+        t.Fatal("Expected an impostor to be refused")
+    }
+
+    // delete after fetching
+    response, err = asOwner(conn, types.GenerateIdentity(), server.Identity, &Request{Op: OpDelete, Id: id})
+    if err != nil || response.Status != StatusError {
+        t.Fatal("Expected an impostor to be refused deletion")
+    }
+    response, err = asOwner(conn, owner, server.Identity, &Request{Op: OpDelete, Id: id})
+    if err != nil || response.Status != StatusOK || !response.Existed {
+        t.Fatal(fmt.Sprintf("Could not delete: %v %v", response, err))
+    }
+    response, err = asOwner(conn, owner, server.Identity, &Request{Op: OpDelete, Id: id})
+    if err != nil || response.Status != StatusOK || response.Existed {
+        t.Fatal(fmt.Sprintf("Deleting again should report no item: %v %v", response, err))
+    }
+    response, _, err = fetch(conn, owner, server.Identity, id, 0, 0)
+    if err != nil || response.Status != StatusError {
+        t.Fatal("Expected a deleted item to be gone")
+    }
+    storer, _ := storehouser.GetStorer(owner)
+    if used, _ := storer.Size(); used != 0 {
+        t.Fatal("Deletion did not credit usage:", used)
+    }
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "errors"
+    "archive/tar"
+    "crypto/sha256"
+    "encoding/json"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Archives
+ * A store is exported as a tar stream, to move an account between servers:
+ *  manifest.json first, with the store's meta & its items in counter order,
+ *  then each item's blob as items/<id>, in the same order.
+ * Each item carries the SHA-256 of its blob, which the import checks before
+ *  moving on. An export from a counter holds only the items from there on,
+ *  to be imported into the store made from the earlier archives.
+ */
+
+const ArchiveVersion = 1
+
+const archiveManifestName = "manifest.json"
+const archiveItemPrefix = "items/"
+
+var (
+    ErrArchiveVersion error = errors.New("Unsupported archive version")
+    ErrArchiveChecksum error = errors.New("Archived blob does not match its checksum")
+)
+
+type ArchiveManifest struct {
+    Version int
+    Owner string
+    Capacity int64
+    ContentAddressed bool
+    Since int64 // the first counter exported, 0 for everything
+    Next int64 // the counter to export from next time
+    Created time.Time
+    Items []ArchiveItem
+}
+
+type ArchiveItem struct {
+    Counter int64
+    Id string
+    Size int64
+    Received time.Time
+    Sender string
+    Expires time.Time
+    Checksum string // SHA-256 of the blob, encoded like an id
+}
+
+// stores that can be exported, such as any Storer in this package
+type ExportableStorer interface {
+    Storer
+    QueryItems(query ItemQuery) ([]ItemMeta, error)
+}
+
+// stores that can be imported into
+type ImportableStorer interface {
+    Storer
+    StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error)
+}
+
+/* Write the items of storer with counters from since on to writer,
+ *  returning the manifest written.
+ * Blobs whose hash is not in the index are read twice, to checksum them first.
+ */
+func ExportArchive(storer ExportableStorer, writer io.Writer, since int64) (*ArchiveManifest, error) {
+    owner := storer.Owner()
+    if owner == nil { return nil, errors.New("Store has no owner") }
+    _, capacity := storer.Size()
+    metas, err := storer.QueryItems(ItemQuery{Since: since})
+    if err != nil { return nil, err }
+    manifest := &ArchiveManifest{
+        Version: ArchiveVersion,
+        Owner: types.KeyToString(owner.PublicKey),
+        Capacity: capacity,
+        Since: since,
+        Next: since,
+        Created: time.Now(),
+        Items: []ArchiveItem{},
+    }
+    if addressed, ok := storer.(interface{ ContentAddressed() bool }); ok {
+        manifest.ContentAddressed = addressed.ContentAddressed() }
+    exported := []ItemMeta{}
+    for _, meta := range metas {
+        if meta.Counter >= manifest.Next { manifest.Next = meta.Counter + 1 }
+        item, err := archiveItem(storer, meta)
+        if err == ErrNotFound { continue } // removed since it was listed
+        if err != nil { return nil, err }
+        manifest.Items = append(manifest.Items, item)
+        exported = append(exported, meta)
+    }
+
+    archive := tar.NewWriter(writer)
+    manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil { return nil, err }
+    err = archive.WriteHeader(&tar.Header{Name: archiveManifestName, Mode: 0600, Size: int64(len(manifestJSON)), ModTime: manifest.Created})
+    if err == nil {
+        _, err = archive.Write(manifestJSON) }
+    if err != nil { return nil, err }
+    for i, meta := range exported {
+        err = exportBlob(storer, archive, meta.Id, manifest.Items[i], manifest.Created)
+        if err != nil { return nil, err }
+    }
+    return manifest, archive.Close()
+}
+
+// the manifest entry for an item, checksumming its blob if the index has no hash
+func archiveItem(storer Storer, meta ItemMeta) (ArchiveItem, error) {
+    blob, err := storer.Open(meta.Id)
+    if err != nil { return ArchiveItem{}, err }
+    defer blob.Close()
+    hash := meta.Hash
+    if hash == nil {
+        hash, err = ReaderContentId(io.NewSectionReader(blob, 0, blob.Size()))
+        if err != nil { return ArchiveItem{}, err }
+    }
+    return ArchiveItem{meta.Counter, meta.Id.String(), blob.Size(), meta.Received, meta.Sender, meta.Expires, hash.String()}, nil
+}
+
+// write a blob, checking it against the manifest as it goes
+func exportBlob(storer Storer, archive *tar.Writer, id types.Id, item ArchiveItem, modTime time.Time) error {
+    blob, err := storer.Open(id)
+    if err != nil { return err }
+    defer blob.Close()
+    if blob.Size() != item.Size {
+        return errors.New(fmt.Sprintf("Blob %v changed size during export", item.Id)) }
+    err = archive.WriteHeader(&tar.Header{Name: archiveItemPrefix + item.Id, Mode: 0600, Size: item.Size, ModTime: modTime})
+    if err != nil { return err }
+    hasher := sha256.New()
+    _, err = io.Copy(io.MultiWriter(archive, hasher), io.NewSectionReader(blob, 0, item.Size))
+    if err != nil { return err }
+    if types.Id(hasher.Sum(nil)).String() != item.Checksum {
+        return errors.New(fmt.Sprintf("Blob %v does not match its hash in the index", item.Id)) }
+    return nil
+}
+
+/* Read an archive written by ExportArchive, storing its items into the store
+ *  open returns for its manifest, e.g. one freshly allocated for its owner.
+ * Items the store already has are skipped, so an interrupted import can
+ *  be run again. Stops with ErrArchiveChecksum at the first corrupt blob,
+ *  which is not kept.
+ */
+func ImportArchive(reader io.Reader, open func(manifest *ArchiveManifest) (ImportableStorer, error)) (*ArchiveManifest, error) {
+    archive := tar.NewReader(reader)
+    header, err := archive.Next()
+    if err != nil { return nil, err }
+    if header.Name != archiveManifestName {
+        return nil, errors.New("Archive does not start with a manifest") }
+    manifest := &ArchiveManifest{}
+    err = json.NewDecoder(archive).Decode(manifest)
+    if err != nil { return nil, err }
+    if manifest.Version != ArchiveVersion { return manifest, ErrArchiveVersion }
+    storer, err := open(manifest)
+    if err != nil { return manifest, err }
+    owner := storer.Owner()
+    if owner == nil || types.KeyToString(owner.PublicKey) != manifest.Owner { return manifest, ErrOwnerMismatch }
+    if manifest.ContentAddressed {
+        if addressed, ok := storer.(interface{ SetContentAddressed(bool) error }); ok {
+            err = addressed.SetContentAddressed(true)
+            if err != nil { return manifest, err }
+        }
+    }
+    for _, item := range manifest.Items {
+        header, err := archive.Next()
+        if err == io.EOF { err = io.ErrUnexpectedEOF }
+        if err != nil { return manifest, err }
+        if header.Name != archiveItemPrefix + item.Id || header.Size != item.Size {
+            return manifest, errors.New(fmt.Sprintf("Expected %v%v in archive, found %v", archiveItemPrefix, item.Id, header.Name))
+        }
+        err = importItem(storer, item, archive)
+        if err != nil { return manifest, err }
+    }
+    return manifest, nil
+}
+
+func importItem(storer ImportableStorer, item ArchiveItem, reader io.Reader) error {
+    id, err := types.StringToId(item.Id)
+    if err != nil { return err }
+    if _, err := storer.Stat(id); err == nil { return nil }
+    checksum, err := types.StringToId(item.Checksum)
+    if err != nil { return ErrArchiveChecksum }
+    // the store checks the blob against its checksum before committing it
+    meta := ItemMeta{Id: id, Size: item.Size, Received: item.Received, Sender: item.Sender, Expires: item.Expires, Hash: checksum}
+    _, err = storer.StoreItem(meta, reader)
+    if err == ErrHashMismatch { return ErrArchiveChecksum }
+    return err
+}
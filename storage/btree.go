@@ -0,0 +1,242 @@
+package storage
+
+import (
+    "sort"
+)
+
+/* A btree maps string keys to string values, in key order.
+ * MemIndex & LogIndex keep their key/values in one, for ordered Finds,
+ *  & their items' ids in another, by counter.
+ * Not safe for concurrent use.
+ */
+type btree struct {
+    root *btreeNode
+    length int
+}
+
+type btreeNode struct {
+    keys []string
+    values []string
+    children []*btreeNode // nil for leaves, else one more than keys
+}
+
+// nodes other than the root hold between btreeDegree-1 & 2*btreeDegree-1 keys
+const btreeDegree = 16
+
+func (this *btree) Len() int {
+    return this.length
+}
+
+func (this *btree) Get(key string) (string, bool) {
+    for node := this.root; node != nil; {
+        i, found := node.search(key)
+        if found { return node.values[i], true }
+        if node.leaf() { break }
+        node = node.children[i]
+    }
+    return "", false
+}
+
+func (this *btree) Set(key, value string) {
+    if this.root == nil { this.root = &btreeNode{} }
+    if len(this.root.keys) == 2*btreeDegree-1 {
+        this.root = &btreeNode{children: []*btreeNode{this.root}}
+        this.root.splitChild(0)
+    }
+    if this.root.insert(key, value) { this.length++ }
+}
+
+// returns whether key was there
+func (this *btree) Delete(key string) bool {
+    if this.root == nil { return false }
+    deleted := this.root.remove(key)
+    if len(this.root.keys) == 0 {
+        if this.root.leaf() {
+            this.root = nil
+        } else {
+            this.root = this.root.children[0]
+        }
+    }
+    if deleted { this.length-- }
+    return deleted
+}
+
+// Call fn for each key >= from in order, until it returns false
+func (this *btree) Ascend(from string, fn func(key, value string) bool) {
+    if this.root != nil { this.root.ascend(from, fn) }
+}
+
+func (this *btreeNode) leaf() bool {
+    return this.children == nil
+}
+
+// the index of the first key >= key, & whether it is key
+func (this *btreeNode) search(key string) (int, bool) {
+    i := sort.SearchStrings(this.keys, key)
+    return i, i < len(this.keys) && this.keys[i] == key
+}
+
+// insert into a node that is not full, returning whether key is new
+func (this *btreeNode) insert(key, value string) bool {
+    node := this
+    for {
+        i, found := node.search(key)
+        if found {
+            node.values[i] = value
+            return false
+        }
+        if node.leaf() {
+            node.keys = insertString(node.keys, i, key)
+            node.values = insertString(node.values, i, value)
+            return true
+        }
+        if len(node.children[i].keys) == 2*btreeDegree-1 {
+            node.splitChild(i)
+            if key == node.keys[i] {
+                node.values[i] = value
+                return false
+            }
+            if key > node.keys[i] { i++ }
+        }
+        node = node.children[i]
+    }
+}
+
+// split the full child i in two, moving its median up into this node
+func (this *btreeNode) splitChild(i int) {
+    child := this.children[i]
+    mid := btreeDegree - 1
+    right := &btreeNode{
+        keys: append([]string{}, child.keys[mid+1:]...),
+        values: append([]string{}, child.values[mid+1:]...),
+    }
+    if !child.leaf() {
+        right.children = append([]*btreeNode{}, child.children[mid+1:]...)
+        child.children = child.children[:mid+1]
+    }
+    key, value := child.keys[mid], child.values[mid]
+    child.keys, child.values = child.keys[:mid], child.values[:mid]
+    this.keys = insertString(this.keys, i, key)
+    this.values = insertString(this.values, i, value)
+    this.children = append(this.children, nil)
+    copy(this.children[i+2:], this.children[i+1:])
+    this.children[i+1] = right
+}
+
+/* Remove key from this subtree, returning whether it was there.
+ * Unless this is the root, it has at least btreeDegree keys, so that
+ *  removing one never leaves it too small.
+ */
+func (this *btreeNode) remove(key string) bool {
+    i, found := this.search(key)
+    if this.leaf() {
+        if !found { return false }
+        this.keys = removeString(this.keys, i)
+        this.values = removeString(this.values, i)
+        return true
+    }
+    if found {
+        left, right := this.children[i], this.children[i+1]
+        if len(left.keys) >= btreeDegree {
+            // replace with the predecessor
+            k, v := left.last()
+            this.keys[i], this.values[i] = k, v
+            return left.remove(k)
+        }
+        if len(right.keys) >= btreeDegree {
+            // or the successor
+            k, v := right.first()
+            this.keys[i], this.values[i] = k, v
+            return right.remove(k)
+        }
+        this.merge(i)
+        return left.remove(key)
+    }
+    // make sure the child has a key to spare before descending
+    child := this.children[i]
+    if len(child.keys) < btreeDegree {
+        switch {
+        case i > 0 && len(this.children[i-1].keys) >= btreeDegree:
+            this.rotateRight(i-1)
+        case i < len(this.keys) && len(this.children[i+1].keys) >= btreeDegree:
+            this.rotateLeft(i)
+        case i < len(this.keys):
+            this.merge(i)
+        default:
+            this.merge(i-1)
+            child = this.children[i-1]
+        }
+    }
+    return child.remove(key)
+}
+
+func (this *btreeNode) first() (string, string) {
+    node := this
+    for !node.leaf() { node = node.children[0] }
+    return node.keys[0], node.values[0]
+}
+
+func (this *btreeNode) last() (string, string) {
+    node := this
+    for !node.leaf() { node = node.children[len(node.children)-1] }
+    return node.keys[len(node.keys)-1], node.values[len(node.values)-1]
+}
+
+// merge child i+1 & key i into child i
+func (this *btreeNode) merge(i int) {
+    left, right := this.children[i], this.children[i+1]
+    left.keys = append(append(left.keys, this.keys[i]), right.keys...)
+    left.values = append(append(left.values, this.values[i]), right.values...)
+    if !left.leaf() { left.children = append(left.children, right.children...) }
+    this.keys = removeString(this.keys, i)
+    this.values = removeString(this.values, i)
+    this.children = append(this.children[:i+1], this.children[i+2:]...)
+}
+
+// move the last key of child i up, & key i down into child i+1
+func (this *btreeNode) rotateRight(i int) {
+    left, child := this.children[i], this.children[i+1]
+    last := len(left.keys) - 1
+    child.keys = insertString(child.keys, 0, this.keys[i])
+    child.values = insertString(child.values, 0, this.values[i])
+    this.keys[i], this.values[i] = left.keys[last], left.values[last]
+    left.keys, left.values = left.keys[:last], left.values[:last]
+    if !left.leaf() {
+        child.children = append([]*btreeNode{left.children[last+1]}, child.children...)
+        left.children = left.children[:last+1]
+    }
+}
+
+// move the first key of child i+1 up, & key i down into child i
+func (this *btreeNode) rotateLeft(i int) {
+    child, right := this.children[i], this.children[i+1]
+    child.keys = append(child.keys, this.keys[i])
+    child.values = append(child.values, this.values[i])
+    this.keys[i], this.values[i] = right.keys[0], right.values[0]
+    right.keys, right.values = removeString(right.keys, 0), removeString(right.values, 0)
+    if !right.leaf() {
+        child.children = append(child.children, right.children[0])
+        right.children = append([]*btreeNode{}, right.children[1:]...)
+    }
+}
+
+func (this *btreeNode) ascend(from string, fn func(key, value string) bool) bool {
+    i, _ := this.search(from)
+    for ; i < len(this.keys); i++ {
+        if !this.leaf() && !this.children[i].ascend(from, fn) { return false }
+        if !fn(this.keys[i], this.values[i]) { return false }
+    }
+    if !this.leaf() { return this.children[i].ascend(from, fn) }
+    return true
+}
+
+func insertString(list []string, i int, value string) []string {
+    list = append(list, "")
+    copy(list[i+1:], list[i:])
+    list[i] = value
+    return list
+}
+
+func removeString(list []string, i int) []string {
+    return append(list[:i], list[i+1:]...)
+}
@@ -0,0 +1,476 @@
+package storage
+
+import (
+    "context"
+    "io"
+    "io/ioutil"
+    "fmt"
+    "bytes"
+    "time"
+    "testing"
+    "path/filepath"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Every Storer & index implementation should pass the same tests.
+ * Each implementation gets a Test function below that runs the suite.
+ */
+
+// the optional parts of OSStore & MemStore the suite exercises
+type storerUnderTest interface {
+    Storer
+    mailbox
+    StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error)
+    GetItem(id types.Id) (*ItemMeta, error)
+    SetContentAddressed(contentAddressed bool) error
+    Verify(id types.Id) error
+    SetExpiry(id types.Id, expires time.Time) error
+    SweepExpired(now time.Time, limit int) (int, error)
+}
+
+// the subset of the server's mailbox interface
+type mailbox interface {
+    FindItems(ctx context.Context, since int64, limit int) *ItemIterator
+    WatchItems(ch chan struct{})
+    UnwatchItems(ch chan struct{})
+}
+
+func TestMemIndexConformance(t *testing.T) {
+    testIndexConformance(t, NewMemIndex())
+}
+
+func TestLogIndexConformance(t *testing.T) {
+    index, err := NewLogIndex(filepath.Join(t.TempDir(), "index.log"))
+    if err != nil { t.Fatal(err) }
+    defer index.Close()
+    testIndexConformance(t, index)
+}
+
+func TestOSStoreConformance(t *testing.T) {
+    testStorerConformance(t, func(owner *types.Identity, capacity int64) (Storer, error) {
+        return NewOSStore(t.TempDir(), owner, capacity, nil)
+    })
+}
+
+func TestOSStoreLogIndexConformance(t *testing.T) {
+    defer func(backend string) { DefaultIndexBackend = backend }(DefaultIndexBackend)
+    DefaultIndexBackend = IndexLog
+    testStorerConformance(t, func(owner *types.Identity, capacity int64) (Storer, error) {
+        return NewOSStore(t.TempDir(), owner, capacity, nil)
+    })
+}
+
+func TestMemStoreConformance(t *testing.T) {
+    testStorerConformance(t, NewMemStore)
+}
+
+func itemIds(t *testing.T, index interface{ FindItems(context.Context, int64, int) *ItemIterator }, since int64, limit int) ([]int64, []types.Id) {
+    items := index.FindItems(context.Background(), since, limit)
+    defer items.Close()
+    counters, ids := []int64{}, []types.Id{}
+    for items.Next() {
+        counters = append(counters, items.Item().Counter)
+        ids = append(ids, items.Item().Id)
+    }
+    if err := items.Err(); err != nil { t.Fatal("FindItems failed:", err) }
+    return counters, ids
+}
+
+func testIndexConformance(t *testing.T, index Index) {
+    // key/values
+    if _, err := index.Get("missing"); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound for a missing key, got", err)
+    }
+    index.Set("b", "1")
+    index.SetDefault("b", "2")
+    index.SetDefault("c", "3")
+    index.Set("a", "0")
+    if value, _ := index.Get("b"); value != "1" {
+        t.Fatal("SetDefault overwrote a value, got", value)
+    }
+    if value, _ := index.Get("c"); value != "3" {
+        t.Fatal("SetDefault did not set a missing value, got", value)
+    }
+    index.Delete("c")
+    if _, err := index.Get("c"); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound for a deleted key, got", err)
+    }
+    keys := index.Find(context.Background(), "a", 2)
+    found := ""
+    for keys.Next() {
+        found += keys.Key() + "=" + keys.Value() + " "
+    }
+    if keys.Err() != nil { t.Fatal(keys.Err()) }
+    if found != "a=0 b=1 " {
+        t.Fatal("Find returned the wrong keys:", found)
+    }
+    // past a page, resuming from a cursor
+    for i := 0; i < iteratorPageSize + 50; i++ {
+        index.Set(fmt.Sprintf("p:%03d", i), "")
+    }
+    keys = index.Find(context.Background(), "p:", -1)
+    count := 0
+    for count < iteratorPageSize + 10 && keys.Next() { count++ }
+    keys.Close()
+    if keys.Next() || keys.Key() != fmt.Sprintf("p:%03d", iteratorPageSize + 9) {
+        t.Fatal("Close did not stop Find at", keys.Key())
+    }
+    keys = index.Find(context.Background(), keys.Cursor(), -1)
+    for keys.Next() { count++ }
+    if keys.Err() != nil || count != iteratorPageSize + 50 {
+        t.Fatal("Expected to resume Find after the cursor, got", count, keys.Err())
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    keys = index.Find(ctx, "p:", -1)
+    keys.Next()
+    cancel()
+    if keys.Next() || keys.Err() != context.Canceled {
+        t.Fatal("Find went on after its context was cancelled:", keys.Err())
+    }
+
+    // items
+    if _, err := index.AddItem(types.Id("short")); err == nil {
+        t.Fatal("Expected an error adding an invalid id")
+    }
+    ids := []types.Id{}
+    last := int64(0)
+    for i := 0; i < 3; i++ {
+        id := types.Id(RandomData(32))
+        counter, err := index.AddItem(id)
+        if err != nil { t.Fatal(err) }
+        if counter <= last {
+            t.Fatal(fmt.Sprintf("Counters should increase, got %v after %v", counter, last))
+        }
+        last = counter
+        ids = append(ids, id)
+    }
+    if _, err := index.AddItem(ids[0]); err != ErrDuplicateItem {
+        t.Fatal("Expected ErrDuplicateItem adding an id twice, got", err)
+    }
+    dupTx, _ := index.Transaction()
+    dupErr := dupTx.AddItem(ids[1])
+    if dupErr == nil {
+        dupErr = dupTx.Commit()
+    } else {
+        dupTx.Rollback()
+    }
+    if dupErr != ErrDuplicateItem {
+        t.Fatal("Expected ErrDuplicateItem adding an id twice in a transaction, got", dupErr)
+    }
+    counters, found2 := itemIds(t, index, 0, -1)
+    if len(found2) != 3 || !bytes.Equal(found2[0], ids[0]) || !bytes.Equal(found2[2], ids[2]) {
+        t.Fatal("FindItems returned the wrong items:", found2)
+    }
+    _, found2 = itemIds(t, index, counters[1], 1)
+    if len(found2) != 1 || !bytes.Equal(found2[0], ids[1]) {
+        t.Fatal("FindItems ignored since or limit:", found2)
+    }
+    items := index.FindItems(context.Background(), 0, 2)
+    for items.Next() {}
+    _, found2 = itemIds(t, index, items.Cursor(), -1)
+    if len(found2) != 1 || !bytes.Equal(found2[0], ids[2]) {
+        t.Fatal("Expected to resume FindItems after the cursor, got", found2)
+    }
+
+    // transactions
+    watch := make(chan struct{}, 1)
+    index.Watch(watch)
+    defer index.Unwatch(watch)
+    tx, err := index.Transaction()
+    if err != nil { t.Fatal(err) }
+    tx.Set("a", "rolled back")
+    tx.AddItem(types.Id(RandomData(32)))
+    if value, _ := tx.Get("a"); value != "rolled back" {
+        t.Fatal("A transaction should see its own writes, got", value)
+    }
+    tx.Rollback()
+    if value, _ := index.Get("a"); value != "0" {
+        t.Fatal("Rollback did not discard a write, got", value)
+    }
+    if _, found2 = itemIds(t, index, 0, -1); len(found2) != 3 {
+        t.Fatal("Rollback did not discard an item")
+    }
+    select {
+    case <-watch:
+        t.Fatal("Watchers were signalled for a rolled back item")
+    default:
+    }
+
+    tx, err = index.Transaction()
+    if err != nil { t.Fatal(err) }
+    added := types.Id(RandomData(32))
+    tx.Set("a", "committed")
+    tx.Delete("b")
+    tx.AddItem(added)
+    existed, err := tx.DeleteItem(ids[0])
+    if err != nil || !existed {
+        t.Fatal("DeleteItem should report an existing item:", existed, err)
+    }
+    existed, err = tx.DeleteItem(types.Id(RandomData(32)))
+    if err != nil || existed {
+        t.Fatal("DeleteItem should report a missing item:", existed, err)
+    }
+    if _, err = tx.Get("b"); err != ErrNotFound {
+        t.Fatal("A transaction should see its own deletes, got", err)
+    }
+    err = tx.Commit()
+    if err != nil { t.Fatal(err) }
+    if value, _ := index.Get("a"); value != "committed" {
+        t.Fatal("Commit did not apply a write, got", value)
+    }
+    if _, err = index.Get("b"); err != ErrNotFound {
+        t.Fatal("Commit did not apply a delete, got", err)
+    }
+    counters, found2 = itemIds(t, index, 0, -1)
+    if len(found2) != 3 || !bytes.Equal(found2[0], ids[1]) || !bytes.Equal(found2[2], added) || counters[2] <= last {
+        t.Fatal("Commit did not apply the item changes:", counters, found2)
+    }
+    select {
+    case <-watch:
+    default:
+        t.Fatal("Watchers were not signalled for a committed item")
+    }
+
+    // expiry
+    now := time.Now()
+    if err = index.SetExpiry(types.Id(RandomData(32)), now); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound setting the expiry of a missing item, got", err)
+    }
+    index.SetExpiry(ids[2], now.Add(-time.Minute))
+    index.SetExpiry(ids[1], now.Add(-time.Hour))
+    index.SetExpiry(added, now.Add(time.Hour))
+    expired, err := index.FindExpired(now, -1)
+    if err != nil { t.Fatal(err) }
+    if len(expired) != 2 || !bytes.Equal(expired[0], ids[1]) || !bytes.Equal(expired[1], ids[2]) {
+        t.Fatal("FindExpired returned the wrong items:", expired)
+    }
+    index.SetExpiry(ids[1], time.Time{})
+    if expired, _ = index.FindExpired(now, -1); len(expired) != 1 {
+        t.Fatal("Clearing an expiry did not take, got", expired)
+    }
+    // meta
+    if _, err = index.GetItem(ids[0]); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound for a deleted item, got", err)
+    }
+    meta, err := index.GetItem(ids[1])
+    if err != nil { t.Fatal(err) }
+    if meta.Size != -1 || !meta.Received.IsZero() || meta.Sender != "" || meta.Hash != nil {
+        t.Fatal("Items added without meta should have none, got", meta)
+    }
+    if err = index.SetItemSize(ids[1], 7); err != nil { t.Fatal(err) }
+    senders := []string{"bob", "alice", "bob"}
+    for i, sender := range senders {
+        data := RandomData(uint(10 * (i + 1)))
+        _, err = index.AddItemMeta(ItemMeta{Id: ContentId(data), Size: int64(len(data)), Received: now.Add(time.Duration(i) * time.Hour),
+            Sender: sender, Hash: ContentId(data)})
+        if err != nil { t.Fatal(err) }
+    }
+    sizes := func(query ItemQuery) string {
+        items, err := index.QueryItems(query)
+        if err != nil { t.Fatal(err) }
+        found := ""
+        for _, item := range items { found += fmt.Sprint(item.Size) + " " }
+        return found
+    }
+    for _, c := range []struct { query ItemQuery; expected string }{
+        {ItemQuery{}, "7 -1 -1 10 20 30 "},
+        {ItemQuery{Sender: "bob"}, "10 30 "},
+        {ItemQuery{MinSize: 15}, "20 30 "},
+        {ItemQuery{MaxSize: 15}, "7 10 "},
+        {ItemQuery{ReceivedAfter: now.Add(time.Minute)}, "20 30 "},
+        {ItemQuery{ReceivedBefore: now.Add(time.Minute)}, "10 "},
+        {ItemQuery{SortBy: SortSize, Descending: true, Limit: 2}, "30 20 "},
+        {ItemQuery{SortBy: SortSender, MinSize: 1}, "7 20 10 30 "},
+        {ItemQuery{SortBy: SortReceived, Descending: true, Sender: "bob"}, "30 10 "},
+    } {
+        if found := sizes(c.query); found != c.expected {
+            t.Fatal(fmt.Sprintf("QueryItems(%+v) returned sizes %v, expected %v", c.query, found, c.expected))
+        }
+    }
+    if _, err = index.QueryItems(ItemQuery{SortBy: "id; DROP TABLE items"}); err != ErrUnknownSort {
+        t.Fatal("Expected ErrUnknownSort, got", err)
+    }
+    tx, _ = index.Transaction()
+    tx.AddItemMeta(ItemMeta{Id: types.Id(RandomData(32)), Size: 99, Sender: "carol"})
+    tx.Commit()
+    if found := sizes(ItemQuery{Sender: "carol"}); found != "99 " {
+        t.Fatal("AddItemMeta in a transaction did not record meta, got", found)
+    }
+}
+
+func testStorerConformance(t *testing.T, newStorer func(owner *types.Identity, capacity int64) (Storer, error)) {
+    storer, err := newStorer(TestIdentity, 1000)
+    if err != nil { t.Fatal("Could not create store:", err) }
+    defer storer.Delete()
+    store, ok := storer.(storerUnderTest)
+    if !ok { t.Fatal(fmt.Sprintf("%T is missing methods", storer)) }
+
+    if owner := store.Owner(); owner == nil || *owner.PublicKey != *TestIdentity.PublicKey {
+        t.Fatal("Wrong owner:", owner)
+    }
+    if used, capacity := store.Size(); used != 0 || capacity != 1000 {
+        t.Fatal(fmt.Sprintf("Wrong size. Expected 0/1000, got %v/%v", used, capacity))
+    }
+    if softLimit := store.SoftLimit(); softLimit != 900 {
+        t.Fatal("Wrong soft limit. Expected 900, got", softLimit)
+    }
+
+    watch := make(chan struct{}, 1)
+    store.WatchItems(watch)
+    defer store.UnwatchItems(watch)
+
+    // storing
+    id := types.Id(RandomData(32))
+    if err = store.Store(id, RandomData(100)); err != nil { t.Fatal(err) }
+    if err = store.Store(id, RandomData(100)); err == nil {
+        t.Fatal("Expected an error storing an existing id")
+    }
+    if err = store.Store(types.Id("short"), RandomData(100)); err == nil {
+        t.Fatal("Expected an error storing an invalid id")
+    }
+    shortId := types.Id(RandomData(32))
+    if err = store.StoreReader(shortId, bytes.NewReader(RandomData(10)), 100); err == nil {
+        t.Fatal("Expected an error storing a short read")
+    }
+    if used, _ := store.Size(); used != 100 {
+        t.Fatal("Failed stores changed usage, got", used)
+    }
+    if err = store.Store(shortId, RandomData(100)); err != nil {
+        t.Fatal("A failed store left its id behind:", err)
+    }
+    data := RandomData(100)
+    contentId, err := store.StoreContent(bytes.NewReader(data), 100)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(contentId, ContentId(data)) || store.Verify(contentId) != nil {
+        t.Fatal("StoreContent stored under the wrong id:", contentId)
+    }
+    if store.Verify(id) != ErrIdMismatch {
+        t.Fatal("Verify should fail for data not under its ContentId")
+    }
+    select {
+    case <-watch:
+    default:
+        t.Fatal("Watchers were not signalled for a stored item")
+    }
+    _, ids := itemIds(t, store, 0, -1)
+    if len(ids) != 3 || !bytes.Equal(ids[0], id) || !bytes.Equal(ids[1], shortId) || !bytes.Equal(ids[2], contentId) {
+        t.Fatal("FindItems returned the wrong items:", ids)
+    }
+
+    // meta
+    itemData := RandomData(50)
+    expires := time.Now().Add(time.Hour)
+    itemId, err := store.StoreItem(ItemMeta{Size: 50, Sender: "someone", Expires: expires}, bytes.NewReader(itemData))
+    if err != nil { t.Fatal(err) }
+    meta, err := store.GetItem(itemId)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(itemId, ContentId(itemData)) || meta.Size != 50 || meta.Sender != "someone" || !bytes.Equal(meta.Hash, itemId) ||
+        meta.Expires.Unix() != expires.Unix() || time.Since(meta.Received) > time.Minute {
+        t.Fatal("Wrong meta:", meta)
+    }
+    if meta, _ = store.GetItem(id); meta.Size != 100 || meta.Hash == nil || bytes.Equal(meta.Hash, id) {
+        t.Fatal("Wrong meta:", meta)
+    }
+    swept, err := store.SweepExpired(expires, 10)
+    if err != nil || swept != 1 { t.Fatal("Could not sweep the item:", swept, err) }
+    // content that doesn't match the expected hash is never stored
+    hashUsed, _ := store.Size()
+    badId := types.Id(RandomData(32))
+    _, err = store.StoreItem(ItemMeta{Id: badId, Size: 50, Hash: ContentId(RandomData(50))}, bytes.NewReader(itemData))
+    if err != ErrHashMismatch { t.Fatal("Expected ErrHashMismatch, got", err) }
+    if _, err := store.GetItem(badId); err != ErrNotFound { t.Fatal("Expected no item for a mismatched hash:", err) }
+    if used, _ := store.Size(); used != hashUsed { t.Fatal("A mismatched hash changed the usage:", used) }
+
+    // reading
+    blob, err := store.Open(contentId)
+    if err != nil { t.Fatal(err) }
+    if blob.Size() != 100 { t.Fatal("Wrong blob size:", blob.Size()) }
+    section, err := ioutil.ReadAll(io.NewSectionReader(blob, 10, 20))
+    if err != nil || !bytes.Equal(section, data[10:30]) {
+        t.Fatal("Could not read a range of the blob:", err)
+    }
+    blob.Close()
+    if meta, err = store.Stat(contentId); err != nil || meta.Size != 100 || !bytes.Equal(meta.Id, contentId) {
+        t.Fatal("Wrong Stat:", meta, err)
+    }
+    if _, err = store.Open(types.Id(RandomData(32))); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound opening a missing blob, got", err)
+    }
+    if _, err = store.Stat(types.Id(RandomData(32))); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound for Stat of a missing blob, got", err)
+    }
+
+    // an enciphered blob can be read in place
+    key := &[32]byte{}
+    copy(key[:], RandomData(32))
+    plain := RandomData(500)
+    ciphered := &bytes.Buffer{}
+    writer := types.NewCipherWriter(ciphered, key, 2048)
+    writer.Write(plain)
+    writer.Close()
+    cipherId, err := store.StoreContent(bytes.NewReader(ciphered.Bytes()), int64(ciphered.Len()))
+    if err != nil { t.Fatal(err) }
+    blob, err = store.Open(cipherId)
+    if err != nil { t.Fatal(err) }
+    deciphered := make([]byte, 100)
+    _, err = types.NewCipherReaderAt(blob, key, 2048).ReadAt(deciphered, 200)
+    blob.Close()
+    if err != nil || !bytes.Equal(deciphered, plain[200:300]) {
+        t.Fatal("Could not decipher a range of the blob:", err)
+    }
+
+    // removing
+    usedBefore, _ := store.Size()
+    removedId, err := store.StoreContent(bytes.NewReader(RandomData(30)), 30)
+    if err != nil { t.Fatal(err) }
+    existed, err := store.Remove(removedId)
+    if err != nil || !existed { t.Fatal("Remove should report an existing item:", existed, err) }
+    if used, _ := store.Size(); used != usedBefore {
+        t.Fatal(fmt.Sprintf("Remove did not credit usage. Expected %v, got %v", usedBefore, used))
+    }
+    if _, err = store.Open(removedId); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound opening a removed blob, got", err)
+    }
+    if _, err = store.GetItem(removedId); err != ErrNotFound {
+        t.Fatal("Expected ErrNotFound for a removed item, got", err)
+    }
+    existed, err = store.Remove(removedId)
+    if err != nil || existed { t.Fatal("Remove should report a missing item:", existed, err) }
+
+    // content-addressed mode
+    store.SetContentAddressed(true)
+    if err = store.Store(types.Id(RandomData(32)), RandomData(10)); err != ErrIdMismatch {
+        t.Fatal("Expected ErrIdMismatch in content-addressed mode, got", err)
+    }
+    data = RandomData(10)
+    if err = store.Store(ContentId(data), data); err != nil { t.Fatal(err) }
+    store.SetContentAddressed(false)
+
+    // capacity
+    err = store.Store(types.Id(RandomData(32)), RandomData(1000))
+    if !IsCapacityError(err) {
+        t.Fatal("Expected a CapacityError, got", err)
+    }
+    cipherSize := int64(ciphered.Len())
+    if used, _ := store.Size(); used != 310 + cipherSize {
+        t.Fatal("Wrong usage. Expected", 310 + cipherSize, "got", used)
+    }
+
+    // expiry
+    now := time.Now()
+    if err = store.SetExpiry(id, now.Add(-time.Minute)); err != nil { t.Fatal(err) }
+    store.SetExpiry(shortId, now.Add(time.Hour))
+    removed, err := store.SweepExpired(now, 10)
+    if err != nil || removed != 1 {
+        t.Fatal("SweepExpired should remove 1 item, got", removed, err)
+    }
+    if used, _ := store.Size(); used != 210 + cipherSize {
+        t.Fatal("Sweeping did not credit usage, got", used)
+    }
+    if _, ids = itemIds(t, store, 0, -1); len(ids) != 4 || bytes.Equal(ids[0], id) {
+        t.Fatal("Sweeping did not remove the item:", ids)
+    }
+    if err = store.Store(id, RandomData(100)); err != nil {
+        t.Fatal("Could not store again under a swept id:", err)
+    }
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+    "os"
+    "io"
+    "bytes"
+    "errors"
+    "crypto/sha256"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Content addressing
+ * The ContentId of a blob is the SHA-256 of its bytes.
+ * A store in content-addressed mode refuses to store a blob under any other id,
+ *  and blobs can be verified against their id when read back.
+ */
+
+var ErrIdMismatch error = errors.New("Id does not match content")
+var ErrHashMismatch error = errors.New("Content does not match the expected hash")
+
+func ContentId(data []byte) types.Id {
+    hash := sha256.Sum256(data)
+    return types.Id(hash[:])
+}
+
+// Compute the ContentId of everything read from reader
+func ReaderContentId(reader io.Reader) (types.Id, error) {
+    hasher := sha256.New()
+    _, err := io.Copy(hasher, reader)
+    if err != nil { return nil, err }
+    return types.Id(hasher.Sum(nil)), nil
+}
+
+func (this *OSStore) ContentAddressed() bool {
+    value, err := this.Index.Get(MetaContentAddressed)
+    return err == nil && value == "true"
+}
+
+/* Turn content-addressed mode on or off.
+ * Blobs stored before it was turned on are not checked; use Verify.
+ */
+func (this *OSStore) SetContentAddressed(contentAddressed bool) error {
+    if contentAddressed {
+        return this.Index.Set(MetaContentAddressed, "true")
+    }
+    return this.Index.Delete(MetaContentAddressed)
+}
+
+/* Store exactly size bytes read from reader under their ContentId,
+ *  which is returned. Works in either mode.
+ */
+func (this *OSStore) StoreContent(reader io.Reader, size int64) (types.Id, error) {
+    return this.store(ItemMeta{Size: size}, reader)
+}
+
+/* Check that the blob stored under id is the content it names.
+ * Returns ErrIdMismatch if it isn't.
+ */
+func (this *OSStore) Verify(id types.Id) error {
+    path, err := this.findPath(id)
+    if err != nil { return err }
+    file, err := os.Open(path)
+    if err != nil { return err }
+    defer file.Close()
+    contentId, err := ReaderContentId(file)
+    if err != nil { return err }
+    if !bytes.Equal(id, contentId) { return ErrIdMismatch }
+    return nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "errors"
+    "path/filepath"
+    "encoding/hex"
+    "encoding/base64"
+    "github.com/jaekwon/go-prelude/fs"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Deduplication
+ * Stores sharing a BlobPool keep one copy of identical blobs, e.g. a body
+ *  deposited for many recipients on one server.
+ * A store's file for an item is then a hard link to the pool's file, which is
+ *  named by its ContentId. The pool's index counts these links in its blobs
+ *  table, & the pool's file is removed along with the last of them.
+ * Every owner is still charged the full size of each of their items,
+ *  so usage does not depend on what other owners happen to store.
+ * As the links themselves keep a blob alive, a crash between linking &
+ *  counting can only leave a pooled blob behind, never lose one.
+ */
+type BlobPool struct {
+    Dir string // on the same filesystem as the stores using it
+    Index Index
+
+    mtx sync.Mutex
+}
+
+func NewBlobPool(dir string, index Index) (*BlobPool, error) {
+    _, err := fs.EnsureDir(dir)
+    if err != nil { return nil, err }
+    return &BlobPool{Dir: dir, Index: index}, nil
+}
+
+// sharded like an OSStore's DataDir
+func (this *BlobPool) PathForHash(hash types.Id) (string, error) {
+    if len(hash) != 32 {
+        return "", errors.New(fmt.Sprintf("Hash was of the wrong length (expected 32, got %v).", len(hash)))
+    }
+    return filepath.Join(this.Dir, hex.EncodeToString(hash[0:1]), hex.EncodeToString(hash[1:2]),
+        base64.URLEncoding.EncodeToString(hash)), nil
+}
+
+/* Link the blob with ContentId hash to path, moving the file at tmpPath
+ *  into the pool unless it already has a copy.
+ */
+func (this *BlobPool) link(hash types.Id, size int64, tmpPath string, path string) error {
+    poolPath, err := this.PathForHash(hash)
+    if err != nil { return err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    _, err = os.Stat(poolPath)
+    created := os.IsNotExist(err)
+    if created {
+        _, err = fs.EnsureDir(filepath.Dir(poolPath))
+        if err == nil {
+            err = os.Rename(tmpPath, poolPath) }
+        if err == nil {
+            err = syncDir(filepath.Dir(poolPath)) }
+    }
+    if err == nil {
+        err = os.Link(poolPath, path)
+        if err == nil {
+            err = this.Index.AddBlobRef(hash, size)
+            if err != nil { os.Remove(path) }
+        }
+    }
+    if err != nil && created { os.Remove(poolPath) }
+    return err
+}
+
+/* Drop the reference of the file at path, which is about to be removed,
+ *  removing the pool's copy if it was the last.
+ * Files that are not links to the pool's copy, e.g. those stored before
+ *  the pool was in use, hold no reference.
+ */
+func (this *BlobPool) release(hash types.Id, path string) error {
+    poolPath, err := this.PathForHash(hash)
+    if err != nil { return nil } // not pooled
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    info, err := os.Stat(path)
+    if err != nil { return err }
+    poolInfo, err := os.Stat(poolPath)
+    if os.IsNotExist(err) { return nil }
+    if err != nil { return err }
+    if !os.SameFile(info, poolInfo) { return nil }
+    refs, err := this.Index.ReleaseBlobRef(hash)
+    if err != nil { return err }
+    if refs <= 0 {
+        err = os.Remove(poolPath)
+        if os.IsNotExist(err) { err = nil }
+    }
+    return err
+}
+
+// the number of pooled blobs & their total size
+func (this *BlobPool) Usage() (int64, int64, error) {
+    return this.Index.BlobUsage()
+}
+
+/* Remove a blob file of this store, dropping its pool reference first.
+ * hash is its ContentId, or nil if unknown, in which case it is computed.
+ * Caller must hold this.mtx.
+ */
+func (this *OSStore) removeBlob(hash types.Id, path string) error {
+    if this.Pool != nil {
+        if hash == nil {
+            file, err := os.Open(path)
+            if err != nil { return err }
+            hash, err = ReaderContentId(file)
+            file.Close()
+            if err != nil { return err }
+        }
+        err := this.Pool.release(hash, path)
+        if err != nil && !os.IsNotExist(err) { return err }
+    }
+    return os.Remove(path)
+}
@@ -0,0 +1,58 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+    "database/sql"
+    "github.com/jaekwon/gourami/types"
+)
+
+// see BlobPool
+// Count another reference to the pooled blob with ContentId hash
+func (this *SQLIndex) AddBlobRef(hash types.Id, size int64) error {
+    tx, err := this.DB.Begin()
+    if err != nil { return err }
+    _, err = tx.Exec("INSERT OR IGNORE INTO blobs (hash, refs, size) VALUES (?, 0, ?)", hash.String(), size)
+    if err == nil {
+        _, err = tx.Exec("UPDATE blobs SET refs = refs + 1 WHERE hash=?", hash.String()) }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+// Drop a reference to a pooled blob, returning how many are left
+func (this *SQLIndex) ReleaseBlobRef(hash types.Id) (int64, error) {
+    tx, err := this.DB.Begin()
+    if err != nil { return -1, err }
+    var refs int64
+    _, err = tx.Exec("UPDATE blobs SET refs = refs - 1 WHERE hash=?", hash.String())
+    if err == nil {
+        err = tx.QueryRow("SELECT refs FROM blobs WHERE hash=?", hash.String()).Scan(&refs) }
+    if err == sql.ErrNoRows {
+        refs, err = 0, nil
+    } else if err == nil && refs <= 0 {
+        _, err = tx.Exec("DELETE FROM blobs WHERE hash=?", hash.String())
+    }
+    if err != nil {
+        tx.Rollback()
+        return -1, err
+    }
+    return refs, tx.Commit()
+}
+
+// The references to a pooled blob, 0 if it is not pooled
+func (this *SQLIndex) BlobRefs(hash types.Id) (int64, error) {
+    var refs int64
+    err := this.DB.QueryRow("SELECT refs FROM blobs WHERE hash=?", hash.String()).Scan(&refs)
+    if err == sql.ErrNoRows { return 0, nil }
+    return refs, err
+}
+
+func (this *SQLIndex) BlobUsage() (int64, int64, error) {
+    var blobs, size int64
+    err := this.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").Scan(&blobs, &size)
+    return blobs, size, err
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+    "os"
+    "log"
+    "time"
+    "context"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Expiry
+ * Items may carry an expiry time in the index. Expired items are removed by
+ *  SweepExpired, usually run periodically by a Sweeper, which paces itself
+ *  so that sweeping does not starve foreground IO.
+ */
+
+// Set when the item expires, or clear it with the zero time
+func (this *OSStore) SetExpiry(id types.Id, expires time.Time) error {
+    return this.Index.SetExpiry(id, expires)
+}
+
+/* Remove up to limit items that expired at or before now.
+ * Items with open Files are skipped until a later sweep.
+ * Returns the number removed.
+ */
+func (this *OSStore) SweepExpired(now time.Time, limit int) (int, error) {
+    // pinned items stay expired, so look past as many as there are
+    this.mtx.Lock()
+    pinned := len(this.pins)
+    this.mtx.Unlock()
+    ids, err := this.Index.FindExpired(now, limit + pinned)
+    if err != nil { return 0, err }
+    removed := 0
+    for _, id := range ids {
+        if removed >= limit { break }
+        this.mtx.Lock()
+        if this.pins[id.String()] > 0 {
+            this.mtx.Unlock()
+            continue
+        }
+        existed, err := this.removeItem(id)
+        this.mtx.Unlock()
+        if err != nil { return removed, err }
+        if existed { removed++ }
+    }
+    return removed, nil
+}
+
+/* Remove the blob & item for id in a StoreTransaction, crediting its size
+ *  back to the usage.
+ * Returns whether either existed. Caller must hold this.mtx.
+ */
+func (this *OSStore) removeItem(id types.Id) (bool, error) {
+    _, err := this.Index.GetItem(id)
+    itemExisted := err == nil
+    if err != nil && err != ErrNotFound { return false, err }
+    _, err = this.findPath(id)
+    if err != nil && !os.IsNotExist(err) { return false, err }
+    if !itemExisted && err != nil { return false, nil }
+    tx, err := this.Begin()
+    if err != nil { return false, err }
+    err = tx.Remove(id)
+    if err != nil {
+        tx.Rollback()
+        return false, err
+    }
+    journal, err := tx.apply()
+    tx.finish()
+    if err != nil { return false, err }
+    return itemExisted || journal.Removes[0].Path != "", nil
+}
+
+/* Stores that can remove their expired items, such as an OSStore or a
+ *  whole OSStorehouser
+ */
+type ExpirySweepable interface {
+    SweepExpired(now time.Time, limit int) (int, error)
+}
+
+/* A Sweeper removes expired items every Interval, in batches of BatchSize,
+ *  pausing between batches.
+ */
+type Sweeper struct {
+    Target ExpirySweepable
+    Interval time.Duration
+    BatchSize int
+    Pause time.Duration
+}
+
+const (
+    DefaultSweepInterval = 10 * time.Minute
+    DefaultSweepBatchSize = 100
+    DefaultSweepPause = 100 * time.Millisecond
+)
+
+func NewSweeper(target ExpirySweepable) *Sweeper {
+    return &Sweeper{target, DefaultSweepInterval, DefaultSweepBatchSize, DefaultSweepPause}
+}
+
+// Sweep until ctx is cancelled
+func (this *Sweeper) Run(ctx context.Context) error {
+    ticker := time.NewTicker(this.Interval)
+    defer ticker.Stop()
+    for {
+        _, err := this.Sweep(ctx)
+        if err != nil && err != ctx.Err() {
+            log.Printf("Expiry sweep failed: %v", err)
+        }
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+}
+
+// One sweep, batch by batch, until nothing more has expired
+func (this *Sweeper) Sweep(ctx context.Context) (int, error) {
+    total := 0
+    for {
+        removed, err := this.Target.SweepExpired(time.Now(), this.BatchSize)
+        total += removed
+        if err != nil { return total, err }
+        if removed < this.BatchSize { return total, nil }
+        select {
+        case <-ctx.Done():
+            return total, ctx.Err()
+        case <-time.After(this.Pause):
+        }
+    }
+}
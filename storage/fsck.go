@@ -0,0 +1,210 @@
+package storage
+
+import (
+    "os"
+    "fmt"
+    "strconv"
+    "path/filepath"
+    "encoding/base64"
+    "github.com/jaekwon/go-prelude/fs"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Fsck checks that the items in the index & the files in DataDir agree.
+ * Nothing updates both atomically, so a crash between the two, or a file
+ *  copied in by hand, leaves them drifting apart.
+ */
+
+const (
+    ProblemUnindexed = "unindexed" // a file with no item in the index
+    ProblemMissing = "missing" // an item with no file
+    ProblemBadName = "bad-name" // a file whose name is not an id
+    ProblemMisplaced = "misplaced" // a file outside its shard
+    ProblemDuplicate = "duplicate" // a file outside its shard, when its shard has one too
+    ProblemSize = "size" // an item's recorded size differs from its file's
+    ProblemUsage = "usage" // recorded usage differs from the files' total size
+)
+
+type FsckProblem struct {
+    Kind string
+    Id types.Id // nil for bad-name & usage problems
+    Path string // the file, if any
+    Size int64 // of the file, or the actual usage for usage problems
+    Recorded int64 // the recorded size or usage, -1 if unknown
+    Repaired bool
+}
+
+func (this FsckProblem) String() string {
+    repaired := ""
+    if this.Repaired { repaired = " (repaired)" }
+    switch this.Kind {
+    case ProblemUsage, ProblemSize:
+        return fmt.Sprintf("%v: %v recorded %v bytes, found %v%v", this.Kind, this.Path, this.Recorded, this.Size, repaired)
+    case ProblemMissing:
+        return fmt.Sprintf("%v: %v%v", this.Kind, this.Id, repaired)
+    default:
+        return fmt.Sprintf("%v: %v (%v bytes)%v", this.Kind, this.Path, this.Size, repaired)
+    }
+}
+
+/* Which problems Fsck should repair. The zero value only reports.
+ * If both IndexUnindexed & RemoveUnindexed are set, files are indexed.
+ */
+type FsckOptions struct {
+    IndexUnindexed bool // add items for unindexed files, at the end of the mailbox
+    RemoveUnindexed bool // or delete unindexed files
+    DropMissing bool // delete items with no file
+    MoveMisplaced bool // move misplaced files into their shard
+    QuarantineBadNames bool // move bad-name files to RootDir/lost+found
+    QuarantineDuplicates bool // likewise for duplicates
+    FixUsage bool // record the actual usage & item sizes
+}
+
+var (
+    // rebuild the index from the files
+    FsckRebuild = FsckOptions{IndexUnindexed: true, DropMissing: true, MoveMisplaced: true, QuarantineBadNames: true, QuarantineDuplicates: true, FixUsage: true}
+    // make the files match the index
+    FsckPrune = FsckOptions{RemoveUnindexed: true, DropMissing: true, MoveMisplaced: true, QuarantineBadNames: true, QuarantineDuplicates: true, FixUsage: true}
+)
+
+type FsckReport struct {
+    Files int // valid files found, not counting duplicates
+    Items int // items in the index
+    Used int64 // total size of the valid files
+    Problems []FsckProblem
+}
+
+// the id a data file is named for, if its name is exactly an encoded id
+func idForName(name string) (types.Id, bool) {
+    id, err := types.StringToId(name)
+    if err != nil || len(id) != 32 { return nil, false }
+    // lenient decoding accepts names that don't round trip
+    if base64.URLEncoding.EncodeToString(id) != name { return nil, false }
+    return id, true
+}
+
+/* Check the store, repairing what options asks for.
+ * Blocks writes to the store while it runs.
+ */
+func (this *OSStore) Fsck(options FsckOptions) (*FsckReport, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    report := &FsckReport{}
+
+    metas, err := this.Index.QueryItems(ItemQuery{})
+    if err != nil { return nil, err }
+    items := map[string]bool{} // by id, whether a file was found
+    sizes := map[string]int64{} // recorded sizes by id
+    for _, meta := range metas {
+        items[meta.Id.String()] = false
+        sizes[meta.Id.String()] = meta.Size
+    }
+    report.Items = len(items)
+
+    // list the files first, as repairs move them around
+    paths, infos := []string{}, []os.FileInfo{}
+    err = this.walkData(func(path string, info os.FileInfo) error {
+        paths = append(paths, path)
+        infos = append(infos, info)
+        return nil
+    })
+    if err != nil { return nil, err }
+    for i, path := range paths {
+        this.fsckFile(path, infos[i], items, sizes, options, report)
+    }
+
+    for idString, found := range items {
+        if found { continue }
+        id, _ := types.StringToId(idString)
+        problem := FsckProblem{Kind: ProblemMissing, Id: id}
+        if options.DropMissing {
+            problem.Repaired, err = this.dropItem(id)
+            if err != nil { return nil, err }
+        }
+        report.Problems = append(report.Problems, problem)
+    }
+
+    used, _ := this.Size()
+    if used != report.Used {
+        problem := FsckProblem{Kind: ProblemUsage, Path: this.RootDir, Size: report.Used, Recorded: used}
+        if options.FixUsage {
+            problem.Repaired = this.Index.Set(MetaUsed, strconv.FormatInt(report.Used, 10)) == nil }
+        report.Problems = append(report.Problems, problem)
+    }
+    return report, nil
+}
+
+// check one file, marking its item as found. caller must hold this.mtx
+func (this *OSStore) fsckFile(path string, info os.FileInfo, items map[string]bool, sizes map[string]int64, options FsckOptions, report *FsckReport) {
+    id, ok := idForName(info.Name())
+    if !ok {
+        problem := FsckProblem{Kind: ProblemBadName, Path: path, Size: info.Size()}
+        if options.QuarantineBadNames {
+            problem.Repaired = this.quarantine(path) == nil }
+        report.Problems = append(report.Problems, problem)
+        return
+    }
+    expected, _ := this.PathForId(id)
+    flatPath, _ := this.flatPathForId(id)
+    if path != expected && (path != flatPath || this.Layout() == LayoutSharded) {
+        // the copy in the shard is the one counted
+        if _, err := os.Stat(expected); err == nil {
+            problem := FsckProblem{Kind: ProblemDuplicate, Id: id, Path: path, Size: info.Size()}
+            if options.QuarantineDuplicates {
+                problem.Repaired = this.quarantine(path) == nil }
+            report.Problems = append(report.Problems, problem)
+            return
+        }
+        problem := FsckProblem{Kind: ProblemMisplaced, Id: id, Path: path, Size: info.Size()}
+        if options.MoveMisplaced {
+            _, err := fs.EnsureDir(filepath.Dir(expected))
+            if err == nil { err = os.Rename(path, expected) }
+            problem.Repaired = err == nil
+        }
+        report.Problems = append(report.Problems, problem)
+        if problem.Repaired { path = expected }
+    }
+    if _, indexed := items[id.String()]; !indexed {
+        problem := FsckProblem{Kind: ProblemUnindexed, Id: id, Path: path, Size: info.Size()}
+        if options.IndexUnindexed {
+            _, err := this.Index.AddItemMeta(ItemMeta{Id: id, Size: info.Size(), Received: info.ModTime()})
+            problem.Repaired = err == nil
+        } else if options.RemoveUnindexed {
+            problem.Repaired = this.removeBlob(nil, path) == nil
+        }
+        report.Problems = append(report.Problems, problem)
+        if !options.IndexUnindexed && problem.Repaired { return }
+    } else if sizes[id.String()] != info.Size() {
+        problem := FsckProblem{Kind: ProblemSize, Id: id, Path: path, Size: info.Size(), Recorded: sizes[id.String()]}
+        if options.FixUsage {
+            problem.Repaired = this.Index.SetItemSize(id, info.Size()) == nil }
+        report.Problems = append(report.Problems, problem)
+    }
+    items[id.String()] = true
+    report.Files++
+    report.Used += info.Size()
+}
+
+func (this *OSStore) dropItem(id types.Id) (bool, error) {
+    tx, err := this.Index.Transaction()
+    if err != nil { return false, err }
+    existed, err := tx.DeleteItem(id)
+    if err != nil {
+        tx.Rollback()
+        return false, err
+    }
+    return existed, tx.Commit()
+}
+
+// move a file out of DataDir, where it can be inspected
+func (this *OSStore) quarantine(path string) error {
+    dir := filepath.Join(this.RootDir, "lost+found")
+    _, err := fs.EnsureDir(dir)
+    if err != nil { return err }
+    target := filepath.Join(dir, filepath.Base(path))
+    for i := 1; ; i++ {
+        if _, err := os.Lstat(target); os.IsNotExist(err) { break }
+        target = filepath.Join(dir, fmt.Sprintf("%v.%v", filepath.Base(path), i))
+    }
+    return os.Rename(path, target)
+}
@@ -2,194 +2,147 @@ package storage
 
 import (
     "os"
-	"database/sql"
+    "path/filepath"
 	"errors"
-	"fmt"
-    "strconv"
-    _ "github.com/mattn/go-sqlite3"
+    "sync"
+    "time"
+    "context"
     "github.com/jaekwon/gourami/types"
-    "github.com/jaekwon/go-prelude/colors"
 )
 
 var (
     ErrNotFound error = errors.New("Not found in index")
     ErrSchemaUnknown error = errors.New("Schema unknown")
+    ErrSchemaTooNew error = errors.New("Index schema is newer than this version supports")
+    ErrDuplicateItem error = errors.New("Item already in index")
+    ErrNoSQLite error = errors.New("SQLite indexes need a build with cgo")
 )
 
 const (
-    CurrentSchemaVersion = 1
+    CurrentSchemaVersion = 5 // the Version of the last of migrations
 
     MetaSchemaVersion string = "meta:schema_version"
     MetaOwner string = "meta:owner"
     MetaCapacity string = "meta:capacity"
+    MetaUsed string = "meta:used"
+    MetaSoftLimit string = "meta:soft_limit"
+    MetaLayout string = "meta:layout"
+    MetaContentAddressed string = "meta:content_addressed"
 )
 
-type Index struct {
-	DB *sql.DB
-}
-
-func (this *Index) SchemaVersion() (int, error) {
-    value, err := this.Get(MetaSchemaVersion)
-	if err != nil {
-        return -1, ErrSchemaUnknown
-	}
-	return strconv.Atoi(value)
-}
-
-// called by NewIndex
-func (this *Index) initialize() error {
-
-    // nothing to do if schema version is 1
-    schemaVersion, err := this.SchemaVersion()
-    if err == nil {
-        if schemaVersion == CurrentSchemaVersion {
-            return nil
-        } else {
-            // include upgrade path here.
-            return errors.New("Schema version unrecognized")
-        }
-    }
-    if err != nil && err != ErrSchemaUnknown {
-        return err
-    }
-
-    // create new index table...
-
-    fmt.Println(colors.Blue("Initializing Index"))
-    _, err = this.DB.Exec(
-    `CREATE TABLE kv (
-        k VARCHAR(255) NOT NULL PRIMARY KEY,
-        v VARCHAR(255)
-    )`)
-    if err != nil { return err }
-    _, err = this.DB.Exec(
-    `CREATE TABLE items (
-        counter INTEGER PRIMARY KEY AUTOINCREMENT,
-        id VARCHAR(44) NOT NULL
-    )`)
-    if err != nil { return err }
-
-    // set schema version
-    err = this.Set(MetaSchemaVersion, strconv.Itoa(CurrentSchemaVersion))
-
-    return err
-}
-
-func (this *Index) Transaction() (*Transaction, error) {
-	tx, err := this.DB.Begin()
-	return &Transaction{tx}, err
-}
-
-func (this *Index) Get(key string) (value string, err error) {
-	err = this.DB.QueryRow("SELECT v FROM kv WHERE k=?", key).Scan(&value)
-	if err == sql.ErrNoRows {
-		err = ErrNotFound
-	}
-	return
-}
-
-func (this *Index) Set(key, value string) error {
-	_, err := this.DB.Exec("REPLACE INTO kv (k, v) VALUES (?, ?)", key, value)
-	return err
-}
-
-func (this *Index) Delete(key string) error {
-	_, err := this.DB.Exec("DELETE FROM kv WHERE k=?", key)
-	return err
-}
-
-func (this *Index) Find(key string, limit int, ch chan KeyValueErr) {
-    defer close(ch)
-    rows, err := this.DB.Query("SELECT k, v FROM kv WHERE k >= ? ORDER BY k LIMIT ?", key, limit)
-    if err != nil {
-        ch <- KeyValueErr{"", "", err}
-        return
-    }
-    for rows.Next() {
-        var kvErr KeyValueErr
-        kvErr.Err = rows.Scan(&kvErr.Key, &kvErr.Value)
-        ch <- kvErr
-    }
-    return
-}
-
-func (this *Index) Close() error {
-    return this.DB.Close()
-}
-
-type KeyValueErr struct {
-    Key string
-    Value string
-    Err error
-}
-
-func (this *Index) AddItem(id types.Id) (lastInsertId int64, err error) {
-    idString, err := id.ToString()
-    if err != nil { return -1, err }
-    result, err := this.DB.Exec("INSERT INTO items (id) VALUES (?)", idString)
-    if err != nil { return -1, err }
-    return result.LastInsertId()
-}
+/* An Index keeps a store's meta as key/values, & its items in the order
+ *  they were added. SQLIndex keeps them in SQLite, which needs cgo;
+ *  LogIndex is pure Go. MemIndex keeps them in memory only.
+ */
+type Index interface {
+    SchemaVersion() (int, error)
+    Transaction() (Transaction, error)
+    Close() error
+
+    Get(key string) (string, error) // ErrNotFound if missing
+    Set(key, value string) error
+    SetDefault(key, value string) error // only if key has no value yet
+    Delete(key string) error
+    Find(ctx context.Context, key string, limit int) *KeyIterator // keys >= key in order, negative limit for all
+
+    AddItem(id types.Id) (int64, error)
+    AddItemMeta(meta ItemMeta) (int64, error)
+    HasItem(id types.Id) (bool, error)
+    GetItem(id types.Id) (*ItemMeta, error)
+    SetItemSize(id types.Id, size int64) error
+    QueryItems(query ItemQuery) ([]ItemMeta, error)
+    FindItems(ctx context.Context, since int64, limit int) *ItemIterator // counters >= since in order
+    SetExpiry(id types.Id, expires time.Time) error
+    FindExpired(now time.Time, limit int) ([]types.Id, error)
+    Watch(ch chan struct{})
+    Unwatch(ch chan struct{})
+
+    // see BlobPool
+    AddBlobRef(hash types.Id, size int64) error
+    ReleaseBlobRef(hash types.Id) (int64, error)
+    BlobRefs(hash types.Id) (int64, error)
+    BlobUsage() (int64, int64, error)
+}
+
+/* A Transaction applies its changes all at once on Commit, or not at all.
+ */
+type Transaction interface {
+    Get(key string) (string, error)
+    Set(key, value string) error
+    Delete(key string) error
+    AddItem(id types.Id) error
+    AddItemMeta(meta ItemMeta) error
+    DeleteItem(id types.Id) (bool, error) // whether there was such an item
+    Commit() error
+    Rollback() error
+}
+
+// Index backends
+const (
+    IndexSQLite string = "sqlite"
+    IndexLog string = "log"
+)
 
-func (this *Index) FindItems(start int64, limit int, ch chan IdErr) {
-    defer close(ch)
-    rows, err := this.DB.Query("SELECT item FROM items WHERE id >= ? ORDER BY k LIMIT ?", start, limit)
-    if err != nil {
-        ch <- IdErr{nil, err}
-        return
-    }
-    for rows.Next() {
-        var idErr IdErr
-        var idString string
-        err = rows.Scan(&idString)
-        if err != nil {
-            ch <- IdErr{nil, err}
-        }
-        idErr.Id, idErr.Err = types.StringToId(idString)
-        ch <- idErr
+// the backend of new indexes: SQLite, unless built without cgo
+var DefaultIndexBackend string = defaultIndexBackend
+
+/* Open the index called name in dir, e.g. dir/index.sqlite for "index",
+ *  with whichever backend made it.
+ * If there is none, one is made with DefaultIndexBackend if create is set.
+ */
+func OpenIndexIn(dir string, name string, create bool) (Index, error) {
+    sqliteFile := filepath.Join(dir, name + ".sqlite")
+    logFile := filepath.Join(dir, name + ".log")
+    _, sqliteErr := os.Stat(sqliteFile)
+    _, logErr := os.Stat(logFile)
+    switch {
+    case sqliteErr == nil:
+        return openSQLiteIndex(sqliteFile, false)
+    case logErr == nil || !create:
+        return openLogIndexFile(logFile, false)
+    case DefaultIndexBackend == IndexLog:
+        return openLogIndexFile(logFile, true)
+    default:
+        return openSQLiteIndex(sqliteFile, true)
     }
-    return
 }
 
-type IdErr struct {
-    Id types.Id
-    Err error
-}
-
-func NewIndex(file string) (*Index, error) {
-    _, err := os.Create(file)
-    if err != nil { return nil, err }
-	db, err := sql.Open("sqlite3", file)
-    if err != nil { return nil, err }
-    index := &Index{db}
-    err = index.initialize()
+// avoids a non-nil Index holding a nil pointer
+func openLogIndexFile(file string, create bool) (Index, error) {
+    index, err := openLogIndex(file, create)
     if err != nil { return nil, err }
     return index, nil
 }
 
-
-
-type Transaction struct {
-	tx  *sql.Tx
-}
-
-func (this *Transaction) Set(key, value string) error {
-	_, err := this.tx.Exec("REPLACE INTO kv (k, v) VALUES (?, ?)", key, value)
-    return err
+/* itemWatchers are signalled whenever items are added, once the change is committed.
+ * Signals are dropped while a watcher's channel is full, so a buffer of 1 suffices:
+ *  watchers should look up new items with FindItems after each signal.
+ */
+type itemWatchers struct {
+    watchMtx sync.Mutex
+    watchers map[chan struct{}]bool
 }
 
-func (this *Transaction) Delete(key string) error {
-	_, err := this.tx.Exec("DELETE FROM kv WHERE k=?", key)
-    return err
+func (this *itemWatchers) Watch(ch chan struct{}) {
+    this.watchMtx.Lock()
+    defer this.watchMtx.Unlock()
+    if this.watchers == nil { this.watchers = make(map[chan struct{}]bool) }
+    this.watchers[ch] = true
 }
 
-func (this *Transaction) AddItem(id types.Id) error {
-    idString, err := id.ToString()
-    if err != nil { return err }
-    _, err = this.tx.Exec("INSERT INTO items (id) VALUES (?)", idString)
-    return err
+func (this *itemWatchers) Unwatch(ch chan struct{}) {
+    this.watchMtx.Lock()
+    defer this.watchMtx.Unlock()
+    delete(this.watchers, ch)
 }
 
-func (this *Transaction) Commit() error {
-	return this.tx.Commit()
+func (this *itemWatchers) notifyWatchers() {
+    this.watchMtx.Lock()
+    defer this.watchMtx.Unlock()
+    for ch := range this.watchers {
+        select {
+        case ch <- struct{}{}:
+        default:
+        }
+    }
 }
@@ -0,0 +1,261 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+    "os"
+	"database/sql"
+    "strconv"
+    "time"
+    "context"
+    "github.com/mattn/go-sqlite3"
+    "github.com/jaekwon/gourami/types"
+)
+
+const defaultIndexBackend = IndexSQLite
+
+// whether err is SQLite refusing a row that breaks a unique index
+func isUniqueViolation(err error) bool {
+    sqliteErr, ok := err.(sqlite3.Error)
+    return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// avoids a non-nil Index holding a nil pointer
+func openSQLiteIndex(file string, create bool) (Index, error) {
+    var index *SQLIndex
+    var err error
+    if create {
+        index, err = NewSQLIndex(file)
+    } else {
+        index, err = OpenSQLIndex(file)
+    }
+    if err != nil { return nil, err }
+    return index, nil
+}
+
+/* The SQLite Index
+ */
+type SQLIndex struct {
+	DB *sql.DB
+
+    itemWatchers
+}
+
+func (this *SQLIndex) SchemaVersion() (int, error) {
+    value, err := this.Get(MetaSchemaVersion)
+	if err != nil {
+        return -1, ErrSchemaUnknown
+	}
+	return strconv.Atoi(value)
+}
+
+// called by NewSQLIndex & OpenSQLIndex
+func (this *SQLIndex) initialize() error {
+    _, err := this.Migrate(false)
+    return err
+}
+
+func (this *SQLIndex) Transaction() (Transaction, error) {
+    return this.begin()
+}
+
+func (this *SQLIndex) begin() (*SQLTransaction, error) {
+	tx, err := this.DB.Begin()
+	return &SQLTransaction{tx: tx, index: this}, err
+}
+
+func (this *SQLIndex) Get(key string) (value string, err error) {
+	err = this.DB.QueryRow("SELECT v FROM kv WHERE k=?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (this *SQLIndex) Set(key, value string) error {
+	_, err := this.DB.Exec("REPLACE INTO kv (k, v) VALUES (?, ?)", key, value)
+	return err
+}
+
+// Set key only if it has no value yet
+func (this *SQLIndex) SetDefault(key, value string) error {
+	_, err := this.DB.Exec("INSERT OR IGNORE INTO kv (k, v) VALUES (?, ?)", key, value)
+	return err
+}
+
+func (this *SQLIndex) Delete(key string) error {
+	_, err := this.DB.Exec("DELETE FROM kv WHERE k=?", key)
+	return err
+}
+
+func (this *SQLIndex) Find(ctx context.Context, key string, limit int) *KeyIterator {
+    return newKeyIterator(ctx, key, limit, this.findPage)
+}
+
+// the rows are read in full & closed before returning
+func (this *SQLIndex) findPage(from string, limit int) ([]KeyValue, error) {
+    rows, err := this.DB.Query("SELECT k, v FROM kv WHERE k >= ? ORDER BY k LIMIT ?", from, limit)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    found := []KeyValue{}
+    for rows.Next() {
+        var kv KeyValue
+        err = rows.Scan(&kv.Key, &kv.Value)
+        if err != nil { return nil, err }
+        found = append(found, kv)
+    }
+    return found, rows.Err()
+}
+
+func (this *SQLIndex) Close() error {
+    return this.DB.Close()
+}
+
+func (this *SQLIndex) AddItem(id types.Id) (lastInsertId int64, err error) {
+    idString, err := id.ToString()
+    if err != nil { return -1, err }
+    result, err := this.DB.Exec("INSERT INTO items (id) VALUES (?)", idString)
+    if err != nil { return -1, itemInsertError(err) }
+    this.notifyWatchers()
+    return result.LastInsertId()
+}
+
+func (this *SQLIndex) HasItem(id types.Id) (bool, error) {
+    idString, err := id.ToString()
+    if err != nil { return false, err }
+    var counter int64
+    err = this.DB.QueryRow("SELECT counter FROM items WHERE id=? LIMIT 1", idString).Scan(&counter)
+    if err == sql.ErrNoRows { return false, nil }
+    return err == nil, err
+}
+
+// Find items with counter >= since, in the order they were added
+func (this *SQLIndex) FindItems(ctx context.Context, since int64, limit int) *ItemIterator {
+    return newItemIterator(ctx, since, limit, this.QueryItems)
+}
+
+/* Set when the item expires, or clear it with the zero time.
+ * Stored with a precision of seconds.
+ */
+func (this *SQLIndex) SetExpiry(id types.Id, expires time.Time) error {
+    idString, err := id.ToString()
+    if err != nil { return err }
+    var expiresUnix interface{}
+    if !expires.IsZero() { expiresUnix = expires.Unix() }
+    result, err := this.DB.Exec("UPDATE items SET expires=? WHERE id=?", expiresUnix, idString)
+    if err != nil { return err }
+    affected, err := result.RowsAffected()
+    if err != nil { return err }
+    if affected == 0 { return ErrNotFound }
+    return nil
+}
+
+// Find up to limit items that expire at or before now, soonest first
+func (this *SQLIndex) FindExpired(now time.Time, limit int) ([]types.Id, error) {
+    rows, err := this.DB.Query("SELECT id FROM items WHERE expires IS NOT NULL AND expires <= ? ORDER BY expires LIMIT ?", now.Unix(), limit)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    ids := []types.Id{}
+    for rows.Next() {
+        var idString string
+        err = rows.Scan(&idString)
+        if err != nil { return nil, err }
+        id, err := types.StringToId(idString)
+        if err != nil { return nil, err }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+// Open the SQLite index file, creating it if needed
+func NewSQLIndex(file string) (*SQLIndex, error) {
+    return openIndex(file)
+}
+
+// Open an existing SQLite index file, keeping its contents
+func OpenSQLIndex(file string) (*SQLIndex, error) {
+    _, err := os.Stat(file)
+    if err != nil { return nil, err }
+    return openIndex(file)
+}
+
+func openIndex(file string) (*SQLIndex, error) {
+	db, err := sql.Open("sqlite3", file)
+    if err != nil { return nil, err }
+    index := &SQLIndex{DB: db}
+    err = index.initialize()
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return index, nil
+}
+
+
+
+type SQLTransaction struct {
+	tx  *sql.Tx
+    index *SQLIndex
+    addedItems bool
+}
+
+func (this *SQLTransaction) Get(key string) (value string, err error) {
+	err = this.tx.QueryRow("SELECT v FROM kv WHERE k=?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (this *SQLTransaction) Set(key, value string) error {
+	_, err := this.tx.Exec("REPLACE INTO kv (k, v) VALUES (?, ?)", key, value)
+    return err
+}
+
+func (this *SQLTransaction) Delete(key string) error {
+	_, err := this.tx.Exec("DELETE FROM kv WHERE k=?", key)
+    return err
+}
+
+func (this *SQLTransaction) AddItem(id types.Id) error {
+    idString, err := id.ToString()
+    if err != nil { return err }
+    _, err = this.tx.Exec("INSERT INTO items (id) VALUES (?)", idString)
+    if err != nil { return itemInsertError(err) }
+    this.addedItems = true
+    return nil
+}
+
+// ErrDuplicateItem for an id the items table already has
+func itemInsertError(err error) error {
+    if isUniqueViolation(err) { return ErrDuplicateItem }
+    return err
+}
+
+// for statements beyond kv & items, e.g. in migrations
+func (this *SQLTransaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+    return this.tx.Exec(query, args...)
+}
+
+// Remove the item for id, returning whether there was one
+func (this *SQLTransaction) DeleteItem(id types.Id) (bool, error) {
+    idString, err := id.ToString()
+    if err != nil { return false, err }
+    result, err := this.tx.Exec("DELETE FROM items WHERE id=?", idString)
+    if err != nil { return false, err }
+    affected, err := result.RowsAffected()
+    return affected > 0, err
+}
+
+func (this *SQLTransaction) Commit() error {
+	err := this.tx.Commit()
+    if err == nil && this.addedItems {
+        this.index.notifyWatchers()
+    }
+    return err
+}
+
+func (this *SQLTransaction) Rollback() error {
+    return this.tx.Rollback()
+}
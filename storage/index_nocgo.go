@@ -0,0 +1,11 @@
+//go:build !cgo
+// +build !cgo
+
+package storage
+
+// SQLite needs cgo; indexes are kept in logs instead
+const defaultIndexBackend = IndexLog
+
+func openSQLiteIndex(file string, create bool) (Index, error) {
+    return nil, ErrNoSQLite
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+    "time"
+    "errors"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Besides its id & counter, the index records what a client needs to show
+ *  an inbox without downloading bodies.
+ * Items added before schema version 3 have none of this.
+ */
+type ItemMeta struct {
+    Counter int64
+    Id types.Id
+    Size int64 // -1 if unknown
+    Received time.Time // zero if unknown
+    Sender string // the sender's key as claimed by the depositor, "" if unknown
+    Hash types.Id // ContentId of the blob, nil if unknown
+    Expires time.Time // zero for never
+}
+
+// when an item being stored was received, now unless already known
+func (this ItemMeta) receivedOrNow() time.Time {
+    if this.Received.IsZero() { return time.Now() }
+    return this.Received
+}
+
+const (
+    SortCounter string = "counter"
+    SortReceived string = "received"
+    SortSize string = "size"
+    SortSender string = "sender"
+    SortExpires string = "expires"
+)
+
+var ErrUnknownSort error = errors.New("Unknown sort")
+
+var sortColumns = map[string]bool{SortCounter: true, SortReceived: true, SortSize: true, SortSender: true, SortExpires: true}
+
+/* An ItemQuery selects items by their meta. The zero value selects all items
+ *  in counter order. Items whose meta is unknown never match a filter on it.
+ */
+type ItemQuery struct {
+    Since int64 // counter >= Since
+    Sender string
+    MinSize int64
+    MaxSize int64 // 0 for no maximum
+    ReceivedAfter time.Time // inclusive
+    ReceivedBefore time.Time // exclusive
+    SortBy string // one of the Sort constants, SortCounter by default
+    Descending bool
+    Limit int // 0 for no limit
+}
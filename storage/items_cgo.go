@@ -0,0 +1,137 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+    "time"
+    "strings"
+    "database/sql"
+    "github.com/jaekwon/gourami/types"
+)
+
+// as the items table stores them
+type itemRow struct {
+    size, received, expires interface{}
+    sender, hash interface{}
+}
+
+func newItemRow(meta ItemMeta) itemRow {
+    row := itemRow{}
+    if meta.Size >= 0 { row.size = meta.Size }
+    if !meta.Received.IsZero() { row.received = meta.Received.Unix() }
+    if !meta.Expires.IsZero() { row.expires = meta.Expires.Unix() }
+    if meta.Sender != "" { row.sender = meta.Sender }
+    if meta.Hash != nil { row.hash = meta.Hash.String() }
+    return row
+}
+
+const itemInsert = "INSERT INTO items (id, size, received, expires, sender, hash) VALUES (?, ?, ?, ?, ?, ?)"
+
+const itemColumns = "counter, id, size, received, expires, sender, hash"
+
+func scanItem(scan func(dest ...interface{}) error) (ItemMeta, error) {
+    var meta ItemMeta
+    var idString string
+    var size, received, expires sql.NullInt64
+    var sender, hash sql.NullString
+    err := scan(&meta.Counter, &idString, &size, &received, &expires, &sender, &hash)
+    if err != nil { return meta, err }
+    meta.Id, err = types.StringToId(idString)
+    if err != nil { return meta, err }
+    meta.Size = -1
+    if size.Valid { meta.Size = size.Int64 }
+    if received.Valid { meta.Received = time.Unix(received.Int64, 0) }
+    if expires.Valid { meta.Expires = time.Unix(expires.Int64, 0) }
+    meta.Sender = sender.String
+    if hash.Valid {
+        meta.Hash, err = types.StringToId(hash.String) }
+    return meta, err
+}
+
+// Add an item with its meta, returning its counter. meta.Counter is ignored.
+func (this *SQLIndex) AddItemMeta(meta ItemMeta) (int64, error) {
+    idString, err := meta.Id.ToString()
+    if err != nil { return -1, err }
+    row := newItemRow(meta)
+    result, err := this.DB.Exec(itemInsert, idString, row.size, row.received, row.expires, row.sender, row.hash)
+    if err != nil { return -1, itemInsertError(err) }
+    this.notifyWatchers()
+    return result.LastInsertId()
+}
+
+func (this *SQLTransaction) AddItemMeta(meta ItemMeta) error {
+    idString, err := meta.Id.ToString()
+    if err != nil { return err }
+    row := newItemRow(meta)
+    _, err = this.tx.Exec(itemInsert, idString, row.size, row.received, row.expires, row.sender, row.hash)
+    if err != nil { return itemInsertError(err) }
+    this.addedItems = true
+    return nil
+}
+
+func (this *SQLIndex) GetItem(id types.Id) (*ItemMeta, error) {
+    idString, err := id.ToString()
+    if err != nil { return nil, err }
+    meta, err := scanItem(this.DB.QueryRow("SELECT " + itemColumns + " FROM items WHERE id=? LIMIT 1", idString).Scan)
+    if err == sql.ErrNoRows { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    return &meta, nil
+}
+
+// Record the size of an item, e.g. one added before sizes were kept
+func (this *SQLIndex) SetItemSize(id types.Id, size int64) error {
+    idString, err := id.ToString()
+    if err != nil { return err }
+    result, err := this.DB.Exec("UPDATE items SET size=? WHERE id=?", size, idString)
+    if err != nil { return err }
+    affected, err := result.RowsAffected()
+    if err != nil { return err }
+    if affected == 0 { return ErrNotFound }
+    return nil
+}
+
+func (this *SQLIndex) QueryItems(query ItemQuery) ([]ItemMeta, error) {
+    sortBy := query.SortBy
+    if sortBy == "" { sortBy = SortCounter }
+    if !sortColumns[sortBy] { return nil, ErrUnknownSort }
+    where := []string{"counter >= ?"}
+    args := []interface{}{query.Since}
+    if query.Sender != "" {
+        where = append(where, "sender = ?")
+        args = append(args, query.Sender)
+    }
+    if query.MinSize > 0 {
+        where = append(where, "size >= ?")
+        args = append(args, query.MinSize)
+    }
+    if query.MaxSize > 0 {
+        where = append(where, "size <= ?")
+        args = append(args, query.MaxSize)
+    }
+    if !query.ReceivedAfter.IsZero() {
+        where = append(where, "received >= ?")
+        args = append(args, query.ReceivedAfter.Unix())
+    }
+    if !query.ReceivedBefore.IsZero() {
+        where = append(where, "received < ?")
+        args = append(args, query.ReceivedBefore.Unix())
+    }
+    order := sortBy
+    if query.Descending { order += " DESC" }
+    if sortBy != SortCounter { order += ", counter" }
+    limit := query.Limit
+    if limit <= 0 { limit = -1 }
+    args = append(args, limit)
+    rows, err := this.DB.Query("SELECT " + itemColumns + " FROM items WHERE " + strings.Join(where, " AND ") +
+        " ORDER BY " + order + " LIMIT ?", args...)
+    if err != nil { return nil, err }
+    defer rows.Close()
+    items := []ItemMeta{}
+    for rows.Next() {
+        meta, err := scanItem(rows.Scan)
+        if err != nil { return nil, err }
+        items = append(items, meta)
+    }
+    return items, rows.Err()
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+    "path"
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Iterators
+ * Scans are pulled, a page at a time: when Next runs out of results it
+ *  fetches the next page, closing whatever the fetch opened, so nothing is
+ *  held open between calls & an iterator abandoned part way leaks nothing.
+ * Next returns false once the scan is done, its limit is reached, ctx is
+ *  cancelled or it fails; Err tells which. Close ends a scan early.
+ * Cursor is where the scan has reached: a scan started from it continues
+ *  after the last result, e.g. for the next page of a listing.
+ */
+
+// how many rows an iterator fetches at once
+const iteratorPageSize = 100
+
+type KeyValue struct {
+    Key string
+    Value string
+}
+
+// iterates key/values in key order
+type KeyIterator struct {
+    ctx context.Context
+    fetch func(from string, limit int) ([]KeyValue, error)
+    from string // the next key to fetch from
+    limit int // results left, or negative for no limit
+    page []KeyValue
+    last bool // whether page is the last one
+    current KeyValue
+    err error
+    done bool
+}
+
+// fetch returns up to limit key/values from key from on, in key order
+func newKeyIterator(ctx context.Context, from string, limit int, fetch func(from string, limit int) ([]KeyValue, error)) *KeyIterator {
+    return &KeyIterator{ctx: ctx, fetch: fetch, from: from, limit: limit}
+}
+
+func (this *KeyIterator) Next() bool {
+    if this.done { return false }
+    if this.limit == 0 { return this.stop(nil) }
+    if err := this.ctx.Err(); err != nil { return this.stop(err) }
+    if len(this.page) == 0 {
+        if this.last { return this.stop(nil) }
+        size := pageSize(this.limit)
+        page, err := this.fetch(this.from, size)
+        if err != nil { return this.stop(err) }
+        this.page, this.last = page, len(page) < size
+        if len(page) == 0 { return this.stop(nil) }
+    }
+    this.current, this.page = this.page[0], this.page[1:]
+    // the least key after current
+    this.from = this.current.Key + "\x00"
+    if this.limit > 0 { this.limit-- }
+    return true
+}
+
+func (this *KeyIterator) stop(err error) bool {
+    this.err, this.done, this.page = err, true, nil
+    return false
+}
+
+func (this *KeyIterator) KeyValue() KeyValue {
+    return this.current
+}
+
+func (this *KeyIterator) Key() string {
+    return this.current.Key
+}
+
+func (this *KeyIterator) Value() string {
+    return this.current.Value
+}
+
+func (this *KeyIterator) Err() error {
+    return this.err
+}
+
+// the key to Find from to continue after the last result
+func (this *KeyIterator) Cursor() string {
+    return this.from
+}
+
+func (this *KeyIterator) Close() error {
+    this.stop(this.err)
+    return nil
+}
+
+// iterates items in the order they were added
+type ItemIterator struct {
+    ctx context.Context
+    query func(query ItemQuery) ([]ItemMeta, error)
+    since int64 // the next counter to fetch from
+    limit int
+    page []ItemMeta
+    last bool
+    current ItemMeta
+    err error
+    done bool
+}
+
+// pages through the items query returns, in counter order
+func newItemIterator(ctx context.Context, since int64, limit int, query func(query ItemQuery) ([]ItemMeta, error)) *ItemIterator {
+    return &ItemIterator{ctx: ctx, query: query, since: since, limit: limit}
+}
+
+func (this *ItemIterator) Next() bool {
+    if this.done { return false }
+    if this.limit == 0 { return this.stop(nil) }
+    if err := this.ctx.Err(); err != nil { return this.stop(err) }
+    if len(this.page) == 0 {
+        if this.last { return this.stop(nil) }
+        size := pageSize(this.limit)
+        page, err := this.query(ItemQuery{Since: this.since, Limit: size})
+        if err != nil { return this.stop(err) }
+        this.page, this.last = page, len(page) < size
+        if len(page) == 0 { return this.stop(nil) }
+    }
+    this.current, this.page = this.page[0], this.page[1:]
+    this.since = this.current.Counter + 1
+    if this.limit > 0 { this.limit-- }
+    return true
+}
+
+func (this *ItemIterator) stop(err error) bool {
+    this.err, this.done, this.page = err, true, nil
+    return false
+}
+
+func (this *ItemIterator) Item() ItemMeta {
+    return this.current
+}
+
+func (this *ItemIterator) Err() error {
+    return this.err
+}
+
+// the counter to FindItems from to continue after the last result
+func (this *ItemIterator) Cursor() int64 {
+    return this.since
+}
+
+func (this *ItemIterator) Close() error {
+    this.stop(this.err)
+    return nil
+}
+
+func pageSize(limit int) int {
+    if limit > 0 && limit < iteratorPageSize { return limit }
+    return iteratorPageSize
+}
+
+/* iterates the blobs in a store's data dir, in the order of their paths,
+ *  listing one directory at a time.
+ * Files whose names are not ids are skipped; see Fsck.
+ */
+type BlobIterator struct {
+    ctx context.Context
+    root string
+    after []string // the cursor's path, split
+    dirs []*blobDir // being listed, outermost first
+    current types.Id
+    cursor string
+    err error
+    done bool
+}
+
+type blobDir struct {
+    path string // relative to root, with slashes
+    infos []os.FileInfo // entries left, in name order
+}
+
+func newBlobIterator(ctx context.Context, root string, after string) *BlobIterator {
+    iterator := &BlobIterator{ctx: ctx, root: root, cursor: after}
+    if after != "" { iterator.after = strings.Split(after, "/") }
+    iterator.push("")
+    return iterator
+}
+
+// list the directory at path, skipping entries up to the cursor
+func (this *BlobIterator) push(dirPath string) bool {
+    infos, err := ioutil.ReadDir(filepath.Join(this.root, filepath.FromSlash(dirPath)))
+    if os.IsNotExist(err) { return true } // removed since it was listed
+    if err != nil { return this.stop(err) }
+    depth := 0
+    if dirPath != "" { depth = len(strings.Split(dirPath, "/")) }
+    if depth < len(this.after) && dirPath == path.Join(this.after[:depth]...) {
+        name := this.after[depth]
+        for len(infos) > 0 && (infos[0].Name() < name ||
+            infos[0].Name() == name && depth == len(this.after)-1) {
+            infos = infos[1:]
+        }
+    }
+    this.dirs = append(this.dirs, &blobDir{dirPath, infos})
+    return true
+}
+
+func (this *BlobIterator) Next() bool {
+    for !this.done {
+        if err := this.ctx.Err(); err != nil { return this.stop(err) }
+        if len(this.dirs) == 0 { return this.stop(nil) }
+        dir := this.dirs[len(this.dirs)-1]
+        if len(dir.infos) == 0 {
+            this.dirs = this.dirs[:len(this.dirs)-1]
+            continue
+        }
+        info := dir.infos[0]
+        dir.infos = dir.infos[1:]
+        filePath := path.Join(dir.path, info.Name())
+        if info.IsDir() {
+            this.push(filePath)
+            continue
+        }
+        if !info.Mode().IsRegular() { continue }
+        id, ok := idForName(info.Name())
+        if !ok { continue }
+        this.current, this.cursor = id, filePath
+        return true
+    }
+    return false
+}
+
+func (this *BlobIterator) stop(err error) bool {
+    this.err, this.done, this.dirs = err, true, nil
+    return false
+}
+
+func (this *BlobIterator) Id() types.Id {
+    return this.current
+}
+
+func (this *BlobIterator) Err() error {
+    return this.err
+}
+
+// the path of the last blob, relative to the data dir, to Iterate after
+func (this *BlobIterator) Cursor() string {
+    return this.cursor
+}
+
+func (this *BlobIterator) Close() error {
+    this.stop(this.err)
+    return nil
+}
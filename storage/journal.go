@@ -0,0 +1,384 @@
+package storage
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "log"
+    "bytes"
+    "errors"
+    "strings"
+    "context"
+    "io/ioutil"
+    "encoding/json"
+    "path/filepath"
+    "github.com/jaekwon/go-prelude/fs"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Store transactions
+ * A StoreTransaction stores & removes items, & sets meta, all at once on
+ *  Commit, or not at all. Blobs are staged in a directory of their own in
+ *  JournalDir. Commit writes a journal of the changes there, then moves the
+ *  blobs into place, applies the changes to the index in one index
+ *  Transaction & removes the blobs of removed items, before dropping the
+ *  transaction's directory.
+ * The journal is the commit point: after a crash, Recover rolls transactions
+ *  with a journal forward, & drops those without. Each step is safe to
+ *  repeat; the index records which transactions it has applied under
+ *  MetaJournalPrefix, until their directory is gone.
+ */
+
+const MetaJournalPrefix string = "meta:journal:"
+
+const journalName = "journal"
+
+type StoreTransaction struct {
+    store *OSStore
+    dir string
+    puts []journalPut
+    removes []types.Id
+    meta []journalMeta
+    reserved int64 // capacity held for the staged blobs
+    done bool
+}
+
+// what a committed transaction does, as written to its journal
+type storeJournal struct {
+    Puts []journalPut
+    Removes []journalRemove
+    Meta []journalMeta
+}
+
+type journalPut struct {
+    Item ItemMeta
+    Staged string // the blob's file in the transaction's dir
+    Path string // where it goes, relative to RootDir
+    PoolPath string // the pool's copy, if the store was pooled
+}
+
+type journalRemove struct {
+    Id types.Id
+    Hash types.Id
+    Size int64
+    Path string // relative to RootDir, "" if there was no blob
+}
+
+type journalMeta struct {
+    Key string
+    Value string
+    Delete bool
+}
+
+func (this *OSStore) Begin() (*StoreTransaction, error) {
+    _, err := fs.EnsureDir(this.JournalDir)
+    if err != nil { return nil, err }
+    dir, err := ioutil.TempDir(this.JournalDir, "tx-")
+    if err != nil { return nil, err }
+    return &StoreTransaction{store: this, dir: dir}, nil
+}
+
+/* Stage meta.Size bytes read from reader, to be stored as StoreItem would.
+ * Returns the id the item will have.
+ */
+func (this *StoreTransaction) StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    if this.done { return nil, ErrTransactionDone }
+    id, size := meta.Id, meta.Size
+    if id != nil {
+        if _, err := id.ToString(); err != nil { return nil, err }
+        if this.has(id) { return nil, errors.New(fmt.Sprintf("Transaction already has %v", id)) }
+    }
+    if size < 0 {
+        return nil, errors.New(fmt.Sprintf("Invalid size %v", size))
+    }
+    err := this.store.reserve(id, size)
+    if err != nil { return nil, err }
+    this.reserved += size
+    stagedPath, contentId, err := writeTemp(this.dir, reader, size)
+    if err != nil { return nil, err }
+    if meta.Hash != nil && !bytes.Equal(meta.Hash, contentId) {
+        os.Remove(stagedPath)
+        return nil, ErrHashMismatch
+    }
+    if id == nil {
+        id = contentId
+        if this.has(id) {
+            os.Remove(stagedPath)
+            return nil, errors.New(fmt.Sprintf("Transaction already has %v", id))
+        }
+    } else if !bytes.Equal(id, contentId) && this.store.ContentAddressed() {
+        os.Remove(stagedPath)
+        return nil, ErrIdMismatch
+    }
+    item := ItemMeta{Id: id, Size: size, Received: meta.receivedOrNow(), Sender: meta.Sender, Hash: contentId, Expires: meta.Expires}
+    this.puts = append(this.puts, journalPut{Item: item, Staged: filepath.Base(stagedPath)})
+    return id, nil
+}
+
+// Stage the removal of the blob & item for id, as Remove would
+func (this *StoreTransaction) Remove(id types.Id) error {
+    if this.done { return ErrTransactionDone }
+    if _, err := id.ToString(); err != nil { return err }
+    if this.has(id) { return errors.New(fmt.Sprintf("Transaction already has %v", id)) }
+    this.removes = append(this.removes, id)
+    return nil
+}
+
+func (this *StoreTransaction) Set(key, value string) error {
+    if this.done { return ErrTransactionDone }
+    this.meta = append(this.meta, journalMeta{Key: key, Value: value})
+    return nil
+}
+
+func (this *StoreTransaction) Delete(key string) error {
+    if this.done { return ErrTransactionDone }
+    this.meta = append(this.meta, journalMeta{Key: key, Delete: true})
+    return nil
+}
+
+// whether id is already stored or removed by this transaction
+func (this *StoreTransaction) has(id types.Id) bool {
+    for _, put := range this.puts {
+        if bytes.Equal(put.Item.Id, id) { return true }
+    }
+    for _, removed := range this.removes {
+        if bytes.Equal(removed, id) { return true }
+    }
+    return false
+}
+
+/* Apply the staged changes.
+ * An error before the journal is written rolls the transaction back. Once
+ *  it is written the transaction stands: should a later step fail, the
+ *  changes are completed by Recover when the store is next opened.
+ */
+func (this *StoreTransaction) Commit() error {
+    if this.done { return ErrTransactionDone }
+    defer this.finish()
+    this.store.mtx.Lock()
+    defer this.store.mtx.Unlock()
+    _, err := this.apply()
+    return err
+}
+
+/* Write the journal & carry it out, returning it.
+ * Caller must hold this.store.mtx, & finish the transaction.
+ */
+func (this *StoreTransaction) apply() (*storeJournal, error) {
+    store := this.store
+    journal, err := this.journal()
+    if err == nil {
+        err = writeJournal(this.dir, journal) }
+    if err != nil {
+        os.RemoveAll(this.dir)
+        return nil, err
+    }
+    used, capacity := store.Size()
+    err = store.applyJournal(this.dir, journal)
+    if err != nil { return nil, err }
+    // warn when crossing the soft limit
+    newUsed, _ := store.Size()
+    if store.SoftLimitHandler != nil && crossesSoftLimit(store.Index, used, newUsed) {
+        store.SoftLimitHandler(store, newUsed, capacity)
+    }
+    return journal, nil
+}
+
+// Drop the staged changes
+func (this *StoreTransaction) Rollback() error {
+    if this.done { return ErrTransactionDone }
+    this.finish()
+    return os.RemoveAll(this.dir)
+}
+
+// a transaction that reserved nothing, such as a removal, may finish under this.store.mtx
+func (this *StoreTransaction) finish() {
+    this.done = true
+    if this.reserved == 0 { return }
+    this.store.release(this.reserved)
+    this.reserved = 0
+}
+
+// locate the blobs the transaction touches. caller must hold this.store.mtx
+func (this *StoreTransaction) journal() (*storeJournal, error) {
+    store := this.store
+    journal := &storeJournal{Puts: []journalPut{}, Removes: []journalRemove{}, Meta: this.meta}
+    for _, put := range this.puts {
+        if existing, err := store.findPath(put.Item.Id); err == nil {
+            return nil, errors.New(fmt.Sprintf("Could not store. File already exists: %v", existing))
+        }
+        path, err := store.PathForId(put.Item.Id)
+        if err != nil { return nil, err }
+        put.Path, err = filepath.Rel(store.RootDir, path)
+        if err != nil { return nil, err }
+        if store.Pool != nil {
+            put.PoolPath, err = store.Pool.PathForHash(put.Item.Hash)
+            if err != nil { return nil, err }
+        }
+        journal.Puts = append(journal.Puts, put)
+    }
+    for _, id := range this.removes {
+        remove := journalRemove{Id: id}
+        if meta, err := store.Index.GetItem(id); err == nil { remove.Hash = meta.Hash }
+        path, err := store.findPath(id)
+        if err == nil {
+            info, err := os.Stat(path)
+            if err != nil { return nil, err }
+            remove.Size = info.Size()
+            remove.Path, err = filepath.Rel(store.RootDir, path)
+            if err != nil { return nil, err }
+        } else if !os.IsNotExist(err) {
+            return nil, err
+        }
+        journal.Removes = append(journal.Removes, remove)
+    }
+    return journal, nil
+}
+
+// write the journal to a temporary file, then rename it into place
+func writeJournal(dir string, journal *storeJournal) error {
+    data, err := json.Marshal(journal)
+    if err != nil { return err }
+    tmpPath, _, err := writeTemp(dir, bytes.NewReader(data), int64(len(data)))
+    if err != nil { return err }
+    err = os.Rename(tmpPath, filepath.Join(dir, journalName))
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+    return syncDir(dir)
+}
+
+/* Carry out a written journal, from wherever it was interrupted.
+ * Caller must hold this.mtx.
+ */
+func (this *OSStore) applyJournal(dir string, journal *storeJournal) error {
+    // blobs into place, then the index, unless it already has the changes
+    marker := MetaJournalPrefix + filepath.Base(dir)
+    _, err := this.Index.Get(marker)
+    if err == ErrNotFound {
+        for _, put := range journal.Puts {
+            err = this.placeBlob(dir, put)
+            if err != nil { return err }
+        }
+        err = this.applyJournalIndex(marker, journal)
+    }
+    if err != nil { return err }
+    // the blobs of removed items
+    for _, remove := range journal.Removes {
+        if remove.Path == "" { continue }
+        err = this.removeBlob(remove.Hash, filepath.Join(this.RootDir, remove.Path))
+        if err != nil && !os.IsNotExist(err) { return err }
+    }
+    err = os.RemoveAll(dir)
+    if err == nil {
+        err = syncDir(this.JournalDir) }
+    if err == nil {
+        err = this.Index.Delete(marker) }
+    return err
+}
+
+// move a staged blob to its path, unless it is there already
+func (this *OSStore) placeBlob(dir string, put journalPut) error {
+    path := filepath.Join(this.RootDir, put.Path)
+    _, err := os.Stat(path)
+    if err == nil || !os.IsNotExist(err) { return err }
+    stagedPath := filepath.Join(dir, put.Staged)
+    _, err = fs.EnsureDir(filepath.Dir(path))
+    if err != nil { return err }
+    if this.Pool != nil {
+        err = this.Pool.link(put.Item.Hash, put.Item.Size, stagedPath, path)
+    } else {
+        err = os.Rename(stagedPath, path)
+        if os.IsNotExist(err) && put.PoolPath != "" {
+            // moved into the pool before the crash
+            err = os.Link(put.PoolPath, path)
+        }
+    }
+    if err != nil { return err }
+    return syncDir(filepath.Dir(path))
+}
+
+func (this *OSStore) applyJournalIndex(marker string, journal *storeJournal) error {
+    delta := int64(0)
+    for _, put := range journal.Puts { delta += put.Item.Size }
+    for _, remove := range journal.Removes { delta -= remove.Size }
+    used, _ := this.Size()
+    tx, err := this.Index.Transaction()
+    if err != nil { return err }
+    for _, put := range journal.Puts {
+        if err == nil {
+            err = tx.AddItemMeta(put.Item) }
+    }
+    for _, remove := range journal.Removes {
+        if err == nil {
+            _, err = tx.DeleteItem(remove.Id) }
+    }
+    for _, meta := range journal.Meta {
+        if err != nil { break }
+        if meta.Delete {
+            err = tx.Delete(meta.Key)
+        } else {
+            err = tx.Set(meta.Key, meta.Value)
+        }
+    }
+    if err == nil {
+        err = addUsage(tx, used, delta) }
+    if err == nil {
+        err = tx.Set(marker, "1") }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+/* Finish the transactions a crash interrupted: those whose journal was
+ *  written are rolled forward, the rest are rolled back.
+ * Run when the store is opened.
+ */
+func (this *OSStore) Recover() error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    infos, err := ioutil.ReadDir(this.JournalDir)
+    if os.IsNotExist(err) { infos, err = nil, nil }
+    if err != nil { return err }
+    for _, info := range infos {
+        dir := filepath.Join(this.JournalDir, info.Name())
+        data, err := ioutil.ReadFile(filepath.Join(dir, journalName))
+        if os.IsNotExist(err) {
+            log.Printf("%v: rolling back transaction %v", this.RootDir, info.Name())
+            err = os.RemoveAll(dir)
+            if err != nil { return err }
+            continue
+        }
+        if err != nil { return err }
+        journal := &storeJournal{}
+        err = json.Unmarshal(data, journal)
+        if err != nil { return errors.New(fmt.Sprintf("Corrupt journal in %v: %v", dir, err)) }
+        log.Printf("%v: rolling forward transaction %v", this.RootDir, info.Name())
+        err = this.applyJournal(dir, journal)
+        if err != nil { return err }
+    }
+    return this.dropJournalMarkers()
+}
+
+// delete the markers of transactions whose directory is gone. caller must hold this.mtx
+func (this *OSStore) dropJournalMarkers() error {
+    markers := this.Index.Find(context.Background(), MetaJournalPrefix, -1)
+    defer markers.Close()
+    stale := []string{}
+    for markers.Next() {
+        if !strings.HasPrefix(markers.Key(), MetaJournalPrefix) { break }
+        name := strings.TrimPrefix(markers.Key(), MetaJournalPrefix)
+        if _, err := os.Stat(filepath.Join(this.JournalDir, name)); os.IsNotExist(err) {
+            stale = append(stale, markers.Key())
+        }
+    }
+    if err := markers.Err(); err != nil { return err }
+    for _, key := range stale {
+        err := this.Index.Delete(key)
+        if err != nil { return err }
+    }
+    return nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+    "os"
+    "log"
+    "fmt"
+    "errors"
+    "path/filepath"
+    "encoding/hex"
+    "encoding/base64"
+    "github.com/jaekwon/go-prelude/fs"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Blobs are stored two directory levels deep, named by the first two bytes of the id:
+ *  DataDir/3f/a2/P6Ix...=
+ * This keeps each directory under 256 entries until the deepest level,
+ *  which holds 1/65536th of the blobs.
+ *
+ * Older stores kept every blob directly in DataDir. Such flat stores are
+ *  migrated online by MigrateLayout, and lookups fall back to the flat path
+ *  until the migration is done.
+ */
+
+const (
+    LayoutFlat string = "flat"
+    LayoutSharded string = "sharded"
+)
+
+func (this *OSStore) PathForId(id types.Id) (string, error) {
+    if len(id) != 32 {
+        return "", errors.New(fmt.Sprintf("Id was of the wrong length (expected 32, got %v).", len(id)))
+    }
+    idB64 := base64.URLEncoding.EncodeToString(id)
+    path := filepath.Join(this.DataDir, hex.EncodeToString(id[0:1]), hex.EncodeToString(id[1:2]), idB64)
+    return path, nil
+}
+
+// where id was kept before sharding
+func (this *OSStore) flatPathForId(id types.Id) (string, error) {
+    if len(id) != 32 {
+        return "", errors.New(fmt.Sprintf("Id was of the wrong length (expected 32, got %v).", len(id)))
+    }
+    return filepath.Join(this.DataDir, base64.URLEncoding.EncodeToString(id)), nil
+}
+
+func (this *OSStore) Layout() string {
+    layout, err := this.Index.Get(MetaLayout)
+    if err != nil { return LayoutFlat }
+    return layout
+}
+
+// path of the existing file for id, in either layout
+func (this *OSStore) findPath(id types.Id) (string, error) {
+    path, err := this.PathForId(id)
+    if err != nil { return "", err }
+    _, err = os.Stat(path)
+    if err == nil || !os.IsNotExist(err) || this.Layout() == LayoutSharded {
+        return path, err
+    }
+    flatPath, _ := this.flatPathForId(id)
+    _, err = os.Stat(flatPath)
+    if err == nil { return flatPath, nil }
+    // the file may have just been migrated
+    _, err = os.Stat(path)
+    return path, err
+}
+
+/* Call fn for every regular file in DataDir, in either layout.
+ */
+func (this *OSStore) walkData(fn func(path string, info os.FileInfo) error) error {
+    _, err := fs.EnsureDir(this.DataDir)
+    if err != nil { return err }
+    return filepath.Walk(this.DataDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil { return err }
+        if !info.Mode().IsRegular() { return nil }
+        return fn(path, info)
+    })
+}
+
+// the flat files directly in DataDir
+func (this *OSStore) flatFiles() ([]string, error) {
+    dataDirFile, err := this.OpenDataDir()
+    if err != nil { return nil, err }
+    defer dataDirFile.Close()
+    infos, err := dataDirFile.Readdir(0)
+    if err != nil { return nil, err }
+    files := []string{}
+    for _, info := range infos {
+        if info.Mode().IsRegular() { files = append(files, info.Name()) }
+    }
+    return files, nil
+}
+
+/* Move every flat file into its shard, then mark the store as sharded.
+ * Safe to run while the store is in use.
+ * Files whose names are not ids are left in place.
+ * Returns ErrStoreClosed if the store is closed part way; the rest of the
+ *  files are moved when it is next opened.
+ */
+func (this *OSStore) MigrateLayout() (moved int, err error) {
+    files, err := this.flatFiles()
+    if err != nil { return 0, err }
+    for _, file := range files {
+        if this.stopped() { return moved, ErrStoreClosed }
+        id, err := types.StringToId(file)
+        if err != nil || len(id) != 32 {
+            log.Printf("MigrateLayout: skipping unrecognized file %v", file)
+            continue
+        }
+        path, _ := this.PathForId(id)
+        this.mtx.Lock()
+        _, err = fs.EnsureDir(filepath.Dir(path))
+        if err == nil {
+            err = os.Rename(filepath.Join(this.DataDir, file), path) }
+        this.mtx.Unlock()
+        if err != nil { return moved, err }
+        moved++
+    }
+    err = this.Index.Set(MetaLayout, LayoutSharded)
+    return moved, err
+}
+
+/* Migrate in the background if there are flat files, else mark the store as sharded.
+ * Close & Delete stop the migration & wait for it.
+ */
+func (this *OSStore) startLayoutMigration() error {
+    if this.Layout() == LayoutSharded { return nil }
+    files, err := this.flatFiles()
+    if err != nil { return err }
+    if len(files) == 0 {
+        return this.Index.Set(MetaLayout, LayoutSharded)
+    }
+    this.background.Add(1)
+    go func() {
+        defer this.background.Done()
+        moved, err := this.MigrateLayout()
+        if err == ErrStoreClosed {
+            log.Printf("Layout migration of %v stopped after %v files", this.DataDir, moved)
+        } else if err != nil {
+            log.Printf("Layout migration of %v failed after %v files: %v", this.DataDir, moved, err)
+        }
+    }()
+    return nil
+}
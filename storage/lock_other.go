@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package storage
+
+import (
+    "os"
+)
+
+// Files are not locked on this platform; see lock_unix.go
+func lockFile(path string) (*os.File, error) {
+    return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package storage
+
+import (
+    "os"
+    "syscall"
+)
+
+/* Take an exclusive lock on the file at path, creating it if needed.
+ * The lock is released when the returned file is closed, or the process exits.
+ * Returns ErrIndexInUse if another open file holds it.
+ */
+func lockFile(path string) (*os.File, error) {
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil { return nil, err }
+    err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if err == syscall.EWOULDBLOCK {
+        err = ErrIndexInUse }
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    return file, nil
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+    "os"
+    "io"
+    "log"
+    "fmt"
+    "bufio"
+    "bytes"
+    "errors"
+    "strconv"
+    "hash/crc32"
+    "encoding/json"
+    "path/filepath"
+)
+
+/* A LogIndex is an Index in pure Go: a MemIndex whose every committed change
+ *  is appended to a log file & synced before it is applied.
+ * Opening it replays the log. Each commit is one line,
+ *  "<crc32 in hex> <json ops>", so a commit torn by a crash fails its
+ *  checksum. Only the last commit can be torn, & it is dropped; a bad commit
+ *  before the end is corruption, & fails the open with ErrLogCorrupt.
+ * Compact rewrites the log as the ops recreating the current state; it is
+ *  run on open once the log is mostly superseded changes.
+ * The whole index is held in memory, so only one process may have it open:
+ *  it is locked through File + ".lock", & a second open fails with
+ *  ErrIndexInUse, e.g. while gserver run has the store.
+ */
+type LogIndex struct {
+    *MemIndex
+    File string
+
+    file *os.File
+    lock *os.File // held while open
+    size int64 // of the whole commits in the log
+    commits int
+}
+
+// compact on open once the log has this many more commits than twice its live entries
+const logCompactThreshold = 1000
+
+// Open the log index file, creating it if needed
+func NewLogIndex(file string) (*LogIndex, error) {
+    return openLogIndex(file, true)
+}
+
+// Open an existing log index file, keeping its contents
+func OpenLogIndex(file string) (*LogIndex, error) {
+    return openLogIndex(file, false)
+}
+
+func openLogIndex(file string, create bool) (*LogIndex, error) {
+    flags := os.O_RDWR
+    if create { flags |= os.O_CREATE }
+    logFile, err := os.OpenFile(file, flags, 0600)
+    if err != nil { return nil, err }
+    lock, err := lockFile(file + ".lock")
+    if err != nil {
+        logFile.Close()
+        return nil, err
+    }
+    index := &LogIndex{MemIndex: newMemIndex(), File: file, file: logFile, lock: lock}
+    err = index.replay()
+    if err != nil {
+        logFile.Close()
+        lock.Close()
+        return nil, err
+    }
+    index.log = index.append
+    if index.commits == 0 {
+        err = index.Set(MetaSchemaVersion, strconv.Itoa(CurrentSchemaVersion))
+    } else {
+        err = index.checkSchema()
+    }
+    if err == nil && index.commits > logCompactThreshold + 2 * index.entries() {
+        err = index.Compact()
+    }
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    return index, nil
+}
+
+var ErrLogCorrupt error = errors.New("Index log is corrupt")
+var ErrIndexInUse error = errors.New("Index is in use by another process; stop the server first")
+
+/* Refuse logs from newer versions with ErrSchemaTooNew, as SQLIndex does.
+ * Older logs need no migration, as the log holds the same ops in every
+ *  version, so their version is just brought up to date.
+ */
+func (this *LogIndex) checkSchema() error {
+    version, err := this.SchemaVersion()
+    if err != nil { return ErrSchemaUnknown }
+    if version > CurrentSchemaVersion { return ErrSchemaTooNew }
+    if version < CurrentSchemaVersion {
+        return this.Set(MetaSchemaVersion, strconv.Itoa(CurrentSchemaVersion)) }
+    return nil
+}
+
+// apply the log, truncating a torn last commit
+func (this *LogIndex) replay() error {
+    reader := bufio.NewReader(this.file)
+    good := int64(0)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            if len(line) > 0 { log.Printf("%v: dropping a torn commit", this.File) }
+            break
+        }
+        if err != nil { return err }
+        ops, err := decodeCommit(line)
+        if err != nil {
+            if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+                log.Printf("%v: bad commit at offset %v: %v", this.File, good, err)
+                return ErrLogCorrupt
+            }
+            log.Printf("%v: dropping a torn commit: %v", this.File, err)
+            break
+        }
+        for _, op := range ops { this.apply(op) }
+        good += int64(len(line))
+        this.commits++
+    }
+    this.size = good
+    return this.truncate()
+}
+
+// drop anything after the last whole commit
+func (this *LogIndex) truncate() error {
+    err := this.file.Truncate(this.size)
+    if err != nil { return err }
+    _, err = this.file.Seek(this.size, io.SeekStart)
+    return err
+}
+
+func encodeCommit(ops []indexOp) ([]byte, error) {
+    data, err := json.Marshal(ops)
+    if err != nil { return nil, err }
+    return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeCommit(line []byte) ([]indexOp, error) {
+    line = bytes.TrimSuffix(line, []byte("\n"))
+    if len(line) < 10 || line[8] != ' ' { return nil, errors.New("Malformed commit") }
+    data := line[9:]
+    if fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) != string(line[:8]) {
+        return nil, errors.New("Commit checksum mismatch") }
+    ops := []indexOp{}
+    err := json.Unmarshal(data, &ops)
+    return ops, err
+}
+
+// write a commit to the log. caller must hold this.mtx
+func (this *LogIndex) append(ops []indexOp) error {
+    line, err := encodeCommit(ops)
+    if err != nil { return err }
+    _, err = this.file.Write(line)
+    if err == nil {
+        err = this.file.Sync() }
+    if err != nil {
+        this.truncate()
+        return err
+    }
+    this.size += int64(len(line))
+    this.commits++
+    return nil
+}
+
+// caller must hold this.mtx
+func (this *LogIndex) entries() int {
+    return this.kv.Len() + len(this.items) + len(this.blobs)
+}
+
+/* Rewrite the log as a single commit recreating the current state.
+ * The new log is synced before it replaces the old one.
+ */
+func (this *LogIndex) Compact() error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    ops := []indexOp{{Op: opCounter, Size: this.lastCounter}}
+    this.kv.Ascend("", func(key, value string) bool {
+        ops = append(ops, indexOp{Op: opSet, Key: key, Value: value})
+        return true
+    })
+    this.eachItem(0, func(item *ItemMeta) bool {
+        ops = append(ops, indexOp{Op: opAddItem, Item: item})
+        return true
+    })
+    for hash, blob := range this.blobs {
+        ops = append(ops, indexOp{Op: opBlob, Key: hash, Size: blob.size, Refs: blob.refs})
+    }
+    line, err := encodeCommit(ops)
+    if err != nil { return err }
+    tmpFile := this.File + ".compact"
+    file, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil { return err }
+    _, err = file.Write(line)
+    if err == nil {
+        err = file.Sync() }
+    if err == nil {
+        err = os.Rename(tmpFile, this.File) }
+    if err != nil {
+        file.Close()
+        os.Remove(tmpFile)
+        return err
+    }
+    this.file.Close()
+    this.file = file
+    this.size = int64(len(line))
+    this.commits = 1
+    return syncDir(filepath.Dir(this.File))
+}
+
+func (this *LogIndex) Close() error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    err := this.file.Close()
+    this.lock.Close()
+    return err
+}
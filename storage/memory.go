@@ -0,0 +1,781 @@
+package storage
+
+import (
+    "context"
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "bytes"
+    "errors"
+    "strconv"
+    "crypto/sha256"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* In-memory implementations of the Index operations & of Storer.
+ * They have the same semantics as Index & OSStore (see conformance_test.go),
+ *  but nothing touches the disk, which makes them handy for tests.
+ */
+
+type MemIndex struct {
+    mtx sync.Mutex
+    kv btree
+    items map[string]*ItemMeta // by id
+    order btree // ids by counterKey, in the order items were added
+    lastCounter int64
+    blobs map[string]*memBlobRef // by hash
+
+    // if set, called with every change before it is applied, e.g. by LogIndex;
+    // if it fails, the change is not applied
+    log func(ops []indexOp) error
+
+    itemWatchers
+}
+
+type memBlobRef struct {
+    refs int64
+    size int64
+}
+
+func NewMemIndex() *MemIndex {
+    index := newMemIndex()
+    index.kv.Set(MetaSchemaVersion, strconv.Itoa(CurrentSchemaVersion))
+    return index
+}
+
+// with nothing in it, not even the schema version
+func newMemIndex() *MemIndex {
+    return &MemIndex{items: map[string]*ItemMeta{}, blobs: map[string]*memBlobRef{}}
+}
+
+// sorts as counter does, for the positive counters items have
+func counterKey(counter int64) string {
+    return fmt.Sprintf("%016x", counter)
+}
+
+/* An indexOp is one change to a MemIndex, as buffered by a MemTransaction
+ *  & written to a LogIndex's log. Ops are applied in order, & replaying
+ *  them from an empty index gives the same index.
+ */
+type indexOp struct {
+    Op string
+    Key string `json:",omitempty"` // or hash for blob ops
+    Value string `json:",omitempty"`
+    Item *ItemMeta `json:",omitempty"`
+    Id types.Id `json:",omitempty"`
+    Time time.Time `json:",omitempty"`
+    Size int64 `json:",omitempty"`
+    Refs int64 `json:",omitempty"`
+}
+
+const (
+    opSet = "set"
+    opSetDefault = "setdefault"
+    opDelete = "delete"
+    opAddItem = "item" // Item, whose Counter is assigned on commit
+    opDeleteItem = "delitem" // Id
+    opSetExpiry = "expires" // Id & Time
+    opSetItemSize = "size" // Id & Size
+    opAddBlobRef = "ref" // Key & Size
+    opReleaseBlobRef = "unref" // Key
+    opBlob = "blob" // Key, Size & Refs, as written by LogIndex.Compact
+    opCounter = "counter" // Size is the last counter, as written by LogIndex.Compact
+)
+
+/* Log & apply ops, all or none, assigning counters to the items added.
+ * Caller must hold this.mtx.
+ */
+func (this *MemIndex) commit(ops []indexOp) error {
+    // refuse ids the index has, as SQLIndex's unique index does
+    present := map[string]bool{}
+    for _, op := range ops {
+        switch op.Op {
+        case opAddItem:
+            id := op.Item.Id.String()
+            exists, ok := present[id]
+            if !ok { exists = this.items[id] != nil }
+            if exists { return ErrDuplicateItem }
+            present[id] = true
+        case opDeleteItem:
+            present[op.Id.String()] = false
+        }
+    }
+    counter := this.lastCounter
+    for i := range ops {
+        if ops[i].Op != opAddItem { continue }
+        counter++
+        item := *ops[i].Item
+        item.Counter = counter
+        ops[i].Item = &item
+    }
+    if this.log != nil {
+        err := this.log(ops)
+        if err != nil { return err }
+    }
+    for _, op := range ops { this.apply(op) }
+    return nil
+}
+
+// caller must hold this.mtx
+func (this *MemIndex) apply(op indexOp) {
+    switch op.Op {
+    case opSet:
+        this.kv.Set(op.Key, op.Value)
+    case opSetDefault:
+        if _, ok := this.kv.Get(op.Key); !ok { this.kv.Set(op.Key, op.Value) }
+    case opDelete:
+        this.kv.Delete(op.Key)
+    case opAddItem:
+        meta := *op.Item
+        meta.Id = append(types.Id{}, meta.Id...)
+        // as stored by SQLIndex
+        if meta.Size < 0 { meta.Size = -1 }
+        if !meta.Received.IsZero() { meta.Received = time.Unix(meta.Received.Unix(), 0) }
+        if !meta.Expires.IsZero() { meta.Expires = time.Unix(meta.Expires.Unix(), 0) }
+        this.deleteItem(meta.Id) // only in logs from before ids were unique
+        this.items[meta.Id.String()] = &meta
+        this.order.Set(counterKey(meta.Counter), meta.Id.String())
+        if meta.Counter > this.lastCounter { this.lastCounter = meta.Counter }
+    case opDeleteItem:
+        this.deleteItem(op.Id)
+    case opSetExpiry:
+        if item := this.findItem(op.Id); item != nil {
+            item.Expires = time.Time{}
+            if !op.Time.IsZero() { item.Expires = time.Unix(op.Time.Unix(), 0) }
+        }
+    case opSetItemSize:
+        if item := this.findItem(op.Id); item != nil { item.Size = op.Size }
+    case opAddBlobRef:
+        blob, ok := this.blobs[op.Key]
+        if !ok {
+            blob = &memBlobRef{0, op.Size}
+            this.blobs[op.Key] = blob
+        }
+        blob.refs++
+    case opReleaseBlobRef:
+        blob, ok := this.blobs[op.Key]
+        if !ok { break }
+        blob.refs--
+        if blob.refs <= 0 { delete(this.blobs, op.Key) }
+    case opBlob:
+        this.blobs[op.Key] = &memBlobRef{op.Refs, op.Size}
+    case opCounter:
+        if op.Size > this.lastCounter { this.lastCounter = op.Size }
+    }
+}
+
+// commit a single op
+func (this *MemIndex) commitOne(op indexOp) error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.commit([]indexOp{op})
+}
+
+func (this *MemIndex) SchemaVersion() (int, error) {
+    value, err := this.Get(MetaSchemaVersion)
+    if err != nil { return -1, ErrSchemaUnknown }
+    return strconv.Atoi(value)
+}
+
+func (this *MemIndex) Get(key string) (string, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    value, ok := this.kv.Get(key)
+    if !ok { return "", ErrNotFound }
+    return value, nil
+}
+
+func (this *MemIndex) Set(key, value string) error {
+    return this.commitOne(indexOp{Op: opSet, Key: key, Value: value})
+}
+
+// Set key only if it has no value yet
+func (this *MemIndex) SetDefault(key, value string) error {
+    return this.commitOne(indexOp{Op: opSetDefault, Key: key, Value: value})
+}
+
+func (this *MemIndex) Delete(key string) error {
+    return this.commitOne(indexOp{Op: opDelete, Key: key})
+}
+
+// a negative limit means no limit, as in SQL
+func (this *MemIndex) Find(ctx context.Context, key string, limit int) *KeyIterator {
+    return newKeyIterator(ctx, key, limit, this.findPage)
+}
+
+func (this *MemIndex) findPage(from string, limit int) ([]KeyValue, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    found := []KeyValue{}
+    this.kv.Ascend(from, func(k, v string) bool {
+        found = append(found, KeyValue{k, v})
+        return len(found) < limit
+    })
+    return found, nil
+}
+
+func (this *MemIndex) Close() error {
+    return nil
+}
+
+func (this *MemIndex) AddItem(id types.Id) (int64, error) {
+    if _, err := id.ToString(); err != nil { return -1, err }
+    return this.AddItemMeta(ItemMeta{Id: id, Size: -1})
+}
+
+// Add an item with its meta, returning its counter. meta.Counter is ignored.
+func (this *MemIndex) AddItemMeta(meta ItemMeta) (int64, error) {
+    if _, err := meta.Id.ToString(); err != nil { return -1, err }
+    this.mtx.Lock()
+    ops := []indexOp{{Op: opAddItem, Item: &meta}}
+    err := this.commit(ops)
+    this.mtx.Unlock()
+    if err != nil { return -1, err }
+    this.notifyWatchers()
+    return ops[0].Item.Counter, nil
+}
+
+// the item for id, or nil. caller must hold this.mtx
+func (this *MemIndex) findItem(id types.Id) *ItemMeta {
+    return this.items[id.String()]
+}
+
+// caller must hold this.mtx
+func (this *MemIndex) deleteItem(id types.Id) {
+    item := this.findItem(id)
+    if item == nil { return }
+    delete(this.items, id.String())
+    this.order.Delete(counterKey(item.Counter))
+}
+
+// call fn for each item with counter >= since in counter order, until it
+// returns false. caller must hold this.mtx
+func (this *MemIndex) eachItem(since int64, fn func(item *ItemMeta) bool) {
+    if since < 0 { since = 0 }
+    this.order.Ascend(counterKey(since), func(key, id string) bool {
+        return fn(this.items[id])
+    })
+}
+
+func (this *MemIndex) HasItem(id types.Id) (bool, error) {
+    if _, err := id.ToString(); err != nil { return false, err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.findItem(id) != nil, nil
+}
+
+// Find items with counter >= since, in the order they were added
+func (this *MemIndex) FindItems(ctx context.Context, since int64, limit int) *ItemIterator {
+    return newItemIterator(ctx, since, limit, this.QueryItems)
+}
+
+// commit an op on the item for id, or return ErrNotFound
+func (this *MemIndex) commitItemOp(op indexOp) error {
+    if _, err := op.Id.ToString(); err != nil { return err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if this.findItem(op.Id) == nil { return ErrNotFound }
+    return this.commit([]indexOp{op})
+}
+
+func (this *MemIndex) SetExpiry(id types.Id, expires time.Time) error {
+    return this.commitItemOp(indexOp{Op: opSetExpiry, Id: id, Time: expires})
+}
+
+func (this *MemIndex) FindExpired(now time.Time, limit int) ([]types.Id, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    expired := []*ItemMeta{}
+    this.eachItem(0, func(item *ItemMeta) bool {
+        if !item.Expires.IsZero() && item.Expires.Unix() <= now.Unix() {
+            expired = append(expired, item)
+        }
+        return true
+    })
+    sort.SliceStable(expired, func(i, j int) bool { return expired[i].Expires.Before(expired[j].Expires) })
+    ids := []types.Id{}
+    for _, item := range expired {
+        if limit >= 0 && len(ids) >= limit { break }
+        ids = append(ids, item.Id)
+    }
+    return ids, nil
+}
+
+func (this *MemIndex) GetItem(id types.Id) (*ItemMeta, error) {
+    if _, err := id.ToString(); err != nil { return nil, err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    item := this.findItem(id)
+    if item == nil { return nil, ErrNotFound }
+    meta := *item
+    return &meta, nil
+}
+
+func (this *MemIndex) SetItemSize(id types.Id, size int64) error {
+    return this.commitItemOp(indexOp{Op: opSetItemSize, Id: id, Size: size})
+}
+
+// unknown meta sorts first, as NULL does in SQL
+func lessItem(a, b *ItemMeta, sortBy string) bool {
+    switch sortBy {
+    case SortReceived: return a.Received.Before(b.Received)
+    case SortSize: return a.Size < b.Size
+    case SortSender: return a.Sender < b.Sender
+    case SortExpires: return a.Expires.Before(b.Expires)
+    }
+    return false
+}
+
+func (this *MemIndex) QueryItems(query ItemQuery) ([]ItemMeta, error) {
+    sortBy := query.SortBy
+    if sortBy == "" { sortBy = SortCounter }
+    if !sortColumns[sortBy] { return nil, ErrUnknownSort }
+    this.mtx.Lock()
+    items := []ItemMeta{}
+    this.eachItem(query.Since, func(item *ItemMeta) bool {
+        switch {
+        case query.Sender != "" && item.Sender != query.Sender:
+        case query.MinSize > 0 && item.Size < query.MinSize:
+        case query.MaxSize > 0 && (item.Size < 0 || item.Size > query.MaxSize):
+        case !query.ReceivedAfter.IsZero() && (item.Received.IsZero() || item.Received.Unix() < query.ReceivedAfter.Unix()):
+        case !query.ReceivedBefore.IsZero() && (item.Received.IsZero() || item.Received.Unix() >= query.ReceivedBefore.Unix()):
+        default:
+            items = append(items, *item)
+        }
+        return true
+    })
+    this.mtx.Unlock()
+    // items are in counter order, which breaks ties
+    sort.SliceStable(items, func(i, j int) bool {
+        if sortBy == SortCounter { return query.Descending && items[i].Counter > items[j].Counter }
+        if query.Descending { return lessItem(&items[j], &items[i], sortBy) }
+        return lessItem(&items[i], &items[j], sortBy)
+    })
+    if query.Limit > 0 && len(items) > query.Limit { items = items[:query.Limit] }
+    return items, nil
+}
+
+func (this *MemIndex) AddBlobRef(hash types.Id, size int64) error {
+    return this.commitOne(indexOp{Op: opAddBlobRef, Key: hash.String(), Size: size})
+}
+
+func (this *MemIndex) ReleaseBlobRef(hash types.Id) (int64, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    err := this.commit([]indexOp{{Op: opReleaseBlobRef, Key: hash.String()}})
+    if err != nil { return -1, err }
+    if blob, ok := this.blobs[hash.String()]; ok { return blob.refs, nil }
+    return 0, nil
+}
+
+func (this *MemIndex) BlobRefs(hash types.Id) (int64, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if blob, ok := this.blobs[hash.String()]; ok { return blob.refs, nil }
+    return 0, nil
+}
+
+func (this *MemIndex) BlobUsage() (int64, int64, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    size := int64(0)
+    for _, blob := range this.blobs { size += blob.size }
+    return int64(len(this.blobs)), size, nil
+}
+
+func (this *MemIndex) Transaction() (Transaction, error) {
+    return &MemTransaction{index: this, overlay: map[string]*string{}}, nil
+}
+
+/* A MemTransaction buffers its changes & commits them all at once.
+ * Get sees the transaction's own changes.
+ */
+type MemTransaction struct {
+    index *MemIndex
+    ops []indexOp
+    overlay map[string]*string // nil for deleted keys
+    addedItems bool
+    done bool
+}
+
+var ErrTransactionDone error = errors.New("Transaction already committed or rolled back")
+
+func (this *MemTransaction) Get(key string) (string, error) {
+    if value, ok := this.overlay[key]; ok {
+        if value == nil { return "", ErrNotFound }
+        return *value, nil
+    }
+    return this.index.Get(key)
+}
+
+func (this *MemTransaction) Set(key, value string) error {
+    if this.done { return ErrTransactionDone }
+    this.overlay[key] = &value
+    this.ops = append(this.ops, indexOp{Op: opSet, Key: key, Value: value})
+    return nil
+}
+
+func (this *MemTransaction) Delete(key string) error {
+    if this.done { return ErrTransactionDone }
+    this.overlay[key] = nil
+    this.ops = append(this.ops, indexOp{Op: opDelete, Key: key})
+    return nil
+}
+
+func (this *MemTransaction) AddItem(id types.Id) error {
+    return this.AddItemMeta(ItemMeta{Id: id, Size: -1})
+}
+
+func (this *MemTransaction) AddItemMeta(meta ItemMeta) error {
+    if this.done { return ErrTransactionDone }
+    if _, err := meta.Id.ToString(); err != nil { return err }
+    meta.Id = append(types.Id{}, meta.Id...)
+    this.ops = append(this.ops, indexOp{Op: opAddItem, Item: &meta})
+    this.addedItems = true
+    return nil
+}
+
+// Remove the item for id, returning whether there was one
+func (this *MemTransaction) DeleteItem(id types.Id) (bool, error) {
+    if this.done { return false, ErrTransactionDone }
+    if _, err := id.ToString(); err != nil { return false, err }
+    this.index.mtx.Lock()
+    existed := this.index.findItem(id) != nil
+    this.index.mtx.Unlock()
+    this.ops = append(this.ops, indexOp{Op: opDeleteItem, Id: append(types.Id{}, id...)})
+    return existed, nil
+}
+
+func (this *MemTransaction) Commit() error {
+    if this.done { return ErrTransactionDone }
+    this.done = true
+    this.index.mtx.Lock()
+    err := this.index.commit(this.ops)
+    this.index.mtx.Unlock()
+    if err == nil && this.addedItems { this.index.notifyWatchers() }
+    return err
+}
+
+func (this *MemTransaction) Rollback() error {
+    if this.done { return ErrTransactionDone }
+    this.done = true
+    return nil
+}
+
+/* A MemStore keeps blobs in memory, with its meta & items in a MemIndex.
+ */
+type MemStore struct {
+    Index *MemIndex
+
+    // called when a Store pushes usage to or past the soft limit
+    SoftLimitHandler func(store *MemStore, used int64, capacity int64)
+
+    mtx sync.Mutex
+    blobs map[string][]byte
+    usage reservations // bytes being written
+}
+
+func NewMemStore(owner *types.Identity, capacity int64) (Storer, error) {
+    if owner == nil { return nil, errors.New("NewMemStore expected non-nil owner") }
+    index := NewMemIndex()
+    index.Set(MetaOwner, types.KeyToString(owner.PublicKey))
+    index.Set(MetaCapacity, strconv.FormatInt(capacity, 10))
+    index.Set(MetaUsed, "0")
+    return &MemStore{Index: index, blobs: map[string][]byte{}}, nil
+}
+
+func (this *MemStore) Owner() *types.Identity {
+    ownerKey, err := this.Index.Get(MetaOwner)
+    if err != nil { return nil }
+    owner, err := types.StringToIdentity(ownerKey)
+    if err != nil { return nil }
+    return owner
+}
+
+func (this *MemStore) Size() (int64, int64) {
+    return indexSize(this.Index)
+}
+
+func (this *MemStore) SoftLimit() int64 {
+    return indexSoftLimit(this.Index)
+}
+
+func (this *MemStore) SetCapacity(capacity int64) error {
+    return this.Index.Set(MetaCapacity, strconv.FormatInt(capacity, 10))
+}
+
+func (this *MemStore) SetSoftLimit(softLimit int64) error {
+    return this.Index.Set(MetaSoftLimit, strconv.FormatInt(softLimit, 10))
+}
+
+func (this *MemStore) Store(id types.Id, data []byte) error {
+    return this.StoreReader(id, bytes.NewReader(data), int64(len(data)))
+}
+
+func (this *MemStore) StoreReader(id types.Id, reader io.Reader, size int64) error {
+    if _, err := id.ToString(); err != nil { return err }
+    _, err := this.store(ItemMeta{Id: id, Size: size}, reader)
+    return err
+}
+
+func (this *MemStore) StoreContent(reader io.Reader, size int64) (types.Id, error) {
+    return this.store(ItemMeta{Size: size}, reader)
+}
+
+// see OSStore.StoreItem
+func (this *MemStore) StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    if meta.Id != nil {
+        if _, err := meta.Id.ToString(); err != nil { return nil, err }
+    }
+    return this.store(meta, reader)
+}
+
+// store under meta.Id, or under the content's id if that is nil
+func (this *MemStore) store(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    id, size := meta.Id, meta.Size
+    if size < 0 {
+        return nil, errors.New(fmt.Sprintf("Invalid size %v", size))
+    }
+    err := this.reserve(id, size)
+    if err != nil { return nil, err }
+    defer this.release(size)
+
+    data := make([]byte, size)
+    _, err = io.ReadFull(reader, data)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        err = errors.New(fmt.Sprintf("Could not store. Expected %v bytes", size)) }
+    if err != nil { return nil, err }
+    hash := sha256.Sum256(data)
+    contentId := types.Id(hash[:])
+    if meta.Hash != nil && !bytes.Equal(meta.Hash, contentId) { return nil, ErrHashMismatch }
+    if id == nil {
+        id = contentId
+    } else if !bytes.Equal(id, contentId) && this.ContentAddressed() {
+        return nil, ErrIdMismatch
+    }
+
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if _, ok := this.blobs[id.String()]; ok {
+        return nil, errors.New(fmt.Sprintf("Could not store. Id already exists: %v", id))
+    }
+    used, capacity := this.Size()
+    err = addItemUsage(this.Index, ItemMeta{Id: id, Size: size, Received: meta.receivedOrNow(), Sender: meta.Sender, Hash: contentId, Expires: meta.Expires})
+    if err != nil { return nil, err }
+    this.blobs[id.String()] = data
+    // warn when crossing the soft limit
+    if this.SoftLimitHandler != nil && crossesSoftLimit(this.Index, used, used + size) {
+        this.SoftLimitHandler(this, used + size, capacity)
+    }
+    return id, nil
+}
+
+func (this *MemStore) reserve(id types.Id, size int64) error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if id != nil {
+        if _, ok := this.blobs[id.String()]; ok {
+            return errors.New(fmt.Sprintf("Could not store. Id already exists: %v", id))
+        }
+    }
+    return this.usage.reserve(this.Index, size)
+}
+
+func (this *MemStore) release(size int64) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    this.usage.release(size)
+}
+
+// Recompute usage from the blobs
+func (this *MemStore) Recount() (int64, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    used := int64(0)
+    for _, data := range this.blobs { used += int64(len(data)) }
+    return used, this.Index.Set(MetaUsed, strconv.FormatInt(used, 10))
+}
+
+type memBlob struct {
+    *bytes.Reader
+}
+
+func (this memBlob) Close() error {
+    return nil
+}
+
+func (this *MemStore) Open(id types.Id) (Blob, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    data, ok := this.blobs[id.String()]
+    if !ok { return nil, ErrNotFound }
+    return memBlob{bytes.NewReader(data)}, nil
+}
+
+func (this *MemStore) Stat(id types.Id) (*ItemMeta, error) {
+    this.mtx.Lock()
+    data, ok := this.blobs[id.String()]
+    this.mtx.Unlock()
+    if !ok { return nil, ErrNotFound }
+    meta, err := this.Index.GetItem(id)
+    if err == ErrNotFound {
+        meta, err = &ItemMeta{Id: id}, nil }
+    if err != nil { return nil, err }
+    meta.Size = int64(len(data))
+    return meta, nil
+}
+
+func (this *MemStore) FindItems(ctx context.Context, since int64, limit int) *ItemIterator {
+    return this.Index.FindItems(ctx, since, limit)
+}
+
+func (this *MemStore) QueryItems(query ItemQuery) ([]ItemMeta, error) {
+    return this.Index.QueryItems(query)
+}
+
+func (this *MemStore) RangeDigests(ctx context.Context) (map[byte]RangeDigest, error) {
+    return ItemRangeDigests(ctx, this)
+}
+
+func (this *MemStore) RangeItems(ctx context.Context, prefixes []byte) (map[byte][]ItemMeta, error) {
+    return ItemsInRanges(ctx, this, prefixes)
+}
+
+func (this *MemStore) GetItem(id types.Id) (*ItemMeta, error) {
+    return this.Index.GetItem(id)
+}
+
+func (this *MemStore) WatchItems(ch chan struct{}) {
+    this.Index.Watch(ch)
+}
+
+func (this *MemStore) UnwatchItems(ch chan struct{}) {
+    this.Index.Unwatch(ch)
+}
+
+func (this *MemStore) ContentAddressed() bool {
+    value, err := this.Index.Get(MetaContentAddressed)
+    return err == nil && value == "true"
+}
+
+func (this *MemStore) SetContentAddressed(contentAddressed bool) error {
+    if contentAddressed {
+        return this.Index.Set(MetaContentAddressed, "true")
+    }
+    return this.Index.Delete(MetaContentAddressed)
+}
+
+func (this *MemStore) Verify(id types.Id) error {
+    this.mtx.Lock()
+    data, ok := this.blobs[id.String()]
+    this.mtx.Unlock()
+    if !ok { return ErrNotFound }
+    if !bytes.Equal(id, ContentId(data)) { return ErrIdMismatch }
+    return nil
+}
+
+func (this *MemStore) SetExpiry(id types.Id, expires time.Time) error {
+    return this.Index.SetExpiry(id, expires)
+}
+
+func (this *MemStore) SweepExpired(now time.Time, limit int) (int, error) {
+    ids, err := this.Index.FindExpired(now, limit)
+    if err != nil { return 0, err }
+    removed := 0
+    for _, id := range ids {
+        this.mtx.Lock()
+        existed, err := this.removeItem(id)
+        this.mtx.Unlock()
+        if err != nil { return removed, err }
+        if existed { removed++ }
+    }
+    return removed, nil
+}
+
+// caller must hold this.mtx
+func (this *MemStore) removeItem(id types.Id) (bool, error) {
+    data, blobExisted := this.blobs[id.String()]
+    itemExisted, err := deleteItemUsage(this.Index, id, int64(len(data)))
+    if err != nil { return false, err }
+    delete(this.blobs, id.String())
+    return blobExisted || itemExisted, nil
+}
+
+func (this *MemStore) Remove(id types.Id) (bool, error) {
+    if _, err := id.ToString(); err != nil { return false, err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.removeItem(id)
+}
+
+func (this *MemStore) Close() error {
+    return nil
+}
+
+func (this *MemStore) Delete() error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    this.blobs = map[string][]byte{}
+    this.Index = NewMemIndex()
+    return nil
+}
+
+/* A MemStorehouser keeps a MemStore per owner
+ */
+type MemStorehouser struct {
+    mtx sync.Mutex
+    stores map[string]*MemStore
+}
+
+func NewMemStorehouser() *MemStorehouser {
+    return &MemStorehouser{stores: map[string]*MemStore{}}
+}
+
+func (this *MemStorehouser) AllocateStorer(owner *types.Identity, capacity int64) (Storer, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    ownerKey := types.KeyToString(owner.PublicKey)
+    if _, ok := this.stores[ownerKey]; ok { return nil, ErrAlreadyAllocated }
+    store, err := NewMemStore(owner, capacity)
+    if err != nil { return nil, err }
+    this.stores[ownerKey] = store.(*MemStore)
+    return store, nil
+}
+
+func (this *MemStorehouser) GetStorer(owner *types.Identity) (Storer, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    store, ok := this.stores[types.KeyToString(owner.PublicKey)]
+    if !ok { return nil, nil }
+    return store, nil
+}
+
+func (this *MemStorehouser) DeallocateStorer(owner *types.Identity) error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    ownerKey := types.KeyToString(owner.PublicKey)
+    if _, ok := this.stores[ownerKey]; !ok { return ErrNotFound }
+    delete(this.stores, ownerKey)
+    return nil
+}
+
+func (this *MemStorehouser) SweepExpired(now time.Time, limit int) (int, error) {
+    this.mtx.Lock()
+    stores := []*MemStore{}
+    for _, store := range this.stores { stores = append(stores, store) }
+    this.mtx.Unlock()
+    removed := 0
+    for _, store := range stores {
+        if removed >= limit { break }
+        n, err := store.SweepExpired(now, limit - removed)
+        removed += n
+        if err != nil { return removed, err }
+    }
+    return removed, nil
+}
+
+func (this *MemStorehouser) Close() error {
+    return nil
+}
@@ -0,0 +1,152 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "errors"
+    "strconv"
+    "database/sql"
+)
+
+/* A Migration upgrades an index to schema Version from the version before it.
+ * Each runs in its own transaction, together with the update of MetaSchemaVersion,
+ *  so an index is never left half-migrated.
+ * To change the schema, append a Migration & bump CurrentSchemaVersion.
+ */
+type Migration struct {
+    Version int
+    Description string
+    Up func(tx *SQLTransaction) error
+}
+
+var migrations = []Migration{
+    {1, "Create kv & items tables", func(tx *SQLTransaction) error {
+        _, err := tx.Exec(
+        `CREATE TABLE kv (
+            k VARCHAR(255) NOT NULL PRIMARY KEY,
+            v VARCHAR(255)
+        )`)
+        if err != nil { return err }
+        _, err = tx.Exec(
+        `CREATE TABLE items (
+            counter INTEGER PRIMARY KEY AUTOINCREMENT,
+            id VARCHAR(44) NOT NULL
+        )`)
+        return err
+    }},
+    {2, "Add items.expires", func(tx *SQLTransaction) error {
+        _, err := tx.Exec("ALTER TABLE items ADD COLUMN expires INTEGER")
+        if err != nil { return err }
+        _, err = tx.Exec("CREATE INDEX items_expires ON items (expires)")
+        return err
+    }},
+    {3, "Add items.size, received, sender & hash", func(tx *SQLTransaction) error {
+        for _, statement := range []string{
+            "ALTER TABLE items ADD COLUMN size INTEGER",
+            "ALTER TABLE items ADD COLUMN received INTEGER",
+            "ALTER TABLE items ADD COLUMN sender VARCHAR(44)",
+            "ALTER TABLE items ADD COLUMN hash VARCHAR(44)",
+            "CREATE INDEX items_received ON items (received)",
+            "CREATE INDEX items_sender ON items (sender)",
+        } {
+            _, err := tx.Exec(statement)
+            if err != nil { return err }
+        }
+        return nil
+    }},
+    {4, "Create blobs table of pooled blob references", func(tx *SQLTransaction) error {
+        _, err := tx.Exec(
+        `CREATE TABLE blobs (
+            hash VARCHAR(44) NOT NULL PRIMARY KEY,
+            refs INTEGER NOT NULL,
+            size INTEGER NOT NULL
+        )`)
+        return err
+    }},
+    {5, "Index items by id, dropping duplicates", func(tx *SQLTransaction) error {
+        // keep the first item for each id
+        _, err := tx.Exec("DELETE FROM items WHERE counter NOT IN (SELECT MIN(counter) FROM items GROUP BY id)")
+        if err != nil { return err }
+        _, err = tx.Exec("CREATE UNIQUE INDEX items_id ON items (id)")
+        return err
+    }},
+}
+
+func init() {
+    // the registry must be ordered & end at CurrentSchemaVersion
+    for i, migration := range migrations {
+        if migration.Version != i+1 {
+            panic(fmt.Sprintf("Migration %v has version %v", i+1, migration.Version)) }
+    }
+    if len(migrations) != CurrentSchemaVersion {
+        panic("Migrations do not end at CurrentSchemaVersion") }
+}
+
+// the schema version, or 0 for a new index
+func (this *SQLIndex) schemaVersion() (int, error) {
+    schemaVersion, err := this.SchemaVersion()
+    if err == ErrSchemaUnknown { return 0, nil }
+    return schemaVersion, err
+}
+
+/* Run the migrations this index is missing, returning them.
+ * With dryRun, they are all run in one transaction which is then rolled back,
+ *  to check that they would succeed.
+ * Refuses indexes from newer versions with ErrSchemaTooNew.
+ */
+func (this *SQLIndex) Migrate(dryRun bool) ([]Migration, error) {
+    schemaVersion, err := this.schemaVersion()
+    if err != nil { return nil, err }
+    if schemaVersion > len(migrations) { return nil, ErrSchemaTooNew }
+    pending := migrations[schemaVersion:]
+    if len(pending) == 0 { return pending, nil }
+
+    if dryRun {
+        tx, err := this.begin()
+        if err != nil { return nil, err }
+        defer tx.Rollback()
+        for _, migration := range pending {
+            err = migration.apply(tx)
+            if err != nil { return nil, err }
+        }
+        return pending, nil
+    }
+
+    for _, migration := range pending {
+        log.Printf("Migrating index to version %v: %v", migration.Version, migration.Description)
+        tx, err := this.begin()
+        if err != nil { return nil, err }
+        err = migration.apply(tx)
+        if err == nil {
+            err = tx.Commit()
+        } else {
+            tx.Rollback()
+        }
+        if err != nil { return nil, err }
+    }
+    return pending, nil
+}
+
+func (this Migration) apply(tx *SQLTransaction) error {
+    err := this.Up(tx)
+    if err != nil {
+        return errors.New(fmt.Sprintf("Migration to version %v failed: %v", this.Version, err)) }
+    return tx.Set(MetaSchemaVersion, strconv.Itoa(this.Version))
+}
+
+/* List the migrations the index file needs, checking that they would succeed,
+ *  without changing it.
+ */
+func DryRunMigrations(file string) ([]Migration, error) {
+    _, err := os.Stat(file)
+    if err != nil { return nil, err }
+    db, err := sql.Open("sqlite3", file)
+    if err != nil { return nil, err }
+    defer db.Close()
+    index := &SQLIndex{DB: db}
+    return index.Migrate(true)
+}
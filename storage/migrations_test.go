@@ -0,0 +1,91 @@
+//go:build cgo
+// +build cgo
+
+package storage
+
+import (
+    "os"
+    "fmt"
+    "strconv"
+    "testing"
+    "path/filepath"
+    "github.com/jaekwon/gourami/types"
+)
+
+// SQLIndex needs cgo, so its tests are here rather than with the other indexes'
+
+func TestSQLIndexConformance(t *testing.T) {
+    index, err := NewSQLIndex(filepath.Join(t.TempDir(), "index.sqlite"))
+    if err != nil { t.Fatal(err) }
+    defer index.Close()
+    testIndexConformance(t, index)
+}
+
+func TestMigrations(t *testing.T) {
+    file := "../.testIndex.sqlite"
+    os.Remove(file)
+    defer os.Remove(file)
+
+    index, err := NewSQLIndex(file)
+    if err != nil { t.Fatal(err) }
+    index.AddItem(types.Id(RandomData(32)))
+    index.Close()
+
+    // register a new migration for the duration of the test
+    latest := len(migrations)
+    migrations = append(migrations, Migration{latest+1, "Add items.note", func(tx *SQLTransaction) error {
+        _, err := tx.Exec("ALTER TABLE items ADD COLUMN note VARCHAR(255)")
+        return err
+    }})
+    defer func() { migrations = migrations[:latest] }()
+
+    pending, err := DryRunMigrations(file)
+    if err != nil { t.Fatal(err) }
+    if len(pending) != 1 || pending[0].Version != latest+1 {
+        t.Fatal(fmt.Sprintf("Expected migration %v to be pending, got %v", latest+1, pending))
+    }
+    pending, err = DryRunMigrations(file)
+    if err != nil || len(pending) != 1 {
+        t.Fatal("Expected dry run to leave the index unchanged")
+    }
+
+    index, err = OpenSQLIndex(file)
+    if err != nil { t.Fatal(err) }
+    schemaVersion, _ := index.SchemaVersion()
+    if schemaVersion != latest+1 {
+        t.Fatal(fmt.Sprintf("Expected schema version %v, got %v", latest+1, schemaVersion))
+    }
+    _, err = index.DB.Exec("UPDATE items SET note='migrated'")
+    if err != nil { t.Fatal(err) }
+
+    // an index from the future is refused
+    index.Set(MetaSchemaVersion, strconv.Itoa(latest+2))
+    index.Close()
+    if _, err := OpenSQLIndex(file); err != ErrSchemaTooNew {
+        t.Fatal(fmt.Sprintf("Expected ErrSchemaTooNew, got %v", err))
+    }
+}
+
+// duplicate ids from before version 5 are dropped, keeping the first
+func TestUniqueItemsMigration(t *testing.T) {
+    file := "../.testIndex.sqlite"
+    os.Remove(file)
+    defer os.Remove(file)
+    index, err := NewSQLIndex(file)
+    if err != nil { t.Fatal(err) }
+    id := types.Id(RandomData(32))
+    index.AddItem(id)
+    index.DB.Exec("DROP INDEX items_id")
+    index.DB.Exec("INSERT INTO items (id) VALUES (?)", id.String())
+    index.Set(MetaSchemaVersion, "4")
+    index.Close()
+    index, err = OpenSQLIndex(file)
+    if err != nil { t.Fatal(err) }
+    defer index.Close()
+    var count int
+    index.DB.QueryRow("SELECT COUNT(*) FROM items").Scan(&count)
+    meta, err := index.GetItem(id)
+    if count != 1 || err != nil || meta.Counter != 1 {
+        t.Fatal(fmt.Sprintf("Expected only the first duplicate to be kept, got %v items: %v %v", count, meta, err))
+    }
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+    "io"
+    "io/ioutil"
+    "fmt"
+    "bytes"
+    "strings"
+    "strconv"
+    "net/http"
+    "net/url"
+    "encoding/xml"
+)
+
+/* An ObjectClient talks to an S3-style HTTP object store:
+ *  objects are PUT, GET & DELETEd at Endpoint/key, and large objects are
+ *  uploaded in parts with the S3 multipart API.
+ * Swift speaks the same API through its s3api middleware.
+ * Authorize is called on every request, to sign it or add a token;
+ *  e.g. for Swift, set the X-Auth-Token header.
+ */
+type ObjectClient struct {
+    Endpoint string // the bucket or container URL
+    Client *http.Client
+    Authorize func(req *http.Request) error
+}
+
+func NewObjectClient(endpoint string) *ObjectClient {
+    return &ObjectClient{Endpoint: strings.TrimRight(endpoint, "/"), Client: http.DefaultClient}
+}
+
+/* ObjectError is returned for responses other than 2xx & 404,
+ *  which is returned as ErrNotFound.
+ */
+type ObjectError struct {
+    Method string
+    Key string
+    StatusCode int
+    Message string
+}
+
+func (this *ObjectError) Error() string {
+    return fmt.Sprintf("Object store %v %v failed with status %v: %v", this.Method, this.Key, this.StatusCode, this.Message)
+}
+
+// one uploaded part of a multipart upload
+type ObjectPart struct {
+    PartNumber int
+    ETag string
+}
+
+type initiateMultipartUploadResult struct {
+    UploadId string
+}
+
+type completeMultipartUpload struct {
+    XMLName xml.Name `xml:"CompleteMultipartUpload"`
+    Parts []ObjectPart `xml:"Part"`
+}
+
+// an error returned in the body of a 200 response
+type objectErrorBody struct {
+    XMLName xml.Name `xml:"Error"`
+    Code string
+    Message string
+}
+
+// query is appended as is, e.g. "uploads" or "partNumber=1&uploadId=x"
+func (this *ObjectClient) url(key string, query string) string {
+    u := this.Endpoint + "/" + (&url.URL{Path: key}).EscapedPath()
+    if query != "" { u += "?" + query }
+    return u
+}
+
+// send a request, returning the response if it succeeded
+func (this *ObjectClient) do(method, key, query string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequest(method, this.url(key, query), body)
+    if err != nil { return nil, err }
+    if body != nil { req.ContentLength = size }
+    for name, values := range header {
+        req.Header[name] = values
+    }
+    if this.Authorize != nil {
+        err = this.Authorize(req)
+        if err != nil { return nil, err }
+    }
+    client := this.Client
+    if client == nil { client = http.DefaultClient }
+    res, err := client.Do(req)
+    if err != nil { return nil, err }
+    if res.StatusCode == http.StatusNotFound {
+        drainAndClose(res.Body)
+        return nil, ErrNotFound
+    }
+    if res.StatusCode < 200 || res.StatusCode > 299 {
+        message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+        drainAndClose(res.Body)
+        return nil, &ObjectError{method, key, res.StatusCode, strings.TrimSpace(string(message))}
+    }
+    return res, nil
+}
+
+func drainAndClose(body io.ReadCloser) {
+    io.Copy(ioutil.Discard, io.LimitReader(body, 64 * 1024))
+    body.Close()
+}
+
+func (this *ObjectClient) Put(key string, body io.Reader, size int64) error {
+    res, err := this.do("PUT", key, "", body, size, nil)
+    if err != nil { return err }
+    drainAndClose(res.Body)
+    return nil
+}
+
+/* Get length bytes of the object from offset, or the rest of it if length < 0.
+ * Ranges past the end are cut short, as with HTTP.
+ */
+func (this *ObjectClient) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+    if length == 0 { return ioutil.NopCloser(bytes.NewReader(nil)), nil }
+    header := http.Header{}
+    if length > 0 {
+        header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset + length - 1))
+    } else if offset > 0 {
+        header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+    }
+    res, err := this.do("GET", key, "", nil, 0, header)
+    if err != nil { return nil, err }
+    if header.Get("Range") == "" || res.StatusCode == http.StatusPartialContent {
+        return res.Body, nil
+    }
+    // the server ignored the range, so skip to it ourselves
+    _, err = io.CopyN(ioutil.Discard, res.Body, offset)
+    if err != nil {
+        res.Body.Close()
+        return nil, err
+    }
+    if length < 0 { return res.Body, nil }
+    return struct{ io.Reader; io.Closer }{io.LimitReader(res.Body, length), res.Body}, nil
+}
+
+// returns the size of the object
+func (this *ObjectClient) Head(key string) (int64, error) {
+    res, err := this.do("HEAD", key, "", nil, 0, nil)
+    if err != nil { return -1, err }
+    res.Body.Close()
+    return res.ContentLength, nil
+}
+
+func (this *ObjectClient) Delete(key string) error {
+    res, err := this.do("DELETE", key, "", nil, 0, nil)
+    if err != nil { return err }
+    drainAndClose(res.Body)
+    return nil
+}
+
+// returns the upload id for UploadPart & CompleteMultipartUpload
+func (this *ObjectClient) CreateMultipartUpload(key string) (string, error) {
+    res, err := this.do("POST", key, "uploads", nil, 0, nil)
+    if err != nil { return "", err }
+    defer drainAndClose(res.Body)
+    result := initiateMultipartUploadResult{}
+    err = xml.NewDecoder(res.Body).Decode(&result)
+    if err != nil { return "", err }
+    if result.UploadId == "" {
+        return "", &ObjectError{"POST", key, res.StatusCode, "No UploadId"} }
+    return result.UploadId, nil
+}
+
+// part numbers start at 1
+func (this *ObjectClient) UploadPart(key, uploadId string, partNumber int, body io.Reader, size int64) (ObjectPart, error) {
+    query := "partNumber=" + strconv.Itoa(partNumber) + "&uploadId=" + url.QueryEscape(uploadId)
+    res, err := this.do("PUT", key, query, body, size, nil)
+    if err != nil { return ObjectPart{}, err }
+    drainAndClose(res.Body)
+    return ObjectPart{partNumber, res.Header.Get("ETag")}, nil
+}
+
+func (this *ObjectClient) CompleteMultipartUpload(key, uploadId string, parts []ObjectPart) error {
+    body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+    if err != nil { return err }
+    res, err := this.do("POST", key, "uploadId=" + url.QueryEscape(uploadId), bytes.NewReader(body), int64(len(body)), nil)
+    if err != nil { return err }
+    defer drainAndClose(res.Body)
+    // S3 may report a failure in the body of a 200
+    response, err := ioutil.ReadAll(io.LimitReader(res.Body, 64 * 1024))
+    if err != nil { return err }
+    errorBody := objectErrorBody{}
+    if xml.Unmarshal(response, &errorBody) == nil {
+        return &ObjectError{"POST", key, res.StatusCode, errorBody.Code + ": " + errorBody.Message}
+    }
+    return nil
+}
+
+func (this *ObjectClient) AbortMultipartUpload(key, uploadId string) error {
+    res, err := this.do("DELETE", key, "uploadId=" + url.QueryEscape(uploadId), nil, 0, nil)
+    if err != nil { return err }
+    drainAndClose(res.Body)
+    return nil
+}
+
+/* Upload size bytes from reader, in parts of partSize if larger than that.
+ * A failed multipart upload is aborted, so no parts are left behind.
+ */
+func (this *ObjectClient) Upload(key string, reader io.ReaderAt, size int64, partSize int64) error {
+    if size <= partSize {
+        return this.Put(key, io.NewSectionReader(reader, 0, size), size)
+    }
+    uploadId, err := this.CreateMultipartUpload(key)
+    if err != nil { return err }
+    parts := []ObjectPart{}
+    for offset := int64(0); offset < size; offset += partSize {
+        length := partSize
+        if offset + length > size { length = size - offset }
+        part, err := this.UploadPart(key, uploadId, len(parts) + 1, io.NewSectionReader(reader, offset, length), length)
+        if err != nil {
+            this.AbortMultipartUpload(key, uploadId)
+            return err
+        }
+        parts = append(parts, part)
+    }
+    err = this.CompleteMultipartUpload(key, uploadId, parts)
+    if err != nil {
+        this.AbortMultipartUpload(key, uploadId)
+        return err
+    }
+    return nil
+}
+
+/* An ObjectReaderAt reads an object with ranged GETs.
+ */
+type ObjectReaderAt struct {
+    Client *ObjectClient
+    Key string
+    size int64
+}
+
+func NewObjectReaderAt(client *ObjectClient, key string, size int64) *ObjectReaderAt {
+    return &ObjectReaderAt{client, key, size}
+}
+
+func (this *ObjectReaderAt) Size() int64 {
+    return this.size
+}
+
+// nothing is held open between reads
+func (this *ObjectReaderAt) Close() error {
+    return nil
+}
+
+func (this *ObjectReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+    if offset >= this.size { return 0, io.EOF }
+    length := int64(len(p))
+    if offset + length > this.size { length = this.size - offset }
+    body, err := this.Client.Get(this.Key, offset, length)
+    if err != nil { return 0, err }
+    defer body.Close()
+    n, err := io.ReadFull(body, p[:length])
+    // the object is shorter than its size said
+    if err == io.EOF { err = io.ErrUnexpectedEOF }
+    if err == nil && n < len(p) { err = io.EOF }
+    return n, err
+}
@@ -0,0 +1,372 @@
+package storage
+
+import (
+    "context"
+    "os"
+    "io"
+    "fmt"
+    "bytes"
+    "errors"
+    "strconv"
+    "sync"
+    "time"
+    "path/filepath"
+    "github.com/jaekwon/go-prelude/fs"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* The ObjectStore keeps blobs in an HTTP object store & its Index locally.
+ * Blobs are spooled to TmpDir first, so their ContentId is known & large
+ *  blobs can be uploaded in parts of PartSize (S3 wants at least 5MB).
+ * Objects are named Prefix + id, where Prefix is the owner's key,
+ *  so many owners can share a bucket.
+ */
+type ObjectStore struct {
+    RootDir string
+    TmpDir string
+    Index Index
+    Objects *ObjectClient
+    Prefix string
+    PartSize int64
+
+    // called when a Store pushes usage to or past the soft limit
+    SoftLimitHandler func(store *ObjectStore, used int64, capacity int64)
+
+    mtx sync.Mutex // guards usage accounting
+    usage reservations // bytes being written
+    uploading map[string]bool // ids being uploaded
+}
+
+const DefaultPartSize = 8 * 1024 * 1024
+
+func (this *ObjectStore) ObjectKey(id types.Id) (string, error) {
+    idString, err := id.ToString()
+    if err != nil { return "", err }
+    return this.Prefix + idString, nil
+}
+
+func (this *ObjectStore) Owner() *types.Identity {
+    ownerKey, err := this.Index.Get(MetaOwner)
+    if err != nil { return nil }
+    owner, err := types.StringToIdentity(ownerKey)
+    if err != nil { return nil }
+    return owner
+}
+
+func (this *ObjectStore) Size() (int64, int64) {
+    return indexSize(this.Index)
+}
+
+// returns the soft limit in bytes, or -1 if capacity is unknown
+func (this *ObjectStore) SoftLimit() int64 {
+    return indexSoftLimit(this.Index)
+}
+
+func (this *ObjectStore) SetCapacity(capacity int64) error {
+    return this.Index.Set(MetaCapacity, strconv.FormatInt(capacity, 10))
+}
+
+func (this *ObjectStore) SetSoftLimit(softLimit int64) error {
+    return this.Index.Set(MetaSoftLimit, strconv.FormatInt(softLimit, 10))
+}
+
+func (this *ObjectStore) Store(id types.Id, data []byte) error {
+    return this.StoreReader(id, bytes.NewReader(data), int64(len(data)))
+}
+
+func (this *ObjectStore) StoreReader(id types.Id, reader io.Reader, size int64) error {
+    _, err := this.ObjectKey(id)
+    if err != nil { return err }
+    _, err = this.store(ItemMeta{Id: id, Size: size}, reader)
+    return err
+}
+
+func (this *ObjectStore) StoreContent(reader io.Reader, size int64) (types.Id, error) {
+    return this.store(ItemMeta{Size: size}, reader)
+}
+
+// see OSStore.StoreItem
+func (this *ObjectStore) StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    if meta.Id != nil {
+        if _, err := meta.Id.ToString(); err != nil { return nil, err }
+    }
+    return this.store(meta, reader)
+}
+
+// store under meta.Id, or under the content's id if that is nil
+func (this *ObjectStore) store(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    id, size := meta.Id, meta.Size
+    if size < 0 {
+        return nil, errors.New(fmt.Sprintf("Invalid size %v", size))
+    }
+    err := this.reserve(id, size)
+    if err != nil { return nil, err }
+    defer this.release(size)
+
+    tmpPath, contentId, err := writeTemp(this.TmpDir, reader, size)
+    if err != nil { return nil, err }
+    defer os.Remove(tmpPath)
+    if meta.Hash != nil && !bytes.Equal(meta.Hash, contentId) { return nil, ErrHashMismatch }
+    if id == nil {
+        id = contentId
+    } else if !bytes.Equal(id, contentId) && this.ContentAddressed() {
+        return nil, ErrIdMismatch
+    }
+    key, err := this.ObjectKey(id)
+    if err != nil { return nil, err }
+
+    // claim id for the upload
+    this.mtx.Lock()
+    err = this.checkNew(id)
+    if err == nil { this.uploading[id.String()] = true }
+    this.mtx.Unlock()
+    if err != nil { return nil, err }
+    defer func() {
+        this.mtx.Lock()
+        delete(this.uploading, id.String())
+        this.mtx.Unlock()
+    }()
+
+    file, err := os.Open(tmpPath)
+    if err != nil { return nil, err }
+    err = this.Objects.Upload(key, file, size, this.PartSize)
+    file.Close()
+    if err != nil { return nil, err }
+
+    // record the item & its usage together
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    used, capacity := this.Size()
+    err = addItemUsage(this.Index, ItemMeta{Id: id, Size: size, Received: meta.receivedOrNow(), Sender: meta.Sender, Hash: contentId, Expires: meta.Expires})
+    if err != nil {
+        this.Objects.Delete(key)
+        return nil, err
+    }
+    if this.SoftLimitHandler != nil && crossesSoftLimit(this.Index, used, used + size) {
+        this.SoftLimitHandler(this, used + size, capacity)
+    }
+    return id, nil
+}
+
+// whether id is neither stored nor being uploaded. caller must hold this.mtx
+func (this *ObjectStore) checkNew(id types.Id) error {
+    exists, err := this.Index.HasItem(id)
+    if err != nil { return err }
+    if exists || this.uploading[id.String()] {
+        return errors.New(fmt.Sprintf("Could not store. Id already exists: %v", id))
+    }
+    return nil
+}
+
+// check that id is new & that size fits, counting other writes in progress.
+// a nil id is checked once the content is written.
+func (this *ObjectStore) reserve(id types.Id, size int64) error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if id != nil {
+        err := this.checkNew(id)
+        if err != nil { return err }
+    }
+    return this.usage.reserve(this.Index, size)
+}
+
+func (this *ObjectStore) release(size int64) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    this.usage.release(size)
+}
+
+/* Read the blob for id with ranged GETs.
+ * Unlike an OSStore File, this does not keep the blob from expiring.
+ */
+func (this *ObjectStore) Open(id types.Id) (Blob, error) {
+    key, err := this.ObjectKey(id)
+    if err != nil { return nil, err }
+    size, err := this.Objects.Head(key)
+    if err != nil { return nil, err }
+    return NewObjectReaderAt(this.Objects, key, size), nil
+}
+
+func (this *ObjectStore) Stat(id types.Id) (*ItemMeta, error) {
+    key, err := this.ObjectKey(id)
+    if err != nil { return nil, err }
+    size, err := this.Objects.Head(key)
+    if err != nil { return nil, err }
+    meta, err := this.Index.GetItem(id)
+    if err == ErrNotFound {
+        meta, err = &ItemMeta{Id: id}, nil }
+    if err != nil { return nil, err }
+    meta.Size = size
+    return meta, nil
+}
+
+func (this *ObjectStore) FindItems(ctx context.Context, since int64, limit int) *ItemIterator {
+    return this.Index.FindItems(ctx, since, limit)
+}
+
+func (this *ObjectStore) QueryItems(query ItemQuery) ([]ItemMeta, error) {
+    return this.Index.QueryItems(query)
+}
+
+func (this *ObjectStore) RangeDigests(ctx context.Context) (map[byte]RangeDigest, error) {
+    return ItemRangeDigests(ctx, this)
+}
+
+func (this *ObjectStore) RangeItems(ctx context.Context, prefixes []byte) (map[byte][]ItemMeta, error) {
+    return ItemsInRanges(ctx, this, prefixes)
+}
+
+func (this *ObjectStore) GetItem(id types.Id) (*ItemMeta, error) {
+    return this.Index.GetItem(id)
+}
+
+func (this *ObjectStore) WatchItems(ch chan struct{}) {
+    this.Index.Watch(ch)
+}
+
+func (this *ObjectStore) UnwatchItems(ch chan struct{}) {
+    this.Index.Unwatch(ch)
+}
+
+func (this *ObjectStore) ContentAddressed() bool {
+    value, err := this.Index.Get(MetaContentAddressed)
+    return err == nil && value == "true"
+}
+
+func (this *ObjectStore) SetContentAddressed(contentAddressed bool) error {
+    if contentAddressed {
+        return this.Index.Set(MetaContentAddressed, "true")
+    }
+    return this.Index.Delete(MetaContentAddressed)
+}
+
+// Download the blob for id & check that it is the content it names
+func (this *ObjectStore) Verify(id types.Id) error {
+    key, err := this.ObjectKey(id)
+    if err != nil { return err }
+    body, err := this.Objects.Get(key, 0, -1)
+    if err != nil { return err }
+    defer body.Close()
+    contentId, err := ReaderContentId(body)
+    if err != nil { return err }
+    if !bytes.Equal(id, contentId) { return ErrIdMismatch }
+    return nil
+}
+
+func (this *ObjectStore) SetExpiry(id types.Id, expires time.Time) error {
+    return this.Index.SetExpiry(id, expires)
+}
+
+func (this *ObjectStore) SweepExpired(now time.Time, limit int) (int, error) {
+    ids, err := this.Index.FindExpired(now, limit)
+    if err != nil { return 0, err }
+    removed := 0
+    for _, id := range ids {
+        this.mtx.Lock()
+        existed, err := this.removeItem(id)
+        this.mtx.Unlock()
+        if err != nil { return removed, err }
+        if existed { removed++ }
+    }
+    return removed, nil
+}
+
+/* Remove the object & item for id, crediting its size back to the usage.
+ * The index is updated first, so a failed delete leaves an orphan object
+ *  rather than an item without one. Caller must hold this.mtx.
+ */
+func (this *ObjectStore) removeItem(id types.Id) (bool, error) {
+    key, err := this.ObjectKey(id)
+    if err != nil { return false, err }
+    size, err := this.Objects.Head(key)
+    objectExists := err == nil
+    if err == ErrNotFound {
+        size = 0
+    } else if err != nil {
+        return false, err
+    }
+    itemExisted, err := deleteItemUsage(this.Index, id, size)
+    if err != nil { return false, err }
+    if objectExists {
+        err = this.Objects.Delete(key)
+        if err != nil && err != ErrNotFound { return true, err }
+    }
+    return objectExists || itemExisted, nil
+}
+
+func (this *ObjectStore) Remove(id types.Id) (bool, error) {
+    if _, err := id.ToString(); err != nil { return false, err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.removeItem(id)
+}
+
+func (this *ObjectStore) Close() error {
+    return this.Index.Close()
+}
+
+// Delete every object in the index, then the index itself
+func (this *ObjectStore) Delete() error {
+    items := this.Index.FindItems(context.Background(), 0, -1)
+    defer items.Close()
+    for items.Next() {
+        key, _ := this.ObjectKey(items.Item().Id)
+        err := this.Objects.Delete(key)
+        if err != nil && err != ErrNotFound { return err }
+    }
+    err := items.Err()
+    if err != nil { return err }
+    err = this.Index.Close()
+    if err != nil { return err }
+    return os.RemoveAll(this.RootDir)
+}
+
+/* Create a store with its index in rootDir & its blobs in objects,
+ *  or reuse the existing store in rootDir if it has the same owner.
+ */
+func NewObjectStore(rootDir string, objects *ObjectClient, owner *types.Identity, capacity int64) (Storer, error) {
+    if owner == nil { return nil, errors.New("NewObjectStore expected non-nil owner") }
+    _, err := fs.EnsureDir(rootDir)
+    if err != nil { return nil, err }
+    index, err := OpenIndexIn(rootDir, "index", true)
+    if err != nil { return nil, err }
+    err = initMeta(index, owner, capacity)
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    return newObjectStore(rootDir, objects, index, owner)
+}
+
+/* Open a store previously created with NewObjectStore.
+ * Fails with ErrOwnerMismatch unless the store belongs to owner.
+ */
+func OpenObjectStore(rootDir string, objects *ObjectClient, owner *types.Identity) (*ObjectStore, error) {
+    if owner == nil { return nil, errors.New("OpenObjectStore expected non-nil owner") }
+    index, err := OpenIndexIn(rootDir, "index", false)
+    if err != nil { return nil, err }
+    err = verifyOwner(index, owner)
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    return newObjectStore(rootDir, objects, index, owner)
+}
+
+func newObjectStore(rootDir string, objects *ObjectClient, index Index, owner *types.Identity) (*ObjectStore, error) {
+    store := &ObjectStore{
+        RootDir: rootDir,
+        TmpDir: filepath.Join(rootDir, "tmp"),
+        Index: index,
+        Objects: objects,
+        Prefix: types.KeyToString(owner.PublicKey) + "/",
+        PartSize: DefaultPartSize,
+        uploading: map[string]bool{},
+    }
+    err := cleanDir(store.TmpDir)
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    return store, nil
+}
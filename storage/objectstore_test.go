@@ -0,0 +1,224 @@
+package storage
+
+import (
+    "io"
+    "io/ioutil"
+    "fmt"
+    "bytes"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "net/http"
+    "net/http/httptest"
+    "encoding/xml"
+    "testing"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* fakeObjectServer implements enough of the S3 object API for ObjectStore,
+ *  including multipart uploads & ranged GETs.
+ */
+type fakeObjectServer struct {
+    Token string // required X-Auth-Token, if set
+    FailParts bool
+
+    mtx sync.Mutex
+    objects map[string][]byte
+    uploads map[string]map[int][]byte
+    lastUploadId int
+    multipartUploads int
+    rangedGets int
+}
+
+func newFakeObjectServer(t *testing.T) (*fakeObjectServer, *ObjectClient) {
+    fake := &fakeObjectServer{Token: "secret", objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+    server := httptest.NewServer(fake)
+    t.Cleanup(server.Close)
+    client := NewObjectClient(server.URL + "/bucket")
+    client.Authorize = func(req *http.Request) error {
+        req.Header.Set("X-Auth-Token", "secret")
+        return nil
+    }
+    return fake, client
+}
+
+func etag(data []byte) string {
+    return strconv.Quote(ContentId(data).String())
+}
+
+func (this *fakeObjectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if this.Token != "" && r.Header.Get("X-Auth-Token") != this.Token {
+        http.Error(w, "AccessDenied", http.StatusForbidden)
+        return
+    }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    key := r.URL.Path
+    query := r.URL.Query()
+    uploadId := query.Get("uploadId")
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    switch {
+    case r.Method == "POST" && query.Has("uploads"):
+        this.lastUploadId++
+        uploadId = strconv.Itoa(this.lastUploadId)
+        this.uploads[uploadId] = map[int][]byte{}
+        fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%v</Key><UploadId>%v</UploadId></InitiateMultipartUploadResult>", key, uploadId)
+    case r.Method == "PUT" && uploadId != "":
+        parts, ok := this.uploads[uploadId]
+        if !ok {
+            http.Error(w, "NoSuchUpload", http.StatusNotFound)
+            return
+        }
+        partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+        if this.FailParts && partNumber > 1 {
+            http.Error(w, "InternalError", http.StatusInternalServerError)
+            return
+        }
+        parts[partNumber] = body
+        w.Header().Set("ETag", etag(body))
+    case r.Method == "POST" && uploadId != "":
+        parts, ok := this.uploads[uploadId]
+        if !ok {
+            http.Error(w, "NoSuchUpload", http.StatusNotFound)
+            return
+        }
+        complete := completeMultipartUpload{}
+        err = xml.Unmarshal(body, &complete)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        data := []byte{}
+        for i, part := range complete.Parts {
+            if part.PartNumber != i + 1 || part.ETag != etag(parts[part.PartNumber]) {
+                fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>bad part</Message></Error>")
+                return
+            }
+            data = append(data, parts[part.PartNumber]...)
+        }
+        this.objects[key] = data
+        delete(this.uploads, uploadId)
+        this.multipartUploads++
+        fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%v</Key></CompleteMultipartUploadResult>", key)
+    case r.Method == "DELETE" && uploadId != "":
+        delete(this.uploads, uploadId)
+        w.WriteHeader(http.StatusNoContent)
+    case r.Method == "PUT":
+        this.objects[key] = body
+    case r.Method == "DELETE":
+        if _, ok := this.objects[key]; !ok {
+            http.NotFound(w, r)
+            return
+        }
+        delete(this.objects, key)
+        w.WriteHeader(http.StatusNoContent)
+    case r.Method == "GET" || r.Method == "HEAD":
+        data, ok := this.objects[key]
+        if !ok {
+            http.NotFound(w, r)
+            return
+        }
+        if r.Header.Get("Range") != "" { this.rangedGets++ }
+        http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+    default:
+        http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func TestObjectStoreConformance(t *testing.T) {
+    _, client := newFakeObjectServer(t)
+    testStorerConformance(t, func(owner *types.Identity, capacity int64) (Storer, error) {
+        return NewObjectStore(t.TempDir(), client, owner, capacity)
+    })
+}
+
+func TestObjectStoreMultipart(t *testing.T) {
+    fake, client := newFakeObjectServer(t)
+    rootDir := t.TempDir()
+    storer, err := NewObjectStore(rootDir, client, TestIdentity, 10000)
+    if err != nil { t.Fatal(err) }
+    store := storer.(*ObjectStore)
+    store.PartSize = 100
+
+    data := RandomData(1050)
+    id, err := store.StoreContent(bytes.NewReader(data), int64(len(data)))
+    if err != nil { t.Fatal(err) }
+    if fake.multipartUploads != 1 || len(fake.uploads) != 0 {
+        t.Fatal(fmt.Sprintf("Expected 1 completed multipart upload, got %v with %v pending", fake.multipartUploads, len(fake.uploads)))
+    }
+    small := RandomData(100)
+    err = store.Store(ContentId(small), small)
+    if err != nil { t.Fatal(err) }
+    if fake.multipartUploads != 1 {
+        t.Fatal("Blobs of at most PartSize should be uploaded whole")
+    }
+    if err = store.Verify(id); err != nil { t.Fatal(err) }
+
+    // ranged reads
+    reader, err := store.Open(id)
+    if err != nil { t.Fatal(err) }
+    if reader.Size() != 1050 {
+        t.Fatal("Wrong size. Expected 1050, got", reader.Size())
+    }
+    p := make([]byte, 100)
+    n, err := reader.ReadAt(p, 500)
+    if err != nil || n != 100 || !bytes.Equal(p, data[500:600]) {
+        t.Fatal("ReadAt returned the wrong data:", n, err)
+    }
+    n, err = reader.ReadAt(p, 1000)
+    if err != io.EOF || n != 50 || !bytes.Equal(p[:n], data[1000:]) {
+        t.Fatal("ReadAt past the end should return the rest with io.EOF:", n, err)
+    }
+    section, err := ioutil.ReadAll(io.NewSectionReader(reader, 1, 1048))
+    if err != nil || !bytes.Equal(section, data[1:1049]) {
+        t.Fatal("Reading a section failed:", err)
+    }
+    if fake.rangedGets < 3 {
+        t.Fatal("Expected ranged GETs, got", fake.rangedGets)
+    }
+    // an object shorter than its size is an error, not the end
+    key, _ := store.ObjectKey(id)
+    n, err = NewObjectReaderAt(client, key, 2000).ReadAt(p, 1000)
+    if err != io.ErrUnexpectedEOF || n != 50 {
+        t.Fatal("Expected a short object to fail with io.ErrUnexpectedEOF:", n, err)
+    }
+
+    // a failed part aborts the upload
+    fake.FailParts = true
+    _, err = store.StoreContent(bytes.NewReader(RandomData(300)), 300)
+    if _, ok := err.(*ObjectError); !ok { t.Fatal("Expected an ObjectError, got", err) }
+    fake.FailParts = false
+    if len(fake.uploads) != 0 {
+        t.Fatal("A failed multipart upload was not aborted")
+    }
+    if used, _ := store.Size(); used != 1150 {
+        t.Fatal("Wrong usage. Expected 1150, got", used)
+    }
+
+    // objects are named by owner
+    keys := []string{}
+    for key := range fake.objects { keys = append(keys, key) }
+    sort.Strings(keys)
+    if len(keys) != 2 || (keys[0] != "/bucket/" + key && keys[1] != "/bucket/" + key) {
+        t.Fatal("Wrong object keys:", keys)
+    }
+
+    // reopen
+    store.Close()
+    store, err = OpenObjectStore(rootDir, client, TestIdentity)
+    if err != nil { t.Fatal(err) }
+    if err = store.Verify(id); err != nil { t.Fatal(err) }
+    if err = store.Store(id, data); err == nil {
+        t.Fatal("Expected an error storing an existing id after reopening")
+    }
+    err = store.Delete()
+    if err != nil { t.Fatal(err) }
+    if len(fake.objects) != 0 {
+        t.Fatal("Delete left objects behind:", len(fake.objects))
+    }
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+    "io"
+    "log"
+    "time"
+    "bytes"
+    "errors"
+    "strconv"
+    "context"
+    "crypto/sha256"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Replication
+ * A Replicator mirrors a primary store into a replica, e.g. on a second node.
+ * Pull copies items in the order the primary added them, using their counters
+ *  as a cursor that is saved after each item, so an interrupted pull resumes
+ *  where it stopped. Each copy is verified against the primary's hash.
+ * Counters are assigned before items are committed, so an item can appear
+ *  after the cursor has passed it. Reconcile catches such items, & any others
+ *  missed, by asking the primary for digests of ranges of ids, & then only
+ *  for the items of ranges whose digests differ from the replica's.
+ */
+
+const MetaReplicationCursor string = "meta:replication_cursor"
+
+var ErrReplicaMismatch error = errors.New("Replica does not match the primary's hash")
+
+// what a Replicator copies from, such as any Storer in this package
+type ReplicaSource interface {
+    Open(id types.Id) (Blob, error)
+    QueryItems(query ItemQuery) ([]ItemMeta, error)
+    RangeDigests(ctx context.Context) (map[byte]RangeDigest, error) // see ItemRangeDigests
+    RangeItems(ctx context.Context, prefixes []byte) (map[byte][]ItemMeta, error) // see ItemsInRanges
+}
+
+// what a Replicator copies to
+type ReplicaTarget interface {
+    Storer
+    StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error)
+    QueryItems(query ItemQuery) ([]ItemMeta, error)
+}
+
+// where a Replicator keeps its cursor, usually the replica's index
+type ReplicationState interface {
+    Get(key string) (string, error)
+    Set(key, value string) error
+}
+
+type Replicator struct {
+    Primary ReplicaSource
+    Replica ReplicaTarget
+    State ReplicationState
+    BatchSize int
+    Prune bool // let Reconcile remove items the primary no longer has
+    Interval time.Duration // between pulls, unless the primary signals new items
+    ReconcileInterval time.Duration
+}
+
+const (
+    DefaultReplicationBatchSize = 100
+    DefaultReplicationInterval = time.Minute
+    DefaultReconcileInterval = time.Hour
+)
+
+func NewReplicator(primary ReplicaSource, replica ReplicaTarget, state ReplicationState) *Replicator {
+    return &Replicator{primary, replica, state, DefaultReplicationBatchSize, false,
+        DefaultReplicationInterval, DefaultReconcileInterval}
+}
+
+// the counter of the next item to pull
+func (this *Replicator) Cursor() int64 {
+    return metaInt64(this.State, MetaReplicationCursor, 0)
+}
+
+/* Copy the items added to the primary since the last pull,
+ *  returning the number copied.
+ * Items whose copy does not match the primary's hash are skipped & logged.
+ */
+func (this *Replicator) Pull(ctx context.Context) (int, error) {
+    batchSize := this.BatchSize
+    if batchSize <= 0 { batchSize = DefaultReplicationBatchSize }
+    copied := 0
+    for {
+        items, err := this.Primary.QueryItems(ItemQuery{Since: this.Cursor(), Limit: batchSize})
+        if err != nil { return copied, err }
+        for _, item := range items {
+            if err := ctx.Err(); err != nil { return copied, err }
+            ok, err := this.copyItem(item)
+            if err == ErrReplicaMismatch {
+                log.Printf("Replication of %v failed: %v", item.Id, err)
+            } else if err != nil {
+                return copied, err
+            }
+            if ok { copied++ }
+            err = this.State.Set(MetaReplicationCursor, strconv.FormatInt(item.Counter + 1, 10))
+            if err != nil { return copied, err }
+        }
+        if len(items) < batchSize { return copied, nil }
+    }
+}
+
+// copy an item unless the replica has it, returning whether it was copied
+func (this *Replicator) copyItem(item ItemMeta) (bool, error) {
+    _, err := this.Replica.Stat(item.Id)
+    if err == nil { return false, nil }
+    if err != ErrNotFound { return false, err }
+    blob, err := this.Primary.Open(item.Id)
+    if err == ErrNotFound { return false, nil } // removed since it was listed
+    if err != nil { return false, err }
+    defer blob.Close()
+    // the replica checks the copy against the primary's hash before committing it
+    meta := ItemMeta{Id: item.Id, Size: blob.Size(), Received: item.Received, Sender: item.Sender, Expires: item.Expires, Hash: item.Hash}
+    _, err = this.Replica.StoreItem(meta, io.NewSectionReader(blob, 0, blob.Size()))
+    if err == ErrHashMismatch { return false, ErrReplicaMismatch }
+    if err != nil { return false, err }
+    return true, nil
+}
+
+/* A RangeDigest summarizes the items whose ids start with Prefix.
+ * Stores whose digests for a range are equal hold the same items in it,
+ *  so only the items of differing ranges need to be compared; a remote
+ *  primary need only send its 256 digests to find them.
+ */
+type RangeDigest struct {
+    Prefix byte
+    Count int
+    Digest types.Id // XOR of the SHA-256 of each id & its hash, so any order sums the same
+}
+
+// stores whose items can be listed, such as any Storer in this package
+type itemQuerier interface {
+    QueryItems(query ItemQuery) ([]ItemMeta, error)
+}
+
+/* Digests of the non-empty ranges of the store's items.
+ * The items are read a page at a time, so only the digests are kept.
+ */
+func ItemRangeDigests(ctx context.Context, store itemQuerier) (map[byte]RangeDigest, error) {
+    digests := map[byte]RangeDigest{}
+    items := newItemIterator(ctx, 0, -1, store.QueryItems)
+    defer items.Close()
+    for items.Next() {
+        item := items.Item()
+        if len(item.Id) == 0 { continue }
+        digest, ok := digests[item.Id[0]]
+        if !ok { digest = RangeDigest{item.Id[0], 0, make(types.Id, sha256.Size)} }
+        hasher := sha256.New()
+        hasher.Write(item.Id)
+        hasher.Write(item.Hash)
+        for i, b := range hasher.Sum(nil) { digest.Digest[i] ^= b }
+        digest.Count++
+        digests[item.Id[0]] = digest
+    }
+    return digests, items.Err()
+}
+
+/* The store's items whose ids start with each of prefixes, read in one pass.
+ * Every prefix has an entry, empty if no item starts with it.
+ */
+func ItemsInRanges(ctx context.Context, store itemQuerier, prefixes []byte) (map[byte][]ItemMeta, error) {
+    found := map[byte][]ItemMeta{}
+    for _, prefix := range prefixes { found[prefix] = []ItemMeta{} }
+    if len(prefixes) == 0 { return found, nil }
+    items := newItemIterator(ctx, 0, -1, store.QueryItems)
+    defer items.Close()
+    for items.Next() {
+        item := items.Item()
+        if len(item.Id) == 0 { continue }
+        if inRange, ok := found[item.Id[0]]; ok { found[item.Id[0]] = append(inRange, item) }
+    }
+    return found, items.Err()
+}
+
+/* Copy the items the replica is missing, & replace those whose hash differs
+ *  from the primary's. With Prune, also remove items the primary lacks.
+ * Only the items of ranges whose digests differ are fetched from the primary,
+ *  & each store is read once for all of them.
+ * Returns the numbers of items copied & removed.
+ */
+func (this *Replicator) Reconcile(ctx context.Context) (int, int, error) {
+    primaryDigests, err := this.Primary.RangeDigests(ctx)
+    if err != nil { return 0, 0, err }
+    replicaDigests, err := ItemRangeDigests(ctx, this.Replica)
+    if err != nil { return 0, 0, err }
+    differing := []byte{}
+    for i := 0; i < 256; i++ {
+        prefix := byte(i)
+        primaryDigest, replicaDigest := primaryDigests[prefix], replicaDigests[prefix]
+        if primaryDigest.Count == replicaDigest.Count && bytes.Equal(primaryDigest.Digest, replicaDigest.Digest) { continue }
+        differing = append(differing, prefix)
+    }
+    if len(differing) == 0 { return 0, 0, nil }
+    primaryRanges, err := this.Primary.RangeItems(ctx, differing)
+    if err != nil { return 0, 0, err }
+    replicaRanges, err := ItemsInRanges(ctx, this.Replica, differing)
+    if err != nil { return 0, 0, err }
+    copied, removed := 0, 0
+    for _, prefix := range differing {
+        if err := ctx.Err(); err != nil { return copied, removed, err }
+        primaryItems, replicaItems := primaryRanges[prefix], replicaRanges[prefix]
+        replicaHashes := map[string]types.Id{}
+        for _, item := range replicaItems {
+            replicaHashes[item.Id.String()] = item.Hash
+        }
+        primaryIds := map[string]bool{}
+        for _, item := range primaryItems {
+            primaryIds[item.Id.String()] = true
+            hash, ok := replicaHashes[item.Id.String()]
+            if ok && (item.Hash == nil || bytes.Equal(hash, item.Hash)) { continue }
+            if ok {
+                _, err = this.Replica.Remove(item.Id)
+                if err != nil { return copied, removed, err }
+            }
+            ok, err := this.copyItem(item)
+            if err == ErrReplicaMismatch {
+                log.Printf("Replication of %v failed: %v", item.Id, err)
+            } else if err != nil {
+                return copied, removed, err
+            }
+            if ok { copied++ }
+        }
+        if !this.Prune { continue }
+        for _, item := range replicaItems {
+            if primaryIds[item.Id.String()] { continue }
+            existed, err := this.Replica.Remove(item.Id)
+            if err != nil { return copied, removed, err }
+            if existed { removed++ }
+        }
+    }
+    return copied, removed, nil
+}
+
+// stores that signal new items
+type itemWatcher interface {
+    WatchItems(ch chan struct{})
+    UnwatchItems(ch chan struct{})
+}
+
+/* Pull every Interval, or as soon as the primary signals new items if it
+ *  can, & Reconcile every ReconcileInterval, until ctx is cancelled.
+ */
+func (this *Replicator) Run(ctx context.Context) error {
+    pullTicker := time.NewTicker(this.Interval)
+    defer pullTicker.Stop()
+    reconcileTicker := time.NewTicker(this.ReconcileInterval)
+    defer reconcileTicker.Stop()
+    var added chan struct{} // stays nil, & never ready, unless the primary can be watched
+    if watched, ok := this.Primary.(itemWatcher); ok {
+        added = make(chan struct{}, 1)
+        watched.WatchItems(added)
+        defer watched.UnwatchItems(added)
+    }
+    for {
+        _, err := this.Pull(ctx)
+        if err != nil && err != ctx.Err() {
+            log.Printf("Replication pull failed: %v", err)
+        }
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-pullTicker.C:
+        case <-added:
+        case <-reconcileTicker.C:
+            _, _, err := this.Reconcile(ctx)
+            if err != nil && err != ctx.Err() {
+                log.Printf("Replication reconcile failed: %v", err)
+            }
+        }
+    }
+}
@@ -1,14 +1,17 @@
 package storage
 
 import (
+    "context"
     "os"
+    "io"
     "io/ioutil"
+    "bytes"
+    "crypto/sha256"
     "fmt"
     "errors"
     "strconv"
+    "sync"
     "path/filepath"
-    "encoding/base64"
-    . "github.com/jaekwon/go-prelude"
     "github.com/jaekwon/go-prelude/fs"
     "github.com/jaekwon/gourami/types"
 )
@@ -18,14 +21,62 @@ import (
 type Storer interface {
     Owner() *types.Identity
     Size() (used int64, capacity int64)
+    SoftLimit() int64
     Store(id types.Id, data []byte) error
-    Delete() error
+    StoreReader(id types.Id, reader io.Reader, size int64) error
+    StoreContent(reader io.Reader, size int64) (types.Id, error)
+    Open(id types.Id) (Blob, error) // ErrNotFound if there is no blob for id
+    Stat(id types.Id) (*ItemMeta, error)
+    Remove(id types.Id) (bool, error) // false if there was no such item
+    Close() error
+    Delete() error // the whole store
+}
+
+/* A Blob is a stored item opened for reading, e.g. through a CipherReaderAt.
+ * Close it when done.
+ */
+type Blob interface {
+    io.ReaderAt
+    io.Closer
+    Size() int64
+}
+
+var ErrOwnerMismatch error = errors.New("Store belongs to a different owner")
+var ErrStoreClosed error = errors.New("Store closed")
+
+// Percentage of capacity at which a store warns, unless MetaSoftLimit is set.
+const DefaultSoftLimitPercent = 90
+
+/* CapacityError is returned by Store when a write would exceed the store's capacity.
+ */
+type CapacityError struct {
+    Used int64
+    Capacity int64
+    Requested int64
+}
+
+func (this *CapacityError) Error() string {
+    return fmt.Sprintf("Capacity exceeded: %v of %v bytes used, cannot store %v more", this.Used, this.Capacity, this.Requested)
+}
+
+func IsCapacityError(err error) bool {
+    _, ok := err.(*CapacityError)
+    return ok
+}
+
+/* Is the store at or past its soft limit?
+ * Servers should warn the owner before the store fills up.
+ */
+func OverSoftLimit(store Storer) bool {
+    used, capacity := store.Size()
+    if capacity < 0 { return false }
+    return used >= store.SoftLimit()
 }
 
 /**
  * Storer Implementation
- * NOTE: There is a basic OSStore provided, but users my want
- *  to implement a wrapper to use OpenStack Swift.
+ * NOTE: There is a basic OSStore provided, and an ObjectStore
+ *  for S3 or OpenStack Swift (see objectstore.go).
  */
 
 /* The OSStore works with the OS's filesystem to implement Storer.
@@ -40,128 +91,428 @@ type Storer interface {
 type OSStore struct {
     RootDir string
     DataDir string
-    Index *Index
+    TmpDir string // for writes in progress, on the same filesystem as DataDir
+    JournalDir string // for transactions in progress, likewise
+    Index Index
+    Pool *BlobPool // if set, blobs are deduplicated through it; see dedup.go
+
+    // called when a Store pushes usage to or past the soft limit
+    SoftLimitHandler func(store *OSStore, used int64, capacity int64)
+
+    mtx sync.Mutex // guards usage accounting
+    usage reservations // bytes being written
+    pins map[string]int // open Files by id
+
+    stop chan struct{} // closed by Close & Delete to stop background work
+    stopOnce sync.Once
+    background sync.WaitGroup
 }
 
-func (*OSStore) Owner() *types.Identity {
-    return nil
+func (this *OSStore) Owner() *types.Identity {
+    ownerKey, err := this.Index.Get(MetaOwner)
+    if err != nil { return nil }
+    owner, err := types.StringToIdentity(ownerKey)
+    if err != nil { return nil }
+    return owner
 }
 
 func (this *OSStore) Size() (int64, int64) {
+    return indexSize(this.Index)
+}
+
+// returns the soft limit in bytes, or -1 if capacity is unknown
+func (this *OSStore) SoftLimit() int64 {
+    return indexSoftLimit(this.Index)
+}
+
+func (this *OSStore) SetCapacity(capacity int64) error {
+    return this.Index.Set(MetaCapacity, strconv.FormatInt(capacity, 10))
+}
+
+func (this *OSStore) SetSoftLimit(softLimit int64) error {
+    return this.Index.Set(MetaSoftLimit, strconv.FormatInt(softLimit, 10))
+}
+
+/* Recompute usage from the files in DataDir, e.g. to repair drift after a crash.
+ * Returns the new usage.
+ */
+func (this *OSStore) Recount() (int64, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
     used := int64(0)
-    capstring, err := this.Index.Get(MetaCapacity)
-    if err != nil { return used, int64(-1) }
-    capacity, err := strconv.ParseInt(capstring, 10, 64)
-    if err != nil { return used, int64(-1) }
-    return used, capacity
+    err := this.walkData(func(path string, info os.FileInfo) error {
+        used += info.Size()
+        return nil
+    })
+    if err != nil { return -1, err }
+    err = this.Index.Set(MetaUsed, strconv.FormatInt(used, 10))
+    if err != nil { return -1, err }
+    return used, nil
+}
+
+// read an integer meta value from the index, or def if missing or malformed
+func metaInt64(index metaGetter, key string, def int64) int64 {
+    str, err := index.Get(key)
+    if err != nil { return def }
+    value, err := strconv.ParseInt(str, 10, 64)
+    if err != nil { return def }
+    return value
 }
 
 func (this *OSStore) Store(id types.Id, data []byte) error {
-    path, err := this.PathForId(id)
+    return this.StoreReader(id, bytes.NewReader(data), int64(len(data)))
+}
+
+/* Store exactly size bytes read from reader.
+ * The data is staged & synced, then committed along with its item, so a
+ *  crash never leaves a partial blob under id, nor a blob without its item.
+ * In content-addressed mode, id must be the ContentId of the data.
+ */
+func (this *OSStore) StoreReader(id types.Id, reader io.Reader, size int64) error {
+    _, err := this.PathForId(id)
+    if err != nil { return err }
+    _, err = this.store(ItemMeta{Id: id, Size: size}, reader)
+    return err
+}
+
+/* Store meta.Size bytes read from reader, recording meta.Sender & meta.Expires.
+ * The item is stored under meta.Id, or under its ContentId if meta.Id is nil,
+ *  & that id is returned. meta.Received defaults to now, & is only set
+ *  when copying items from another store.
+ * If meta.Hash is set, the content must have that ContentId, else nothing
+ *  is stored & ErrHashMismatch is returned.
+ * The other fields of meta are set by the store.
+ */
+func (this *OSStore) StoreItem(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    if meta.Id != nil {
+        if _, err := meta.Id.ToString(); err != nil { return nil, err }
+    }
+    return this.store(meta, reader)
+}
+
+// store under meta.Id, or under the content's id if that is nil
+func (this *OSStore) store(meta ItemMeta, reader io.Reader) (types.Id, error) {
+    // the blob & its item are committed together; see journal.go
+    tx, err := this.Begin()
+    if err != nil { return nil, err }
+    id, err := tx.StoreItem(meta, reader)
     if err != nil {
-        return err
+        tx.Rollback()
+        return nil, err
     }
-    // if file exists...
-    if _, err := os.Stat(path); err == nil {
-        return errors.New(fmt.Sprintf("Could not store. File already exists: %v", path))
+    err = tx.Commit()
+    if err != nil { return nil, err }
+    return id, nil
+}
+
+// check that id is new & that size fits, counting other writes in progress.
+// a nil id is checked once the content is written.
+func (this *OSStore) reserve(id types.Id, size int64) error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    if id == nil {
+        // checked later
+    } else if existing, err := this.findPath(id); err == nil {
+        return errors.New(fmt.Sprintf("Could not store. File already exists: %v", existing))
     }
-    err = ioutil.WriteFile(path, data, 0600)
-    return err
+    return this.usage.reserve(this.Index, size)
+}
+
+func (this *OSStore) release(size int64) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    this.usage.release(size)
 }
 
-func (this *OSStore) PathForId(id types.Id) (string, error) {
-    if len(id) != 32 {
-        return "", errors.New(fmt.Sprintf("Id was of the wrong length (expected 32, got %v).", len(id)))
+// write size bytes from reader to a synced temporary file in dir,
+// returning its path & the ContentId of what was written
+func writeTemp(dir string, reader io.Reader, size int64) (string, types.Id, error) {
+    _, err := fs.EnsureDir(dir)
+    if err != nil { return "", nil, err }
+    file, err := ioutil.TempFile(dir, "store-")
+    if err != nil { return "", nil, err }
+    hasher := sha256.New()
+    _, err = io.CopyN(io.MultiWriter(file, hasher), reader, size)
+    if err == io.EOF {
+        err = errors.New(fmt.Sprintf("Could not store. Expected %v bytes", size)) }
+    if err == nil {
+        err = file.Sync() }
+    closeErr := file.Close()
+    if err == nil { err = closeErr }
+    if err != nil {
+        os.Remove(file.Name())
+        return "", nil, err
     }
-    idB64 := base64.URLEncoding.EncodeToString(id)
-    path := filepath.Join(this.DataDir, idB64)
-    return path, nil
+    return file.Name(), types.Id(hasher.Sum(nil)), nil
+}
+
+// sync a directory, so renames into it are durable
+func syncDir(dir string) error {
+    dirFile, err := os.Open(dir)
+    if err != nil { return err }
+    defer dirFile.Close()
+    return dirFile.Sync()
+}
+
+// remove temporary files left behind by writes interrupted by a crash
+func (this *OSStore) cleanTmpDir() error {
+    return cleanDir(this.TmpDir)
+}
+
+func cleanDir(dir string) error {
+    err := os.RemoveAll(dir)
+    if err != nil { return err }
+    _, err = fs.EnsureDir(dir)
+    return err
+}
+
+/* Items are listed & watched through the index.
+ * Together these let a server push new items to their owner.
+ */
+func (this *OSStore) FindItems(ctx context.Context, since int64, limit int) *ItemIterator {
+    return this.Index.FindItems(ctx, since, limit)
+}
+
+func (this *OSStore) QueryItems(query ItemQuery) ([]ItemMeta, error) {
+    return this.Index.QueryItems(query)
+}
+
+func (this *OSStore) RangeDigests(ctx context.Context) (map[byte]RangeDigest, error) {
+    return ItemRangeDigests(ctx, this)
+}
+
+func (this *OSStore) RangeItems(ctx context.Context, prefixes []byte) (map[byte][]ItemMeta, error) {
+    return ItemsInRanges(ctx, this, prefixes)
+}
+
+func (this *OSStore) GetItem(id types.Id) (*ItemMeta, error) {
+    return this.Index.GetItem(id)
+}
+
+func (this *OSStore) WatchItems(ch chan struct{}) {
+    this.Index.Watch(ch)
+}
+
+func (this *OSStore) UnwatchItems(ch chan struct{}) {
+    this.Index.Unwatch(ch)
 }
 
 func (this *OSStore) OpenDataDir() (*os.File, error) {
     return fs.EnsureDirOpen(this.DataDir)
 }
 
-func (this *OSStore) Iterate(ch chan Tuple2) {
-    defer close(ch)
-    dataDirFile, err := this.OpenDataDir()
-    if err != nil {
-        ch <- Tuple2{nil, err}
-        return
+/* Iterate the blobs in the data dir, after the one at cursor,
+ *  or from the first if it is "".
+ */
+func (this *OSStore) Iterate(ctx context.Context, cursor string) *BlobIterator {
+    return newBlobIterator(ctx, this.DataDir, cursor)
+}
+
+/* A File is an open blob. While open, it is not removed by expiry.
+ */
+type File struct {
+    *os.File
+    release func()
+    size int64
+}
+
+func (this *File) Size() int64 {
+    return this.size
+}
+
+func (this *File) Close() error {
+    if this.release != nil {
+        this.release()
+        this.release = nil
     }
-    defer dataDirFile.Close()
-    files, err := dataDirFile.Readdirnames(0)
+    return this.File.Close()
+}
+
+func (this *OSStore) GetFile(id types.Id) (*File, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    path, err := this.findPath(id)
+    if err != nil { return nil, err }
+    file, err := os.Open(path)
+    if err != nil { return nil, err }
+    info, err := file.Stat()
     if err != nil {
-        ch <- Tuple2{nil, err}
-        return
+        file.Close()
+        return nil, err
     }
-    for _, file := range files {
-        idBytes, _ := base64.URLEncoding.DecodeString(file)
-        id := types.Id(idBytes)
-        ch <- Tuple2{id, nil}
-    }
-    return
+    idString := id.String()
+    this.pins[idString]++
+    return &File{file, func() { this.unpin(idString) }, info.Size()}, nil
+}
+
+func (this *OSStore) Open(id types.Id) (Blob, error) {
+    file, err := this.GetFile(id)
+    if os.IsNotExist(err) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    return file, nil
 }
 
-func (this *OSStore) GetFile(id types.Id) (*os.File, error) {
-    path, err := this.PathForId(id)
+/* The item's meta, with the size of its blob.
+ * A blob missing from the index has only its Id & Size set.
+ */
+func (this *OSStore) Stat(id types.Id) (*ItemMeta, error) {
+    path, err := this.findPath(id)
+    var info os.FileInfo
+    if err == nil {
+        info, err = os.Stat(path) }
+    if os.IsNotExist(err) { return nil, ErrNotFound }
+    if err != nil { return nil, err }
+    meta, err := this.Index.GetItem(id)
+    if err == ErrNotFound {
+        meta, err = &ItemMeta{Id: id}, nil }
     if err != nil { return nil, err }
-    return os.Open(path)
+    meta.Size = info.Size()
+    return meta, nil
+}
+
+func (this *OSStore) unpin(idString string) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    this.pins[idString]--
+    if this.pins[idString] <= 0 { delete(this.pins, idString) }
 }
 
+/* Remove the blob & item for id, crediting its size back to the usage,
+ *  in a StoreTransaction so a crash can't leave one without the other.
+ * Open Files can still be read until closed.
+ */
+func (this *OSStore) Remove(id types.Id) (bool, error) {
+    if _, err := id.ToString(); err != nil { return false, err }
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    return this.removeItem(id)
+}
+
+func (this *OSStore) Close() error {
+    this.stopBackground()
+    return this.Index.Close()
+}
+
+// stop background work such as a layout migration, & wait for it to return
+func (this *OSStore) stopBackground() {
+    this.stopOnce.Do(func() {
+        if this.stop != nil { close(this.stop) }
+    })
+    this.background.Wait()
+}
+
+// whether Close or Delete has been called
+func (this *OSStore) stopped() bool {
+    select {
+    case <-this.stop:
+        return true
+    default:
+        return false
+    }
+}
+
+/* Delete the store & everything in it,
+ *  releasing its references to pooled blobs.
+ */
 func (this *OSStore) Delete() error {
+    this.stopBackground()
+    if this.Pool != nil {
+        this.mtx.Lock()
+        err := this.walkData(func(path string, info os.FileInfo) error {
+            var hash types.Id
+            if id, ok := idForName(info.Name()); ok {
+                if meta, err := this.Index.GetItem(id); err == nil { hash = meta.Hash }
+            }
+            return this.removeBlob(hash, path)
+        })
+        this.mtx.Unlock()
+        if err != nil { return err }
+    }
     err := this.Index.Close()
     if err != nil { return err }
     err = os.RemoveAll(this.RootDir)
     return err
 }
 
-func NewOSStore(rootDir string, owner *types.Identity, capacity int64) (Storer, error) {
+/* Create a store, or reuse the existing store in rootDir if it has the same owner.
+ * The capacity of an existing store is kept; use SetCapacity to change it.
+ * pool is the BlobPool to deduplicate blobs through, or nil.
+ */
+func NewOSStore(rootDir string, owner *types.Identity, capacity int64, pool *BlobPool) (Storer, error) {
     var err error
-    dataDir := filepath.Join(rootDir, "data")
-
     if owner == nil { return nil, errors.New("NewOSStore expected non-nil owner") }
 
     _, err = fs.EnsureDir(rootDir)
     if err != nil { return nil, err }
-    _, err = fs.EnsureDir(dataDir)
+    index, err := OpenIndexIn(rootDir, "index", true)
     if err != nil { return nil, err }
-    indexPath := filepath.Join(rootDir, "index.sqlite")
-    index, err := NewIndex(indexPath)
-    if err != nil { return nil, err }
-
-    // set meta
-    index.Set(MetaCapacity, strconv.FormatInt(capacity, 10))
-    index.Set(MetaOwner, types.KeyToString(owner.PublicKey))
 
-    return &OSStore{
-        RootDir: rootDir,
-        DataDir: dataDir,
-        Index: index,
-    }, nil
-}
+    err = initMeta(index, owner, capacity)
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
 
-/* A Storehouser manages many Storers
- */
-type Storehouser interface {
-    AllocateStorer(owner *types.Identity, capacity int64) (Storer, error)
-    GetStorer(owner *types.Identity) (Storer, error)
+    return newOSStore(rootDir, index, pool)
 }
 
-type OSStorehouser struct {
-    RootDir string
+// set a store's meta, unless already set
+func initMeta(index Index, owner *types.Identity, capacity int64) error {
+    err := verifyOwner(index, owner)
+    if err == ErrNotFound {
+        err = index.Set(MetaOwner, types.KeyToString(owner.PublicKey)) }
+    if err == nil {
+        err = index.SetDefault(MetaCapacity, strconv.FormatInt(capacity, 10)) }
+    if err == nil {
+        err = index.SetDefault(MetaUsed, "0") }
+    return err
 }
 
-func (this *OSStorehouser) AllocateStorer(owner *types.Identity, capacity int64) (Storer, error) {
-    return nil, nil
+/* Open a store previously created with NewOSStore, keeping its contents.
+ * Fails with ErrOwnerMismatch unless the store belongs to owner.
+ */
+func OpenOSStore(rootDir string, owner *types.Identity, pool *BlobPool) (*OSStore, error) {
+    if owner == nil { return nil, errors.New("OpenOSStore expected non-nil owner") }
+    index, err := OpenIndexIn(rootDir, "index", false)
+    if err != nil { return nil, err }
+    err = verifyOwner(index, owner)
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    return newOSStore(rootDir, index, pool)
 }
 
-func (this *OSStorehouser) GetStorer(owner *types.Identity) (Storer, error) {
-    return nil, nil
+// returns ErrNotFound if the index has no owner yet
+func verifyOwner(index Index, owner *types.Identity) error {
+    ownerKey, err := index.Get(MetaOwner)
+    if err != nil { return err }
+    if ownerKey != types.KeyToString(owner.PublicKey) { return ErrOwnerMismatch }
+    return nil
 }
 
-func NewOSStorehouser(rootDir string) (Storehouser, error) {
-    _, err := fs.EnsureDir(rootDir)
-    if err != nil { return nil, err }
-    return &OSStorehouser{rootDir}, nil
+// the pool is set before Recover, which may link & release pooled blobs
+func newOSStore(rootDir string, index Index, pool *BlobPool) (*OSStore, error) {
+    store := &OSStore{
+        RootDir: rootDir,
+        DataDir: filepath.Join(rootDir, "data"),
+        TmpDir: filepath.Join(rootDir, "tmp"),
+        JournalDir: filepath.Join(rootDir, "journal"),
+        Index: index,
+        Pool: pool,
+        pins: map[string]int{},
+        stop: make(chan struct{}),
+    }
+    _, err := fs.EnsureDir(store.DataDir)
+    if err == nil {
+        err = store.cleanTmpDir() }
+    if err == nil {
+        err = store.Recover() }
+    if err == nil {
+        err = store.startLayoutMigration() }
+    if err != nil {
+        index.Close()
+        return nil, err
+    }
+    return store, nil
 }
@@ -1,11 +1,18 @@
 package storage
 
 import (
+    "strings"
+    "os"
     "fmt"
+    "io/ioutil"
+    "bytes"
+    "path/filepath"
+    "strconv"
+    "time"
+    "context"
     "testing"
     "crypto/rand"
     "syscall"
-    . "github.com/jaekwon/go-prelude"
     "github.com/jaekwon/gourami/types"
 )
 
@@ -26,7 +33,7 @@ func RandomData(length uint) []byte {
 }
 
 func TestStoreMany(t *testing.T) {
-    store, err := NewOSStore("../.testStore", TestIdentity, 999)
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
 
     if err != nil {
         t.Fatal("Could not create new OSStore:", err)
@@ -41,13 +48,17 @@ func TestStoreMany(t *testing.T) {
         t.Fatal(fmt.Sprintf("Wrong capacity. Expected 999, got %v", capacity))
     }
 
-    // TODO test that the identity is correct
+    // test that the identity is correct
+    owner := store.Owner()
+    if owner == nil || *owner.PublicKey != *TestIdentity.PublicKey {
+        t.Fatal(fmt.Sprintf("Wrong owner. Expected %v, got %v", TestIdentity, owner))
+    }
 
     store.Delete()
 }
 
 func TestIterate(t *testing.T) {
-    store, err := NewOSStore("../.testStore", TestIdentity, 999)
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
 
     if err != nil {
         t.Fatal("Could not create new OSStore:", err)
@@ -62,14 +73,9 @@ func TestIterate(t *testing.T) {
         }
     }
 
-    ch := make(chan Tuple2)
-    go store.(*OSStore).Iterate(ch)
-    for tuple := range ch {
-        id_, err := tuple.Get()
-        id := id_.(types.Id)
-        if err != nil {
-            fmt.Println(err)
-        }
+    blobs := store.(*OSStore).Iterate(context.Background(), "")
+    for blobs.Next() {
+        id := blobs.Id()
         path, err := store.(*OSStore).PathForId(id)
         if err != nil {
             t.Fatal(err)
@@ -81,6 +87,1066 @@ func TestIterate(t *testing.T) {
         }
         fmt.Printf("----> %v (size: %v, blksize:%v)\n", id, stat.Size, stat.Blksize)
     }
+    if blobs.Err() != nil { t.Fatal(blobs.Err()) }
+
+    // resume after the fourth blob
+    blobs = store.(*OSStore).Iterate(context.Background(), "")
+    all := []string{}
+    for blobs.Next() { all = append(all, blobs.Id().String()) }
+    blobs = store.(*OSStore).Iterate(context.Background(), "")
+    for i := 0; i < 4 && blobs.Next(); i++ {}
+    blobs.Close()
+    blobs = store.(*OSStore).Iterate(context.Background(), blobs.Cursor())
+    rest := []string{}
+    for blobs.Next() { rest = append(rest, blobs.Id().String()) }
+    if len(all) != 10 || fmt.Sprint(rest) != fmt.Sprint(all[4:]) {
+        t.Fatal("Iterate did not resume after its cursor:", rest, all)
+    }
 
     store.Delete()
 }
+
+func TestCapacity(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 100, nil)
+    if err != nil {
+        t.Fatal("Could not create new OSStore:", err)
+    }
+    defer store.Delete()
+
+    warned := false
+    store.(*OSStore).SoftLimitHandler = func(_ *OSStore, used int64, capacity int64) {
+        warned = true
+    }
+
+    err = store.Store(RandomData(32), RandomData(60))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if warned || OverSoftLimit(store) {
+        t.Fatal("Soft limit reported too early")
+    }
+    err = store.Store(RandomData(32), RandomData(30))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !warned || !OverSoftLimit(store) {
+        t.Fatal("Expected soft limit warning")
+    }
+    used, _ := store.Size()
+    if used != 90 {
+        t.Fatal(fmt.Sprintf("Wrong used. Expected 90, got %v", used))
+    }
+
+    // this one doesn't fit
+    err = store.Store(RandomData(32), RandomData(20))
+    if !IsCapacityError(err) {
+        t.Fatal(fmt.Sprintf("Expected CapacityError, got %v", err))
+    }
+    used, _ = store.Size()
+    if used != 90 {
+        t.Fatal(fmt.Sprintf("Wrong used after rejection. Expected 90, got %v", used))
+    }
+}
+
+func TestRecount(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil {
+        t.Fatal("Could not create new OSStore:", err)
+    }
+    defer store.Delete()
+    osStore := store.(*OSStore)
+
+    for i:=0; i<3; i++ {
+        err := store.Store(RandomData(32), RandomData(64))
+        if err != nil { t.Fatal(err) }
+    }
+    used, _ := store.Size()
+    if used != 192 {
+        t.Fatal(fmt.Sprintf("Wrong used. Expected 192, got %v", used))
+    }
+
+    // simulate drift
+    osStore.Index.Set(MetaUsed, "5")
+    used, err = osStore.Recount()
+    if err != nil { t.Fatal(err) }
+    if used != 192 {
+        t.Fatal(fmt.Sprintf("Wrong recount. Expected 192, got %v", used))
+    }
+    used, _ = store.Size()
+    if used != 192 {
+        t.Fatal(fmt.Sprintf("Wrong used after recount. Expected 192, got %v", used))
+    }
+}
+
+func TestMigrateLayout(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil {
+        t.Fatal("Could not create new OSStore:", err)
+    }
+    defer store.Delete()
+    osStore := store.(*OSStore)
+
+    // pretend this is an old flat store
+    osStore.Index.Set(MetaLayout, LayoutFlat)
+    ids := []types.Id{}
+    for i:=0; i<5; i++ {
+        id := types.Id(RandomData(32))
+        path, _ := osStore.flatPathForId(id)
+        err := ioutil.WriteFile(path, RandomData(16), 0600)
+        if err != nil { t.Fatal(err) }
+        ids = append(ids, id)
+    }
+    // flat files are still found
+    file, err := osStore.GetFile(ids[0])
+    if err != nil { t.Fatal(err) }
+    file.Close()
+    if store.Store(ids[1], RandomData(16)) == nil {
+        t.Fatal("Expected Store to find the existing flat file")
+    }
+
+    moved, err := osStore.MigrateLayout()
+    if err != nil { t.Fatal(err) }
+    if moved != 5 {
+        t.Fatal(fmt.Sprintf("Expected 5 files moved, got %v", moved))
+    }
+    if osStore.Layout() != LayoutSharded {
+        t.Fatal("Expected store to be sharded")
+    }
+    for _, id := range ids {
+        path, _ := osStore.PathForId(id)
+        if _, err := os.Stat(path); err != nil {
+            t.Fatal(err)
+        }
+    }
+    count := 0
+    blobs := osStore.Iterate(context.Background(), "")
+    for blobs.Next() { count++ }
+    if blobs.Err() != nil { t.Fatal(blobs.Err()) }
+    if count != 5 {
+        t.Fatal(fmt.Sprintf("Expected to iterate 5 files, got %v", count))
+    }
+}
+
+func TestStopLayoutMigration(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, -1, nil)
+    if err != nil { t.Fatal(err) }
+    osStore := store.(*OSStore)
+    osStore.Index.Set(MetaLayout, LayoutFlat)
+    for i:=0; i<500; i++ {
+        path, _ := osStore.flatPathForId(types.Id(RandomData(32)))
+        err := ioutil.WriteFile(path, RandomData(4), 0600)
+        if err != nil { t.Fatal(err) }
+    }
+    store.Close()
+
+    // reopening starts a migration, which Close stops & waits for
+    store, err = NewOSStore("../.testStore", TestIdentity, -1, nil)
+    if err != nil { t.Fatal(err) }
+    err = store.Close()
+    if err != nil { t.Fatal(err) }
+    store, err = NewOSStore("../.testStore", TestIdentity, -1, nil)
+    if err != nil { t.Fatal(err) }
+    err = store.Delete()
+    if err != nil { t.Fatal(err) }
+    if _, err := os.Stat("../.testStore"); !os.IsNotExist(err) {
+        t.Fatal("Expected the migration to stop before the store was deleted:", err)
+    }
+}
+
+func TestStoreReader(t *testing.T) {
+    // a crashed write leaves a temp file behind
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    osStore := store.(*OSStore)
+    err = ioutil.WriteFile(filepath.Join(osStore.TmpDir, "store-orphan"), RandomData(10), 0600)
+    if err != nil { t.Fatal(err) }
+    store.Close()
+    store, err = NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    defer store.Delete()
+    osStore = store.(*OSStore)
+    if _, err := os.Stat(filepath.Join(osStore.TmpDir, "store-orphan")); !os.IsNotExist(err) {
+        t.Fatal("Expected orphaned temp file to be removed")
+    }
+
+    // short reads are rejected & leave nothing behind
+    id := types.Id(RandomData(32))
+    err = store.StoreReader(id, bytes.NewReader(RandomData(10)), 20)
+    if err == nil {
+        t.Fatal("Expected short read to fail")
+    }
+    if _, err := osStore.GetFile(id); !os.IsNotExist(err) {
+        t.Fatal("Expected no file after failed store")
+    }
+    tmpFiles, _ := ioutil.ReadDir(osStore.TmpDir)
+    if len(tmpFiles) != 0 {
+        t.Fatal("Expected temp file to be removed")
+    }
+
+    data := RandomData(100)
+    err = store.StoreReader(id, bytes.NewReader(data), 100)
+    if err != nil { t.Fatal(err) }
+    file, err := osStore.GetFile(id)
+    if err != nil { t.Fatal(err) }
+    defer file.Close()
+    stored, _ := ioutil.ReadAll(file)
+    if !bytes.Equal(stored, data) {
+        t.Fatal("Stored data differs")
+    }
+    used, _ := store.Size()
+    if used != 100 {
+        t.Fatal(fmt.Sprintf("Wrong used. Expected 100, got %v", used))
+    }
+}
+
+func TestContentAddressed(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    defer store.Delete()
+    osStore := store.(*OSStore)
+
+    // any id goes by default, but can be caught by Verify
+    garbage := types.Id(RandomData(32))
+    err = store.Store(garbage, RandomData(10))
+    if err != nil { t.Fatal(err) }
+    if osStore.Verify(garbage) != ErrIdMismatch {
+        t.Fatal("Expected Verify to catch the wrong id")
+    }
+
+    err = osStore.SetContentAddressed(true)
+    if err != nil { t.Fatal(err) }
+    if store.Store(types.Id(RandomData(32)), RandomData(10)) != ErrIdMismatch {
+        t.Fatal("Expected content-addressed store to reject the wrong id")
+    }
+    data := RandomData(10)
+    err = store.Store(ContentId(data), data)
+    if err != nil { t.Fatal(err) }
+
+    data = RandomData(20)
+    id, err := store.StoreContent(bytes.NewReader(data), 20)
+    if err != nil { t.Fatal(err) }
+    if !bytes.Equal(id, ContentId(data)) {
+        t.Fatal("StoreContent returned the wrong id")
+    }
+    if err := osStore.Verify(id); err != nil {
+        t.Fatal(err)
+    }
+    // storing the same content again is refused
+    _, err = store.StoreContent(bytes.NewReader(data), 20)
+    if err == nil {
+        t.Fatal("Expected duplicate content to be refused")
+    }
+    used, _ := store.Size()
+    if used != 40 {
+        t.Fatal(fmt.Sprintf("Wrong used. Expected 40, got %v", used))
+    }
+}
+
+func TestStorehouser(t *testing.T) {
+    rootDir := "../.testStorehouse"
+    os.RemoveAll(rootDir)
+    defer os.RemoveAll(rootDir)
+    owner := types.GenerateIdentity()
+
+    storehouser, err := NewOSStorehouser(rootDir)
+    if err != nil { t.Fatal(err) }
+    if store, _ := storehouser.GetStorer(owner); store != nil {
+        t.Fatal("Expected no store before allocation")
+    }
+    store, err := storehouser.AllocateStorer(owner, 500)
+    if err != nil { t.Fatal(err) }
+    if _, err := storehouser.AllocateStorer(owner, 500); err != ErrAlreadyAllocated {
+        t.Fatal(fmt.Sprintf("Expected ErrAlreadyAllocated, got %v", err))
+    }
+    data := RandomData(50)
+    err = store.Store(ContentId(data), data)
+    if err != nil { t.Fatal(err) }
+    storehouser.Close()
+
+    // reopen
+    storehouser, err = NewOSStorehouser(rootDir)
+    if err != nil { t.Fatal(err) }
+    defer storehouser.Close()
+    store, err = storehouser.GetStorer(owner)
+    if err != nil { t.Fatal(err) }
+    if store == nil { t.Fatal("Expected to find the store again") }
+    used, capacity := store.Size()
+    if used != 50 || capacity != 500 {
+        t.Fatal(fmt.Sprintf("Wrong size after reopening: %v of %v", used, capacity))
+    }
+    allocations, err := storehouser.(*OSStorehouser).Allocations()
+    if err != nil { t.Fatal(err) }
+    if len(allocations) != 1 || allocations[types.KeyToString(owner.PublicKey)] != 500 {
+        t.Fatal(fmt.Sprintf("Wrong allocations: %v", allocations))
+    }
+
+    err = storehouser.DeallocateStorer(owner)
+    if err != nil { t.Fatal(err) }
+    if store, _ := storehouser.GetStorer(owner); store != nil {
+        t.Fatal("Expected no store after deallocation")
+    }
+    if _, err := storehouser.AllocateStorer(owner, 500); err != nil {
+        t.Fatal("Expected to allocate again after deallocation:", err)
+    }
+}
+
+func TestDedup(t *testing.T) {
+    rootDir := "../.testStorehouse"
+    os.RemoveAll(rootDir)
+    defer os.RemoveAll(rootDir)
+    storehouser, err := NewOSStorehouser(rootDir)
+    if err != nil { t.Fatal(err) }
+    defer storehouser.Close()
+    pool := storehouser.(*OSStorehouser).Pool
+    alice, bob := types.GenerateIdentity(), types.GenerateIdentity()
+    aliceStore, err := storehouser.AllocateStorer(alice, 500)
+    if err != nil { t.Fatal(err) }
+    bobStore, err := storehouser.AllocateStorer(bob, 500)
+    if err != nil { t.Fatal(err) }
+
+    // the same body for both, & again under another id
+    data := RandomData(100)
+    id, err := aliceStore.StoreContent(bytes.NewReader(data), 100)
+    if err != nil { t.Fatal(err) }
+    _, err = bobStore.StoreContent(bytes.NewReader(data), 100)
+    if err != nil { t.Fatal(err) }
+    otherId := types.Id(RandomData(32))
+    err = bobStore.Store(otherId, data)
+    if err != nil { t.Fatal(err) }
+    blobs, size, err := pool.Usage()
+    if err != nil || blobs != 1 || size != 100 {
+        t.Fatal(fmt.Sprintf("Expected one pooled blob of 100 bytes, got %v of %v: %v", blobs, size, err))
+    }
+    if refs, _ := pool.Index.BlobRefs(id); refs != 3 {
+        t.Fatal("Expected 3 references, got", refs)
+    }
+    // each owner is charged in full
+    if used, _ := aliceStore.Size(); used != 100 {
+        t.Fatal("Wrong usage for alice:", used)
+    }
+    if used, _ := bobStore.Size(); used != 200 {
+        t.Fatal("Wrong usage for bob:", used)
+    }
+
+    // the blob outlives all but the last reference
+    poolPath, _ := pool.PathForHash(id)
+    if _, err := aliceStore.Remove(id); err != nil { t.Fatal(err) }
+    if _, err := bobStore.Remove(otherId); err != nil { t.Fatal(err) }
+    if _, err := os.Stat(poolPath); err != nil { t.Fatal("Pooled blob removed too early:", err) }
+    blob, err := bobStore.Open(id)
+    if err != nil { t.Fatal(err) }
+    read := make([]byte, 100)
+    if _, err := blob.ReadAt(read, 0); err != nil || !bytes.Equal(read, data) {
+        t.Fatal("Could not read the remaining reference:", err)
+    }
+    blob.Close()
+    if used, _ := bobStore.Size(); used != 100 {
+        t.Fatal("Wrong usage for bob after removal:", used)
+    }
+
+    // deallocating releases the store's references
+    err = storehouser.DeallocateStorer(bob)
+    if err != nil { t.Fatal(err) }
+    if _, err := os.Stat(poolPath); !os.IsNotExist(err) {
+        t.Fatal("Expected the pooled blob to be removed with its last reference")
+    }
+    if blobs, size, _ := pool.Usage(); blobs != 0 || size != 0 {
+        t.Fatal(fmt.Sprintf("Expected an empty pool, got %v of %v", blobs, size))
+    }
+}
+
+func TestReopen(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    data := RandomData(64)
+    id := ContentId(data)
+    err = store.Store(id, data)
+    if err != nil { t.Fatal(err) }
+    store.Close()
+
+    // reopening keeps the contents & meta
+    reopened, err := OpenOSStore("../.testStore", TestIdentity, nil)
+    if err != nil { t.Fatal(err) }
+    used, capacity := reopened.Size()
+    if used != 64 || capacity != 999 {
+        t.Fatal(fmt.Sprintf("Wrong size after reopening: %v of %v", used, capacity))
+    }
+    file, err := reopened.GetFile(id)
+    if err != nil { t.Fatal(err) }
+    file.Close()
+    reopened.Close()
+
+    // so does NewOSStore, unless asked
+    store, err = NewOSStore("../.testStore", TestIdentity, 5000, nil)
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll("../.testStore")
+    used, capacity = store.Size()
+    if used != 64 || capacity != 999 {
+        t.Fatal(fmt.Sprintf("Meta was overwritten: %v of %v", used, capacity))
+    }
+    err = store.(*OSStore).SetCapacity(5000)
+    if err != nil { t.Fatal(err) }
+    if _, capacity = store.Size(); capacity != 5000 {
+        t.Fatal(fmt.Sprintf("Expected capacity 5000, got %v", capacity))
+    }
+    store.Close()
+
+    // someone else's store
+    if _, err := OpenOSStore("../.testStore", types.GenerateIdentity(), nil); err != ErrOwnerMismatch {
+        t.Fatal(fmt.Sprintf("Expected ErrOwnerMismatch, got %v", err))
+    }
+    if _, err := NewOSStore("../.testStore", types.GenerateIdentity(), 999, nil); err != ErrOwnerMismatch {
+        t.Fatal(fmt.Sprintf("Expected ErrOwnerMismatch, got %v", err))
+    }
+    if _, err := OpenOSStore("../.testStoreMissing", TestIdentity, nil); err == nil {
+        t.Fatal("Expected opening a missing store to fail")
+    }
+}
+
+/* Commit tx up to a step, as if the process then crashed: 0 before the
+ *  journal is written, 1 after, 2 after placing the blobs, 3 after the index.
+ */
+func crashCommit(t *testing.T, store *OSStore, tx *StoreTransaction, step int) {
+    store.mtx.Lock()
+    defer store.mtx.Unlock()
+    journal, err := tx.journal()
+    if err != nil { t.Fatal(err) }
+    if step > 0 {
+        err = writeJournal(tx.dir, journal) }
+    for _, put := range journal.Puts {
+        if step > 1 && err == nil {
+            err = store.placeBlob(tx.dir, put) }
+    }
+    if step > 2 && err == nil {
+        err = store.applyJournalIndex(MetaJournalPrefix + filepath.Base(tx.dir), journal) }
+    if err != nil { t.Fatal(err) }
+}
+
+func TestPooledRecovery(t *testing.T) {
+    rootDir := t.TempDir()
+    storehouser, err := NewOSStorehouser(rootDir)
+    if err != nil { t.Fatal(err) }
+    alice, bob := types.GenerateIdentity(), types.GenerateIdentity()
+    aliceStore, _ := storehouser.AllocateStorer(alice, 500)
+    bobStore, _ := storehouser.AllocateStorer(bob, 500)
+    data := RandomData(100)
+    hash := ContentId(data)
+    aliceId := types.Id(RandomData(32))
+    aliceStore.Store(aliceId, data)
+    bobStore.Store(types.Id(RandomData(32)), data)
+    reopen := func() *OSStore {
+        storehouser.Close()
+        storehouser, err = NewOSStorehouser(rootDir)
+        if err != nil { t.Fatal(err) }
+        store, err := storehouser.GetStorer(alice)
+        if err != nil { t.Fatal(err) }
+        return store.(*OSStore)
+    }
+    refs := func() int64 {
+        refs, err := storehouser.(*OSStorehouser).Pool.Index.BlobRefs(hash)
+        if err != nil { t.Fatal(err) }
+        return refs
+    }
+
+    // a put whose blob went into the pool before the crash
+    tx, _ := aliceStore.(*OSStore).Begin()
+    otherId, _ := tx.StoreItem(ItemMeta{Id: types.Id(RandomData(32)), Size: 100}, bytes.NewReader(data))
+    crashCommit(t, aliceStore.(*OSStore), tx, 1)
+    store := reopen()
+    if _, err := store.Stat(otherId); err != nil { t.Fatal("Put was not rolled forward:", err) }
+    if refs() != 3 {
+        t.Fatal("Expected 3 references after rolling a put forward, got", refs())
+    }
+
+    // a remove that crashed before releasing its blob
+    tx, _ = store.Begin()
+    tx.Remove(aliceId)
+    crashCommit(t, store, tx, 3)
+    store = reopen()
+    if _, err := store.Stat(aliceId); err != ErrNotFound { t.Fatal("Remove was not rolled forward:", err) }
+    if refs() != 2 {
+        t.Fatal("Expected 2 references after rolling a remove forward, got", refs())
+    }
+    storehouser.Close()
+}
+
+func TestStoreTransaction(t *testing.T) {
+    rootDir := t.TempDir()
+    store, err := NewOSStore(rootDir, TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    osStore := store.(*OSStore)
+    oldId := types.Id(RandomData(32))
+    err = store.Store(oldId, RandomData(50))
+    if err != nil { t.Fatal(err) }
+
+    // nothing shows until Commit
+    tx, err := osStore.Begin()
+    if err != nil { t.Fatal(err) }
+    id, err := tx.StoreItem(ItemMeta{Size: 100, Sender: "someone"}, bytes.NewReader(RandomData(100)))
+    if err != nil { t.Fatal(err) }
+    if _, err := tx.StoreItem(ItemMeta{Id: id, Size: 10}, bytes.NewReader(RandomData(10))); err == nil {
+        t.Fatal("Expected an error staging an id twice")
+    }
+    tx.Remove(oldId)
+    tx.Set("cursor", "7")
+    if _, err := store.Stat(id); err != ErrNotFound {
+        t.Fatal("A staged item was visible before Commit:", err)
+    }
+    err = tx.Commit()
+    if err != nil { t.Fatal(err) }
+    if meta, err := store.Stat(id); err != nil || meta.Sender != "someone" {
+        t.Fatal("Committed item is missing or lost its meta:", meta, err)
+    }
+    if _, err := store.Stat(oldId); err != ErrNotFound {
+        t.Fatal("Removed item is still there:", err)
+    }
+    if used, _ := store.Size(); used != 100 {
+        t.Fatal("Expected usage 100, got", used)
+    }
+    if value, _ := osStore.Index.Get("cursor"); value != "7" {
+        t.Fatal("Meta was not committed, got", value)
+    }
+    if tx.Commit() != ErrTransactionDone {
+        t.Fatal("Expected ErrTransactionDone committing twice")
+    }
+
+    // Rollback drops the staged blobs
+    tx, _ = osStore.Begin()
+    rolledBack, _ := tx.StoreItem(ItemMeta{Size: 20}, bytes.NewReader(RandomData(20)))
+    err = tx.Rollback()
+    if err != nil { t.Fatal(err) }
+    if _, err := store.Stat(rolledBack); err != ErrNotFound {
+        t.Fatal("Rolled back item is there:", err)
+    }
+    if infos, _ := ioutil.ReadDir(osStore.JournalDir); len(infos) != 0 {
+        t.Fatal("Transactions left behind:", len(infos))
+    }
+
+    // Remove commits a transaction of its own
+    if existed, err := store.Remove(id); err != nil || !existed {
+        t.Fatal("Expected Remove to find the item:", existed, err)
+    }
+    if used, _ := store.Size(); used != 0 {
+        t.Fatal("Expected usage 0 after Remove, got", used)
+    }
+    if existed, err := store.Remove(id); err != nil || existed {
+        t.Fatal("Expected nothing left to remove:", existed, err)
+    }
+    if infos, _ := ioutil.ReadDir(osStore.JournalDir); len(infos) != 0 {
+        t.Fatal("Removals left transactions behind:", len(infos))
+    }
+
+    // crashes, at each step of a commit
+    crash := func(step int) (types.Id, types.Id) {
+        removed := types.Id(RandomData(32))
+        store.Store(removed, RandomData(30))
+        tx, _ := osStore.Begin()
+        stored, _ := tx.StoreItem(ItemMeta{Size: 40}, bytes.NewReader(RandomData(40)))
+        tx.Remove(removed)
+        crashCommit(t, osStore, tx, step)
+        return stored, removed
+    }
+    for step := 0; step < 4; step++ {
+        used, _ := store.Size()
+        stored, removed := crash(step)
+        store.Close()
+        store, err = OpenOSStore(rootDir, TestIdentity, nil)
+        if err != nil { t.Fatal(err) }
+        osStore = store.(*OSStore)
+        _, storedErr := store.Stat(stored)
+        _, removedErr := store.Stat(removed)
+        newUsed, _ := store.Size()
+        if step == 0 {
+            // rolled back
+            if storedErr != ErrNotFound || removedErr != nil || newUsed != used + 30 {
+                t.Fatal(fmt.Sprintf("Step %v was not rolled back: %v, %v, usage %v", step, storedErr, removedErr, newUsed))
+            }
+            continue
+        }
+        // rolled forward, exactly once
+        indexed, _ := osStore.Index.HasItem(stored)
+        if storedErr != nil || !indexed || removedErr != ErrNotFound || newUsed != used + 40 {
+            t.Fatal(fmt.Sprintf("Step %v was not rolled forward: %v, %v, %v, usage %v", step, storedErr, indexed, removedErr, newUsed))
+        }
+        if infos, _ := ioutil.ReadDir(osStore.JournalDir); len(infos) != 0 {
+            t.Fatal("Recovered transactions left behind:", len(infos))
+        }
+        if markers := osStore.Index.Find(context.Background(), MetaJournalPrefix, 1); markers.Next() && strings.HasPrefix(markers.Key(), MetaJournalPrefix) {
+            t.Fatal("Recovered transaction left its marker:", markers.Key())
+        }
+    }
+    store.Close()
+}
+
+func TestExpiry(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    defer store.Delete()
+    osStore := store.(*OSStore)
+
+    now := time.Now()
+    ids := []types.Id{}
+    for i:=0; i<4; i++ {
+        id, err := store.StoreContent(bytes.NewReader(RandomData(10)), 10)
+        if err != nil { t.Fatal(err) }
+        ids = append(ids, id)
+    }
+    osStore.SetExpiry(ids[0], now.Add(-time.Hour))
+    osStore.SetExpiry(ids[1], now.Add(-time.Minute))
+    osStore.SetExpiry(ids[2], now.Add(time.Hour))
+    // ids[3] never expires
+
+    // an open file is not swept, nor holds up those expiring after it
+    file, err := osStore.GetFile(ids[0])
+    if err != nil { t.Fatal(err) }
+    sweeper := &Sweeper{osStore, time.Hour, 1, 0}
+    removed, err := sweeper.Sweep(context.Background())
+    if err != nil { t.Fatal(err) }
+    if removed != 1 {
+        t.Fatal(fmt.Sprintf("Expected 1 removed, got %v", removed))
+    }
+    file.Close()
+    removed, err = sweeper.Sweep(context.Background())
+    if err != nil { t.Fatal(err) }
+    if removed != 1 {
+        t.Fatal(fmt.Sprintf("Expected 1 removed after closing, got %v", removed))
+    }
+
+    for i, id := range ids {
+        _, err := osStore.GetFile(id)
+        if (i < 2) != os.IsNotExist(err) {
+            t.Fatal(fmt.Sprintf("Wrong existence of item %v: %v", i, err))
+        }
+    }
+    used, _ := store.Size()
+    if used != 20 {
+        t.Fatal(fmt.Sprintf("Wrong used after expiry. Expected 20, got %v", used))
+    }
+}
+
+func TestStorehouserSweep(t *testing.T) {
+    root := t.TempDir()
+    storehouser, err := NewOSStorehouser(root)
+    if err != nil { t.Fatal(err) }
+    for i:=0; i<3; i++ {
+        store, err := storehouser.AllocateStorer(types.GenerateIdentity(), 999)
+        if err != nil { t.Fatal(err) }
+        for j:=0; j<2; j++ {
+            id, err := store.StoreContent(bytes.NewReader(RandomData(10)), 10)
+            if err != nil { t.Fatal(err) }
+            store.(*OSStore).SetExpiry(id, time.Now().Add(-time.Hour))
+        }
+    }
+    storehouser.Close()
+
+    storehouser, err = NewOSStorehouser(root)
+    if err != nil { t.Fatal(err) }
+    defer storehouser.Close()
+    osStorehouser := storehouser.(*OSStorehouser)
+    // each batch moves on to the next store, & opens none for good
+    swept := map[string]int{}
+    for i:=0; i<3; i++ {
+        cursor := osStorehouser.sweepCursor
+        removed, err := osStorehouser.SweepExpired(time.Now(), 1)
+        if err != nil || removed != 1 {
+            t.Fatal(fmt.Sprintf("Expected 1 removed, got %v: %v", removed, err))
+        }
+        if len(osStorehouser.stores) != 0 { t.Fatal("Sweeping left stores open") }
+        swept[cursor]++
+    }
+    if len(swept) != 3 { t.Fatal("Expected each batch to start at another store:", swept) }
+    removed, err := osStorehouser.SweepExpired(time.Now(), 10)
+    if err != nil || removed != 3 {
+        t.Fatal(fmt.Sprintf("Expected the other 3 removed, got %v: %v", removed, err))
+    }
+}
+
+func TestFsck(t *testing.T) {
+    store, err := NewOSStore("../.testStore", TestIdentity, 999, nil)
+    if err != nil { t.Fatal(err) }
+    defer store.Delete()
+    osStore := store.(*OSStore)
+
+    ids := []types.Id{}
+    for i:=0; i<3; i++ {
+        id, err := store.StoreContent(bytes.NewReader(RandomData(10)), 10)
+        if err != nil { t.Fatal(err) }
+        ids = append(ids, id)
+    }
+    // a file with no item
+    unindexed := types.Id(RandomData(32))
+    path, _ := osStore.PathForId(unindexed)
+    os.MkdirAll(filepath.Dir(path), 0700)
+    ioutil.WriteFile(path, RandomData(20), 0600)
+    // an item with no file
+    path, _ = osStore.findPath(ids[0])
+    os.Remove(path)
+    // a file in the wrong shard
+    path, _ = osStore.findPath(ids[1])
+    misplaced := filepath.Join(osStore.DataDir, filepath.Base(path))
+    os.Rename(path, misplaced)
+    // a name that decodes, but not into an id
+    badName := filepath.Join(osStore.DataDir, "00", "garbage")
+    os.MkdirAll(filepath.Dir(badName), 0700)
+    ioutil.WriteFile(badName, RandomData(5), 0600)
+
+    blobs := osStore.Iterate(context.Background(), "")
+    for blobs.Next() {
+        if len(blobs.Id()) != 32 { t.Fatal("Iterate returned a bad id:", blobs.Id()) }
+    }
+
+    kinds := func(report *FsckReport) map[string]int {
+        kinds := map[string]int{}
+        for _, problem := range report.Problems { kinds[problem.Kind]++ }
+        return kinds
+    }
+    report, err := osStore.Fsck(FsckOptions{})
+    if err != nil { t.Fatal(err) }
+    expected := map[string]int{ProblemUnindexed: 1, ProblemMissing: 1, ProblemMisplaced: 1, ProblemBadName: 1, ProblemUsage: 1}
+    if fmt.Sprint(kinds(report)) != fmt.Sprint(expected) {
+        t.Fatal("Wrong problems:", report.Problems)
+    }
+    if _, err := os.Stat(badName); err != nil { t.Fatal("A report-only fsck changed files") }
+
+    report, err = osStore.Fsck(FsckRebuild)
+    if err != nil { t.Fatal(err) }
+    for _, problem := range report.Problems {
+        if !problem.Repaired { t.Fatal("Not repaired:", problem) }
+    }
+    if report.Files != 3 || report.Used != 40 {
+        t.Fatal(fmt.Sprintf("Wrong totals: %v files, %v bytes", report.Files, report.Used))
+    }
+    report, err = osStore.Fsck(FsckOptions{})
+    if err != nil { t.Fatal(err) }
+    if len(report.Problems) != 0 || report.Items != 3 {
+        t.Fatal("Problems left after rebuilding:", report.Problems, report.Items)
+    }
+    if used, _ := store.Size(); used != 40 {
+        t.Fatal(fmt.Sprintf("Wrong used after rebuilding. Expected 40, got %v", used))
+    }
+    if _, err := os.Stat(filepath.Join(osStore.RootDir, "lost+found", "garbage")); err != nil {
+        t.Fatal("Bad name was not quarantined:", err)
+    }
+
+    // a file that changed size
+    path, _ = osStore.findPath(ids[2])
+    ioutil.WriteFile(path, RandomData(15), 0600)
+    report, err = osStore.Fsck(FsckOptions{FixUsage: true})
+    if err != nil { t.Fatal(err) }
+    if fmt.Sprint(kinds(report)) != fmt.Sprint(map[string]int{ProblemSize: 1, ProblemUsage: 1}) {
+        t.Fatal("Wrong problems for a changed file:", report.Problems)
+    }
+    if meta, _ := osStore.GetItem(ids[2]); meta.Size != 15 {
+        t.Fatal("Item size was not fixed:", meta.Size)
+    }
+
+    // a second copy outside the shard is not counted twice
+    path, _ = osStore.findPath(ids[1])
+    duplicate := filepath.Join(osStore.DataDir, filepath.Base(path))
+    data, _ := ioutil.ReadFile(path)
+    ioutil.WriteFile(duplicate, data, 0600)
+    report, err = osStore.Fsck(FsckOptions{FixUsage: true})
+    if err != nil { t.Fatal(err) }
+    if fmt.Sprint(kinds(report)) != fmt.Sprint(map[string]int{ProblemDuplicate: 1}) {
+        t.Fatal("Wrong problems for a duplicate:", report.Problems)
+    }
+    if used, _ := store.Size(); used != report.Used || report.Files != 3 {
+        t.Fatal(fmt.Sprintf("Duplicate was counted: %v files, %v bytes, %v recorded", report.Files, report.Used, used))
+    }
+    report, err = osStore.Fsck(FsckOptions{QuarantineDuplicates: true})
+    if err != nil { t.Fatal(err) }
+    if len(report.Problems) != 1 || !report.Problems[0].Repaired {
+        t.Fatal("Duplicate was not quarantined:", report.Problems)
+    }
+    if _, err := os.Stat(duplicate); !os.IsNotExist(err) { t.Fatal("Duplicate was left in place") }
+    if _, err := os.Stat(path); err != nil { t.Fatal("The shard's copy was moved:", err) }
+
+    // prune deletes stray files instead
+    stray := types.Id(RandomData(32))
+    path, _ = osStore.PathForId(stray)
+    os.MkdirAll(filepath.Dir(path), 0700)
+    ioutil.WriteFile(path, RandomData(20), 0600)
+    report, err = osStore.Fsck(FsckPrune)
+    if err != nil { t.Fatal(err) }
+    if len(report.Problems) != 1 || !report.Problems[0].Repaired {
+        t.Fatal("Wrong problems when pruning:", report.Problems)
+    }
+    if _, err := os.Stat(path); !os.IsNotExist(err) { t.Fatal("Stray file was not pruned") }
+}
+
+// a primary that fails after a number of opens, & serves corrupt data for one id
+type faultySource struct {
+    ReplicaSource
+    opens int // before failing, -1 for never
+    corrupt types.Id
+    ranges []byte // the ranges whose items were fetched
+    rangeFetches int
+}
+
+func (this *faultySource) RangeItems(ctx context.Context, prefixes []byte) (map[byte][]ItemMeta, error) {
+    this.ranges = append(this.ranges, prefixes...)
+    this.rangeFetches++
+    return this.ReplicaSource.RangeItems(ctx, prefixes)
+}
+
+func (this *faultySource) Open(id types.Id) (Blob, error) {
+    if this.opens == 0 { return nil, fmt.Errorf("Interrupted") }
+    this.opens--
+    if bytes.Equal(id, this.corrupt) {
+        return memBlob{bytes.NewReader(make([]byte, 10))}, nil
+    }
+    return this.ReplicaSource.Open(id)
+}
+
+func TestReplication(t *testing.T) {
+    primaryStorer, _ := NewMemStore(TestIdentity, -1)
+    primary := primaryStorer.(*MemStore)
+    replicaStorer, err := NewOSStore("../.testStore", TestIdentity, -1, nil)
+    if err != nil { t.Fatal(err) }
+    defer replicaStorer.Delete()
+    replica := replicaStorer.(*OSStore)
+    ids := []types.Id{}
+    for i := 0; i < 5; i++ {
+        id, err := primary.StoreItem(ItemMeta{Size: 10, Sender: "sender"}, bytes.NewReader(RandomData(10)))
+        if err != nil { t.Fatal(err) }
+        ids = append(ids, id)
+    }
+    source := &faultySource{primary, 2, nil, nil, 0}
+    replicator := NewReplicator(source, replica, replica.Index)
+    replicator.BatchSize = 2
+
+    // interrupted, then resumed
+    copied, err := replicator.Pull(context.Background())
+    if err == nil || copied != 2 {
+        t.Fatal(fmt.Sprintf("Expected an interrupted pull after 2 items, copied %v: %v", copied, err))
+    }
+    source.opens = -1
+    copied, err = replicator.Pull(context.Background())
+    if err != nil || copied != 3 {
+        t.Fatal(fmt.Sprintf("Expected the pull to resume with 3 items, copied %v: %v", copied, err))
+    }
+    for _, id := range ids {
+        original, _ := primary.Stat(id)
+        replicated, err := replica.Stat(id)
+        if err != nil { t.Fatal(err) }
+        if replicated.Sender != "sender" || !replicated.Received.Equal(original.Received) || !bytes.Equal(replicated.Hash, original.Hash) {
+            t.Fatal(fmt.Sprintf("Copy has the wrong meta: %v", replicated))
+        }
+    }
+
+    // a corrupt copy is refused
+    data := RandomData(10)
+    corruptId, _ := primary.StoreContent(bytes.NewReader(data), 10)
+    source.corrupt = corruptId
+    copied, err = replicator.Pull(context.Background())
+    if err != nil || copied != 0 {
+        t.Fatal(fmt.Sprintf("Expected the corrupt copy to be skipped, copied %v: %v", copied, err))
+    }
+    if _, err := replica.Stat(corruptId); err != ErrNotFound {
+        t.Fatal("Expected no copy of the corrupt item:", err)
+    }
+
+    // reconciliation catches what pulls missed
+    source.corrupt = nil
+    replica.Remove(ids[1])
+    extra := types.Id(RandomData(32))
+    replica.Store(extra, RandomData(10))
+    replicator.Prune = true
+    copied, removed, err := replicator.Reconcile(context.Background())
+    if err != nil || copied != 2 || removed != 1 {
+        t.Fatal(fmt.Sprintf("Expected 2 copied & 1 removed, got %v & %v: %v", copied, removed, err))
+    }
+    differing := map[byte]bool{ids[1][0]: true, extra[0]: true, corruptId[0]: true}
+    if len(source.ranges) != len(differing) {
+        t.Fatal(fmt.Sprintf("Expected only the %v differing ranges fetched, got %v", len(differing), source.ranges))
+    }
+    for _, prefix := range source.ranges {
+        if !differing[prefix] { t.Fatal("Expected range", prefix, "not to be fetched") }
+    }
+    if source.rangeFetches != 1 { t.Fatal("Expected the differing ranges fetched at once, got", source.rangeFetches, "fetches") }
+    source.ranges = nil
+    copied, removed, err = replicator.Reconcile(context.Background())
+    if err != nil || copied != 0 || removed != 0 {
+        t.Fatal(fmt.Sprintf("Expected nothing left to reconcile, got %v & %v: %v", copied, removed, err))
+    }
+    if len(source.ranges) != 0 { t.Fatal("Expected no ranges fetched once reconciled:", source.ranges) }
+    if _, err := replica.Stat(corruptId); err != nil {
+        t.Fatal("Expected the item to be copied by reconciliation:", err)
+    }
+}
+
+func TestArchive(t *testing.T) {
+    rootDir := "../.testStorehouse"
+    os.RemoveAll(rootDir)
+    defer os.RemoveAll(rootDir)
+    sourceStorer, _ := NewMemStore(TestIdentity, 5000)
+    source := sourceStorer.(*MemStore)
+    datas := [][]byte{}
+    for i := 0; i < 3; i++ {
+        data := RandomData(uint(100 + i))
+        _, err := source.StoreItem(ItemMeta{Size: int64(len(data)), Sender: "sender"}, bytes.NewReader(data))
+        if err != nil { t.Fatal(err) }
+        datas = append(datas, data)
+    }
+    archive := &bytes.Buffer{}
+    manifest, err := ExportArchive(source, archive, 0)
+    if err != nil { t.Fatal(err) }
+    if len(manifest.Items) != 3 || manifest.Next != 4 {
+        t.Fatal(fmt.Sprintf("Wrong manifest: %v items, next %v", len(manifest.Items), manifest.Next))
+    }
+    full := archive.Bytes()
+
+    // a corrupt archive is refused, & leaves no store behind
+    corrupt := append([]byte{}, full...)
+    at := bytes.Index(corrupt, datas[1])
+    corrupt[at] ^= 0xff
+    storehouser, err := NewOSStorehouser(rootDir)
+    if err != nil { t.Fatal(err) }
+    defer storehouser.Close()
+    if _, err := storehouser.(*OSStorehouser).Import(bytes.NewReader(corrupt)); err != ErrArchiveChecksum {
+        t.Fatal("Expected ErrArchiveChecksum, got", err)
+    }
+    if storer, _ := storehouser.GetStorer(TestIdentity); storer != nil {
+        t.Fatal("Expected the failed import to be deallocated")
+    }
+
+    _, err = storehouser.(*OSStorehouser).Import(bytes.NewReader(full))
+    if err != nil { t.Fatal(err) }
+    storer, _ := storehouser.GetStorer(TestIdentity)
+    store := storer.(*OSStore)
+    if used, capacity := store.Size(); used != 303 || capacity != 5000 {
+        t.Fatal(fmt.Sprintf("Wrong size after import: %v of %v", used, capacity))
+    }
+
+    // then the items added since
+    data := RandomData(50)
+    source.Store(ContentId(data), data)
+    datas = append(datas, data)
+    archive.Reset()
+    _, err = ExportArchive(source, archive, manifest.Next)
+    if err != nil { t.Fatal(err) }
+    manifest, err = storehouser.(*OSStorehouser).Import(archive)
+    if err != nil { t.Fatal(err) }
+    if len(manifest.Items) != 1 { t.Fatal("Expected an incremental archive of 1 item, got", len(manifest.Items)) }
+
+    items, _ := store.QueryItems(ItemQuery{})
+    originals, _ := source.QueryItems(ItemQuery{})
+    if len(items) != 4 { t.Fatal("Expected 4 items, got", len(items)) }
+    for i, item := range items {
+        if !bytes.Equal(item.Id, originals[i].Id) || item.Sender != originals[i].Sender || !item.Received.Equal(originals[i].Received) {
+            t.Fatal(fmt.Sprintf("Item %v differs: %v", i, item))
+        }
+        blob, err := store.Open(item.Id)
+        if err != nil { t.Fatal(err) }
+        read := make([]byte, blob.Size())
+        blob.ReadAt(read, 0)
+        blob.Close()
+        if !bytes.Equal(read, datas[i]) { t.Fatal("Wrong data for item", i) }
+    }
+}
+
+func TestBtree(t *testing.T) {
+    tree := btree{}
+    expected := map[string]string{}
+    for i := 0; i < 5000; i++ {
+        random := RandomData(2)
+        key := fmt.Sprintf("%04d", int(random[0]) * 4 + int(random[1]) % 4)
+        if RandomData(1)[0] % 3 == 0 {
+            _, had := expected[key]
+            if tree.Delete(key) != had { t.Fatal("Delete disagrees about", key) }
+            delete(expected, key)
+        } else {
+            tree.Set(key, strconv.Itoa(i))
+            expected[key] = strconv.Itoa(i)
+        }
+    }
+    if tree.Len() != len(expected) {
+        t.Fatal(fmt.Sprintf("Expected %v keys, got %v", len(expected), tree.Len()))
+    }
+    last, count := "0500", 0
+    tree.Ascend("0500", func(key, value string) bool {
+        if key < last || expected[key] != value { t.Fatal("Out of order or wrong value at", key) }
+        last = key
+        count++
+        return true
+    })
+    for key := range expected {
+        if key >= "0500" { count-- }
+    }
+    if count != 0 { t.Fatal("Ascend missed or repeated keys:", count) }
+}
+
+func TestLogIndex(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "index.log")
+    index, err := NewLogIndex(file)
+    if err != nil { t.Fatal(err) }
+    index.Set("a", "1")
+    first := types.Id(RandomData(32))
+    index.AddItemMeta(ItemMeta{Id: first, Size: 10, Sender: "sender"})
+    second := types.Id(RandomData(32))
+    tx, _ := index.Transaction()
+    tx.AddItem(second)
+    tx.Set("b", "2")
+    tx.Commit()
+    index.Close()
+
+    // a torn commit is dropped on reopening
+    logFile, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+    logFile.Write([]byte("0badc0de [{\"Op\":\"set\",\"Key\":\"c\""))
+    logFile.Close()
+    index, err = OpenLogIndex(file)
+    if err != nil { t.Fatal(err) }
+    if value, _ := index.Get("b"); value != "2" { t.Fatal("Expected b=2 after replay, got", value) }
+    if _, err := index.Get("c"); err != ErrNotFound { t.Fatal("Expected the torn commit to be dropped") }
+    meta, err := index.GetItem(first)
+    if err != nil || meta.Counter != 1 || meta.Sender != "sender" {
+        t.Fatal(fmt.Sprintf("Wrong item after replay: %v %v", meta, err))
+    }
+
+    // compaction keeps the state, & counters are not reused
+    tx, _ = index.Transaction()
+    tx.DeleteItem(second)
+    tx.Commit()
+    err = index.Compact()
+    if err != nil { t.Fatal(err) }
+    index.Close()
+    index, err = OpenLogIndex(file)
+    if err != nil { t.Fatal(err) }
+    defer index.Close()
+    if value, _ := index.Get("a"); value != "1" { t.Fatal("Expected a=1 after compaction, got", value) }
+    counter, _ := index.AddItem(types.Id(RandomData(32)))
+    if counter != 3 { t.Fatal("Expected counter 3 after compaction, got", counter) }
+    // one process at a time, as the state is in memory
+    if _, err := OpenLogIndex(file); err != ErrIndexInUse {
+        t.Fatal("Expected a second open to fail with ErrIndexInUse, got", err)
+    }
+    if _, err := OpenLogIndex(file + ".missing"); err == nil {
+        t.Fatal("Expected opening a missing log to fail")
+    }
+
+    // a bad commit before the end fails the open, & the log is kept
+    corrupt := filepath.Join(t.TempDir(), "corrupt.log")
+    index, _ = NewLogIndex(corrupt)
+    index.Set("x", "1")
+    index.Set("y", "2")
+    index.Close()
+    data, _ := ioutil.ReadFile(corrupt)
+    lines := bytes.SplitAfter(data, []byte("\n"))
+    lines[1][12] ^= 1
+    ioutil.WriteFile(corrupt, bytes.Join(lines, nil), 0600)
+    if _, err := OpenLogIndex(corrupt); err != ErrLogCorrupt {
+        t.Fatal("Expected ErrLogCorrupt, got", err)
+    }
+    if info, _ := os.Stat(corrupt); info.Size() != int64(len(data)) {
+        t.Fatal("A corrupt log was truncated to", info.Size())
+    }
+
+    // a log from a newer version is refused
+    newer := filepath.Join(t.TempDir(), "newer.log")
+    index, _ = NewLogIndex(newer)
+    index.Set(MetaSchemaVersion, strconv.Itoa(CurrentSchemaVersion + 1))
+    index.Close()
+    if _, err := OpenLogIndex(newer); err != ErrSchemaTooNew {
+        t.Fatal("Expected ErrSchemaTooNew, got", err)
+    }
+}
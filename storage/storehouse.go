@@ -0,0 +1,238 @@
+package storage
+
+import (
+    "context"
+    "io"
+    "sort"
+    "sync"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+    "path/filepath"
+    "github.com/jaekwon/go-prelude/fs"
+    "github.com/jaekwon/gourami/types"
+)
+
+var ErrAlreadyAllocated error = errors.New("A store is already allocated for this owner")
+
+/* A Storehouser manages many Storers, one per owner
+ */
+type Storehouser interface {
+    AllocateStorer(owner *types.Identity, capacity int64) (Storer, error)
+    GetStorer(owner *types.Identity) (Storer, error) // nil if owner has no store
+    DeallocateStorer(owner *types.Identity) error
+    Close() error // closes every Storer handed out
+}
+
+/* The OSStorehouser keeps an OSStore per owner under RootDir/stores,
+ *  in a directory named by the owner's public key.
+ * A registry index under RootDir records each owner's allocated capacity,
+ *  & counts the references to the blobs the stores share in RootDir/blobs.
+ */
+type OSStorehouser struct {
+    RootDir string
+    Registry Index
+    Pool *BlobPool
+
+    mtx sync.Mutex
+    stores map[string]*OSStore // opened stores by owner key
+    sweepCursor string // the owner key the next SweepExpired starts from
+}
+
+const registryPrefix = "owner:"
+
+func (this *OSStorehouser) storeDir(ownerKey string) string {
+    return filepath.Join(this.RootDir, "stores", ownerKey)
+}
+
+func (this *OSStorehouser) AllocateStorer(owner *types.Identity, capacity int64) (Storer, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    ownerKey := types.KeyToString(owner.PublicKey)
+    _, err := this.Registry.Get(registryPrefix + ownerKey)
+    if err == nil { return nil, ErrAlreadyAllocated }
+    if err != ErrNotFound { return nil, err }
+    storer, err := NewOSStore(this.storeDir(ownerKey), owner, capacity, this.Pool)
+    if err != nil { return nil, err }
+    err = this.Registry.Set(registryPrefix + ownerKey, strconv.FormatInt(capacity, 10))
+    if err != nil {
+        storer.Delete()
+        return nil, err
+    }
+    this.stores[ownerKey] = storer.(*OSStore)
+    return storer, nil
+}
+
+func (this *OSStorehouser) GetStorer(owner *types.Identity) (Storer, error) {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    store, err := this.getStore(owner)
+    if store == nil {
+        return nil, err // avoid a non-nil interface holding a nil *OSStore
+    }
+    return store, err
+}
+
+// open the store for owner if needed. caller must hold this.mtx
+func (this *OSStorehouser) getStore(owner *types.Identity) (*OSStore, error) {
+    ownerKey := types.KeyToString(owner.PublicKey)
+    if store, ok := this.stores[ownerKey]; ok { return store, nil }
+    _, err := this.Registry.Get(registryPrefix + ownerKey)
+    if err == ErrNotFound { return nil, nil }
+    if err != nil { return nil, err }
+    store, err := OpenOSStore(this.storeDir(ownerKey), owner, this.Pool)
+    if err != nil { return nil, err }
+    this.stores[ownerKey] = store
+    return store, nil
+}
+
+/* Delete the owner's store and everything in it.
+ */
+func (this *OSStorehouser) DeallocateStorer(owner *types.Identity) error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    ownerKey := types.KeyToString(owner.PublicKey)
+    store, err := this.getStore(owner)
+    if err != nil { return err }
+    if store == nil { return ErrNotFound }
+    // the registry entry outlives a failed delete, so it can be retried
+    delete(this.stores, ownerKey)
+    err = store.Delete()
+    if err != nil { return err }
+    return this.Registry.Delete(registryPrefix + ownerKey)
+}
+
+/* The capacity allocated to each owner, by owner key
+ */
+func (this *OSStorehouser) Allocations() (map[string]int64, error) {
+    allocations := map[string]int64{}
+    entries := this.Registry.Find(context.Background(), registryPrefix, -1)
+    defer entries.Close()
+    for entries.Next() {
+        if !strings.HasPrefix(entries.Key(), registryPrefix) { break }
+        capacity, err := strconv.ParseInt(entries.Value(), 10, 64)
+        if err != nil { return nil, err }
+        allocations[strings.TrimPrefix(entries.Key(), registryPrefix)] = capacity
+    }
+    return allocations, entries.Err()
+}
+
+// Check the owner's store; see OSStore.Fsck
+func (this *OSStorehouser) Fsck(owner *types.Identity, options FsckOptions) (*FsckReport, error) {
+    this.mtx.Lock()
+    store, err := this.getStore(owner)
+    this.mtx.Unlock()
+    if err != nil { return nil, err }
+    if store == nil { return nil, ErrNotFound }
+    return store.Fsck(options)
+}
+
+/* Import an archive made by ExportArchive, into a store allocated for its
+ *  owner with its capacity. Archives exported from a counter are imported
+ *  into the owner's existing store instead.
+ * A store allocated for a failed import is deallocated again.
+ */
+func (this *OSStorehouser) Import(reader io.Reader) (*ArchiveManifest, error) {
+    var owner *types.Identity
+    allocated := false
+    manifest, err := ImportArchive(reader, func(manifest *ArchiveManifest) (ImportableStorer, error) {
+        var err error
+        owner, err = types.StringToIdentity(manifest.Owner)
+        if err != nil { return nil, err }
+        if manifest.Since > 0 {
+            storer, err := this.GetStorer(owner)
+            if err == nil && storer == nil { err = ErrNotFound }
+            if err != nil { return nil, err }
+            return storer.(*OSStore), nil
+        }
+        storer, err := this.AllocateStorer(owner, manifest.Capacity)
+        if err != nil { return nil, err }
+        allocated = true
+        return storer.(*OSStore), nil
+    })
+    if err != nil && allocated {
+        this.DeallocateStorer(owner) }
+    return manifest, err
+}
+
+/* Remove up to limit expired items across all stores.
+ * Stores are swept in order of owner key, each batch starting after the
+ *  store where the last one filled up, so every store gets its turn.
+ */
+func (this *OSStorehouser) SweepExpired(now time.Time, limit int) (int, error) {
+    allocations, err := this.Allocations()
+    if err != nil { return 0, err }
+    ownerKeys := []string{}
+    for ownerKey := range allocations { ownerKeys = append(ownerKeys, ownerKey) }
+    sort.Strings(ownerKeys)
+    this.mtx.Lock()
+    start := sort.SearchStrings(ownerKeys, this.sweepCursor)
+    this.mtx.Unlock()
+    removed := 0
+    for i := range ownerKeys {
+        ownerKey := ownerKeys[(start + i) % len(ownerKeys)]
+        n, err := this.sweepStore(ownerKey, now, limit - removed)
+        removed += n
+        if err != nil { return removed, err }
+        if removed >= limit {
+            this.mtx.Lock()
+            this.sweepCursor = ownerKeys[(start + i + 1) % len(ownerKeys)]
+            this.mtx.Unlock()
+            break
+        }
+    }
+    return removed, nil
+}
+
+/* Sweep the owner's store. A store that isn't open is opened just for the
+ *  sweep & closed after, so sweeping doesn't hold every store open.
+ */
+func (this *OSStorehouser) sweepStore(ownerKey string, now time.Time, limit int) (int, error) {
+    this.mtx.Lock()
+    if store, ok := this.stores[ownerKey]; ok {
+        this.mtx.Unlock()
+        return store.SweepExpired(now, limit)
+    }
+    // keep GetStorer from opening the store meanwhile
+    defer this.mtx.Unlock()
+    owner, err := types.StringToIdentity(ownerKey)
+    if err != nil { return 0, err }
+    _, err = this.Registry.Get(registryPrefix + ownerKey)
+    if err == ErrNotFound { return 0, nil } // deallocated meanwhile
+    if err != nil { return 0, err }
+    store, err := OpenOSStore(this.storeDir(ownerKey), owner, this.Pool)
+    if err != nil { return 0, err }
+    defer store.Close()
+    return store.SweepExpired(now, limit)
+}
+
+func (this *OSStorehouser) Close() error {
+    this.mtx.Lock()
+    defer this.mtx.Unlock()
+    var err error
+    for ownerKey, store := range this.stores {
+        if cerr := store.Close(); cerr != nil && err == nil { err = cerr }
+        delete(this.stores, ownerKey)
+    }
+    if cerr := this.Registry.Close(); cerr != nil && err == nil { err = cerr }
+    return err
+}
+
+func NewOSStorehouser(rootDir string) (Storehouser, error) {
+    _, err := fs.EnsureDir(filepath.Join(rootDir, "stores"))
+    if err != nil { return nil, err }
+    registry, err := OpenIndexIn(rootDir, "registry", true)
+    if err != nil { return nil, err }
+    pool, err := NewBlobPool(filepath.Join(rootDir, "blobs"), registry)
+    if err != nil {
+        registry.Close()
+        return nil, err
+    }
+    return &OSStorehouser{
+        RootDir: rootDir,
+        Registry: registry,
+        Pool: pool,
+        stores: map[string]*OSStore{},
+    }, nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+    "strconv"
+    "github.com/jaekwon/gourami/types"
+)
+
+/* Usage accounting shared by the stores.
+ * A store's usage, capacity & soft limit are meta in its Index. Capacity
+ *  is reserved for writes in progress, so concurrent writes can't overshoot it.
+ */
+
+type metaGetter interface {
+    Get(key string) (string, error)
+}
+
+// usage & capacity, -1 if unknown
+func indexSize(index metaGetter) (int64, int64) {
+    return metaInt64(index, MetaUsed, 0), metaInt64(index, MetaCapacity, -1)
+}
+
+// the soft limit in bytes, or -1 if capacity is unknown
+func indexSoftLimit(index metaGetter) int64 {
+    capacity := metaInt64(index, MetaCapacity, -1)
+    if capacity < 0 { return -1 }
+    return metaInt64(index, MetaSoftLimit, capacity * DefaultSoftLimitPercent / 100)
+}
+
+// whether usage going from used to newUsed crosses the soft limit
+func crossesSoftLimit(index metaGetter, used int64, newUsed int64) bool {
+    softLimit := indexSoftLimit(index)
+    return softLimit >= 0 && used < softLimit && newUsed >= softLimit
+}
+
+// record a change in usage within tx
+func addUsage(tx Transaction, used int64, delta int64) error {
+    used += delta
+    if used < 0 { used = 0 }
+    return tx.Set(MetaUsed, strconv.FormatInt(used, 10))
+}
+
+// add item & its size to the usage, in one index transaction
+func addItemUsage(index Index, item ItemMeta) error {
+    used, _ := indexSize(index)
+    tx, err := index.Transaction()
+    if err != nil { return err }
+    err = tx.AddItemMeta(item)
+    if err == nil {
+        err = addUsage(tx, used, item.Size) }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+// delete id's item & credit size back to the usage, in one index transaction.
+// returns whether the item existed
+func deleteItemUsage(index Index, id types.Id, size int64) (bool, error) {
+    used, _ := indexSize(index)
+    tx, err := index.Transaction()
+    if err != nil { return false, err }
+    existed, err := tx.DeleteItem(id)
+    if err == nil {
+        err = addUsage(tx, used, -size) }
+    if err != nil {
+        tx.Rollback()
+        return false, err
+    }
+    return existed, tx.Commit()
+}
+
+// capacity held for writes in progress, guarded by its store's lock
+type reservations struct {
+    reserved int64
+}
+
+// check that size fits, counting other writes in progress, & hold it
+func (this *reservations) reserve(index metaGetter, size int64) error {
+    used, capacity := indexSize(index)
+    used += this.reserved
+    if capacity >= 0 && used + size > capacity {
+        return &CapacityError{used, capacity, size}
+    }
+    this.reserved += size
+    return nil
+}
+
+func (this *reservations) release(size int64) {
+    this.reserved -= size
+}
@@ -49,3 +49,19 @@ func NewIdentity(publicKey []byte, privateKey []byte) (*Identity, error) {
 func KeyToString(key *[32]byte) string {
     return base64.URLEncoding.EncodeToString(key[:])
 }
+
+func StringToKey(s string) (*[32]byte, error) {
+    keyBytes, err := base64.URLEncoding.DecodeString(s)
+    if err != nil { return nil, err }
+    if len(keyBytes) != 32 { return nil, errors.New("Invalid key length") }
+    var key [32]byte
+    copy(key[:], keyBytes)
+    return &key, nil
+}
+
+// Parse a public identity as written by KeyToString
+func StringToIdentity(s string) (*Identity, error) {
+    key, err := StringToKey(s)
+    if err != nil { return nil, err }
+    return &Identity{key, nil}, nil
+}